@@ -382,7 +382,15 @@ func get(ctx context.Context, envInfo *cmds.Agent, proxy proxy.Proxy) (*config.N
 	apiServerURL := proxy.APIServerURL()
 
 	var flannelIface *net.Interface
-	if controlConfig.FlannelBackend != config.FlannelBackendNone && len(envInfo.FlannelIface) > 0 {
+	var flannelIfaces []string
+	if controlConfig.FlannelBackend != config.FlannelBackendNone && strings.Contains(envInfo.FlannelIface, ",") {
+		// Flannel uses the first of the listed interfaces that is usable when it starts
+		for _, name := range strings.Split(envInfo.FlannelIface, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				flannelIfaces = append(flannelIfaces, name)
+			}
+		}
+	} else if controlConfig.FlannelBackend != config.FlannelBackendNone && len(envInfo.FlannelIface) > 0 {
 		flannelIface, err = net.InterfaceByName(envInfo.FlannelIface)
 		if err != nil {
 			return nil, errors.Wrapf(err, "unable to find interface %s", envInfo.FlannelIface)
@@ -551,6 +559,8 @@ func get(ctx context.Context, envInfo *cmds.Agent, proxy proxy.Proxy) (*config.N
 		Token:                    info.String(),
 	}
 	nodeConfig.FlannelIface = flannelIface
+	nodeConfig.FlannelIfaces = flannelIfaces
+	nodeConfig.FlannelIfaceExclude = envInfo.FlannelIfaceExclude
 	nodeConfig.Images = filepath.Join(envInfo.DataDir, "agent", "images")
 	nodeConfig.AgentConfig.NodeName = nodeName
 	nodeConfig.AgentConfig.NodeConfigPath = nodeConfigPath
@@ -643,14 +653,23 @@ func get(ctx context.Context, envInfo *cmds.Agent, proxy proxy.Proxy) (*config.N
 			nodeConfig.FlannelConfFile = envInfo.FlannelConf
 			nodeConfig.FlannelConfOverride = true
 		}
+		nodeConfig.FlannelReadyFile = filepath.Join(envInfo.DataDir, "agent", "etc", "flannel", "ready")
 		nodeConfig.AgentConfig.CNIBinDir = filepath.Dir(hostLocal)
 		nodeConfig.AgentConfig.CNIConfDir = filepath.Join(envInfo.DataDir, "agent", "etc", "cni", "net.d")
 		nodeConfig.AgentConfig.FlannelCniConfFile = envInfo.FlannelCniConfFile
+		nodeConfig.AgentConfig.FlannelCniConfTemplate = envInfo.FlannelCniConfTemplate
+		nodeConfig.AgentConfig.CNIConfForce = envInfo.FlannelCniConfForce
 
 		// It does not make sense to use VPN without its flannel backend
 		if envInfo.VPNAuth != "" {
 			nodeConfig.FlannelBackend = vpnInfo.ProviderName
 		}
+	} else if envInfo.FlannelCniConfFile != "" || envInfo.FlannelCniConfTemplate != "" {
+		// Flannel is not run, but a CNI conf has been provided to lay down
+		nodeConfig.AgentConfig.CNIConfDir = filepath.Join(envInfo.DataDir, "agent", "etc", "cni", "net.d")
+		nodeConfig.AgentConfig.FlannelCniConfFile = envInfo.FlannelCniConfFile
+		nodeConfig.AgentConfig.FlannelCniConfTemplate = envInfo.FlannelCniConfTemplate
+		nodeConfig.AgentConfig.CNIConfForce = envInfo.FlannelCniConfForce
 	}
 
 	if nodeConfig.Docker {
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package flannel
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+func addDeathSig(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Pdeathsig: syscall.SIGKILL,
+	}
+}
@@ -0,0 +1,7 @@
+package flannel
+
+import "os/exec"
+
+func addDeathSig(_ *exec.Cmd) {
+	// not supported in this OS
+}
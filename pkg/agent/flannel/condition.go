@@ -0,0 +1,96 @@
+package flannel
+
+import (
+	"context"
+
+	"github.com/k3s-io/k3s/pkg/daemons/config"
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+// FlannelReadyCondition is the node condition that reports whether flannel is up on the node. It is
+// False, with the error as its message, if flannel could not be set up or exited.
+const FlannelReadyCondition v1.NodeConditionType = "FlannelReady"
+
+// Reasons for the FlannelReady condition
+const (
+	flannelStartedReason     = "FlannelStarted"
+	flannelSetupFailedReason = "FlannelSetupFailed"
+	flannelFailedReason      = "FlannelFailed"
+)
+
+// setFlannelReady sets the FlannelReady condition of the node. The node status is only updated if the
+// condition changed, and the transition time is kept if only the reason or message changed.
+func setFlannelReady(ctx context.Context, nodes typedcorev1.NodeInterface, nodeName string, status v1.ConditionStatus, reason, message string) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		node, err := nodes.Get(ctx, nodeName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		now := metav1.Now()
+		condition := v1.NodeCondition{
+			Type:               FlannelReadyCondition,
+			Status:             status,
+			Reason:             reason,
+			Message:            message,
+			LastHeartbeatTime:  now,
+			LastTransitionTime: now,
+		}
+		node = node.DeepCopy()
+		found := false
+		for i, c := range node.Status.Conditions {
+			if c.Type != FlannelReadyCondition {
+				continue
+			}
+			if c.Status == status && c.Reason == reason && c.Message == message {
+				return nil
+			}
+			if c.Status == status {
+				condition.LastTransitionTime = c.LastTransitionTime
+			}
+			node.Status.Conditions[i] = condition
+			found = true
+		}
+		if !found {
+			node.Status.Conditions = append(node.Status.Conditions, condition)
+		}
+		_, err = nodes.UpdateStatus(ctx, node, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// reportFlannelReady sets the FlannelReady condition of the node, logging rather than returning a
+// failure, as the condition only reports on flannel and must not stop it.
+func reportFlannelReady(ctx context.Context, lf logrus.Fields, nodes typedcorev1.NodeInterface, nodeName string, status v1.ConditionStatus, reason, message string) {
+	if err := setFlannelReady(ctx, nodes, nodeName, status, reason, message); err != nil {
+		logrus.WithFields(lf).Warnf("Failed to set the %s node condition: %v", FlannelReadyCondition, err)
+	}
+}
+
+// conditionRunner wraps run so that the FlannelReady condition follows each run of flannel: True once
+// flannel is up, and False with the error if the run fails.
+func conditionRunner(lf logrus.Fields, nodeConfig *config.Node, nodes typedcorev1.NodeInterface, run func(ctx context.Context) error) func(ctx context.Context) error {
+	nodeName := nodeConfig.AgentConfig.NodeName
+	return func(ctx context.Context) error {
+		// Waiting for flannel to be up is stopped once the run returns, and has finished before a failure
+		// is reported, so that the condition cannot be set back to True afterwards
+		readyCtx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if err := Ready(readyCtx, nodeConfig); err == nil {
+				reportFlannelReady(readyCtx, lf, nodes, nodeName, v1.ConditionTrue, flannelStartedReason, "flannel is up")
+			}
+		}()
+		err := run(ctx)
+		cancel()
+		<-done
+		if err != nil && ctx.Err() == nil {
+			reportFlannelReady(ctx, lf, nodes, nodeName, v1.ConditionFalse, flannelFailedReason, err.Error())
+		}
+		return err
+	}
+}
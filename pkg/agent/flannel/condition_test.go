@@ -0,0 +1,188 @@
+package flannel
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/k3s/pkg/daemons/config"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// flannelReady returns the FlannelReady condition of the node, or nil if it is not set.
+func flannelReady(t *testing.T, client *fake.Clientset, nodeName string) *v1.NodeCondition {
+	t.Helper()
+	node, err := client.CoreV1().Nodes().Get(context.Background(), nodeName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range node.Status.Conditions {
+		if node.Status.Conditions[i].Type == FlannelReadyCondition {
+			return &node.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+func assertFlannelReady(t *testing.T, client *fake.Clientset, nodeName string, status v1.ConditionStatus, reason, message string) *v1.NodeCondition {
+	t.Helper()
+	got := flannelReady(t, client, nodeName)
+	if got == nil {
+		t.Fatalf("node has no %s condition, want %s", FlannelReadyCondition, status)
+	}
+	if got.Status != status || got.Reason != reason || got.Message != message {
+		t.Errorf("%s condition = %s %s %q, want %s %s %q", FlannelReadyCondition, got.Status, got.Reason, got.Message, status, reason, message)
+	}
+	return got
+}
+
+func Test_setFlannelReady(t *testing.T) {
+	ready := v1.NodeCondition{Type: v1.NodeReady, Status: v1.ConditionTrue}
+	client := fake.NewSimpleClientset(&v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "self"},
+		Status:     v1.NodeStatus{Conditions: []v1.NodeCondition{ready}},
+	})
+	nodes := client.CoreV1().Nodes()
+	ctx := context.Background()
+
+	if err := setFlannelReady(ctx, nodes, "self", v1.ConditionFalse, flannelFailedReason, "flanneld exited"); err != nil {
+		t.Fatalf("setFlannelReady() error = %v", err)
+	}
+	failed := assertFlannelReady(t, client, "self", v1.ConditionFalse, flannelFailedReason, "flanneld exited")
+
+	// The same condition is not written again
+	client.ClearActions()
+	if err := setFlannelReady(ctx, nodes, "self", v1.ConditionFalse, flannelFailedReason, "flanneld exited"); err != nil {
+		t.Fatalf("setFlannelReady() error = %v", err)
+	}
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "update" {
+			t.Errorf("setFlannelReady() updated the node status without a change")
+		}
+	}
+
+	// A new message for the same status keeps the transition time
+	if err := setFlannelReady(ctx, nodes, "self", v1.ConditionFalse, flannelFailedReason, "flanneld exited again"); err != nil {
+		t.Fatalf("setFlannelReady() error = %v", err)
+	}
+	got := assertFlannelReady(t, client, "self", v1.ConditionFalse, flannelFailedReason, "flanneld exited again")
+	if !got.LastTransitionTime.Equal(&failed.LastTransitionTime) {
+		t.Errorf("LastTransitionTime = %v, want %v", got.LastTransitionTime, failed.LastTransitionTime)
+	}
+
+	if err := setFlannelReady(ctx, nodes, "self", v1.ConditionTrue, flannelStartedReason, "flannel is up"); err != nil {
+		t.Fatalf("setFlannelReady() error = %v", err)
+	}
+	got = assertFlannelReady(t, client, "self", v1.ConditionTrue, flannelStartedReason, "flannel is up")
+	if got.LastTransitionTime.Equal(&failed.LastTransitionTime) {
+		t.Errorf("LastTransitionTime was not updated on the transition to True")
+	}
+
+	// Other conditions are left alone
+	node, err := nodes.Get(ctx, "self", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(node.Status.Conditions) != 2 || node.Status.Conditions[0] != ready {
+		t.Errorf("node conditions = %v, want %s and %s", node.Status.Conditions, v1.NodeReady, FlannelReadyCondition)
+	}
+}
+
+func Test_setFlannelReadyConflict(t *testing.T) {
+	client := fake.NewSimpleClientset(&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "self"}})
+	conflicts := 2
+	client.PrependReactor("update", "nodes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() == "status" && conflicts > 0 {
+			conflicts--
+			return true, nil, apierrors.NewConflict(schema.GroupResource{Resource: "nodes"}, "self", errors.New("modified"))
+		}
+		return false, nil, nil
+	})
+	if err := setFlannelReady(context.Background(), client.CoreV1().Nodes(), "self", v1.ConditionTrue, flannelStartedReason, "flannel is up"); err != nil {
+		t.Fatalf("setFlannelReady() error = %v", err)
+	}
+	if conflicts != 0 {
+		t.Errorf("setFlannelReady() did not retry after conflicts")
+	}
+	assertFlannelReady(t, client, "self", v1.ConditionTrue, flannelStartedReason, "flannel is up")
+}
+
+func Test_conditionRunner(t *testing.T) {
+	oldInterfaceExists, oldSubnetFileWritten := interfaceExists, subnetFileWritten
+	t.Cleanup(func() { interfaceExists, subnetFileWritten = oldInterfaceExists, oldSubnetFileWritten })
+	interfaceExists = func(string) bool { return true }
+	subnetFileWritten = func(string) bool { return true }
+
+	client := fake.NewSimpleClientset(&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "self"}})
+	nodeConfig := &config.Node{FlannelBackend: config.FlannelBackendVXLAN}
+	nodeConfig.AgentConfig.NodeName = "self"
+	nodeConfig.AgentConfig.ClusterCIDRs = stringToCIDR("10.42.0.0/16")
+
+	// Flannel comes up, then exits with an error
+	up := make(chan struct{})
+	run := conditionRunner(nil, nodeConfig, client.CoreV1().Nodes(), func(ctx context.Context) error {
+		if err := pollUntil(ctx, func() bool { return flannelReady(t, client, "self") != nil }); err != nil {
+			return err
+		}
+		close(up)
+		return errors.New("lease expired")
+	})
+	if err := run(context.Background()); err == nil {
+		t.Fatal("run() error = nil, want the error of the run")
+	}
+	select {
+	case <-up:
+	default:
+		t.Fatalf("%s condition was not set while flannel was up", FlannelReadyCondition)
+	}
+	assertFlannelReady(t, client, "self", v1.ConditionFalse, flannelFailedReason, "lease expired")
+
+	// A restarted flannel comes up again; the condition is True while it runs
+	run = conditionRunner(nil, nodeConfig, client.CoreV1().Nodes(), func(ctx context.Context) error {
+		return pollUntil(ctx, func() bool { return flannelReady(t, client, "self").Status == v1.ConditionTrue })
+	})
+	if err := run(context.Background()); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	assertFlannelReady(t, client, "self", v1.ConditionTrue, flannelStartedReason, "flannel is up")
+
+	// A cancelled run is not reported as a failure
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	run = conditionRunner(nil, nodeConfig, client.CoreV1().Nodes(), func(ctx context.Context) error { return ctx.Err() })
+	if err := run(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("run() error = %v, want context.Canceled", err)
+	}
+	assertFlannelReady(t, client, "self", v1.ConditionTrue, flannelStartedReason, "flannel is up")
+}
+
+func Test_RunSetupFailedCondition(t *testing.T) {
+	client := fake.NewSimpleClientset(&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "self"}})
+	nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendAlloc)
+	nodeConfig.AgentConfig.NodeName = "self"
+	nodeConfig.FlannelHealthzPort = -1
+	err := Run(context.Background(), nodeConfig, client.CoreV1().Nodes())
+	if err == nil {
+		t.Fatal("Run() error = nil, want an invalid healthz port error")
+	}
+	assertFlannelReady(t, client, "self", v1.ConditionFalse, flannelSetupFailedReason, err.Error())
+}
+
+// pollUntil polls until the condition is met or the context is done.
+func pollUntil(ctx context.Context, condition func() bool) error {
+	for !condition() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package flannel
+
+import (
+	"context"
+	"fmt"
+	"net"
+	goruntime "runtime"
+	"strings"
+	"time"
+
+	"github.com/k3s-io/k3s/pkg/daemons/config"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	utilsnet "k8s.io/utils/net"
+)
+
+const (
+	connectivityProbeInterval   = time.Minute
+	connectivityProbeMaxTargets = 3
+
+	// Size of the echo requests sent to peers, including the IP header
+	connectivityProbeSize = 64
+
+	// connectivityOK is the connectivity annotation value if every probed peer answered
+	connectivityOK = "ok"
+)
+
+// connectivityProbe reports whether the target answered an echo request. It is a variable so that
+// tests can replace it.
+var connectivityProbe = func(target net.IP) (bool, error) {
+	return pingDF(target, connectivityProbeSize)
+}
+
+// connectivityTarget is the PodCIDR gateway of another node.
+type connectivityTarget struct {
+	nodeName string
+	ip       net.IP
+}
+
+func (t connectivityTarget) String() string {
+	return fmt.Sprintf("%s (%s)", t.nodeName, t.ip)
+}
+
+// connectivityTargets returns the PodCIDR gateways of up to connectivityProbeMaxTargets other nodes,
+// in the address family that the flannel underlay uses. The gateway is the first address of the
+// PodCIDR, which the CNI plugin assigns to the bridge on the node.
+func connectivityTargets(ctx context.Context, nodeName string, nodes typedcorev1.NodeInterface, netMode int) ([]connectivityTarget, error) {
+	nodeList, err := nodes.List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	wantIPv6 := netMode == ipv6
+	var targets []connectivityTarget
+	for i := range nodeList.Items {
+		node := &nodeList.Items[i]
+		if node.Name == nodeName {
+			continue
+		}
+		if gateway := podCIDRGateway(node, wantIPv6); gateway != nil {
+			targets = append(targets, connectivityTarget{nodeName: node.Name, ip: gateway})
+		}
+		if len(targets) == connectivityProbeMaxTargets {
+			break
+		}
+	}
+	return targets, nil
+}
+
+// podCIDRGateway returns the first address of the node's PodCIDR in the requested address family,
+// or nil if the node has no such PodCIDR.
+func podCIDRGateway(node *v1.Node, wantIPv6 bool) net.IP {
+	for _, podCIDR := range nodePodCIDRs(node) {
+		_, podNet, err := net.ParseCIDR(podCIDR)
+		if err != nil || utilsnet.IsIPv6CIDR(podNet) != wantIPv6 {
+			continue
+		}
+		return subnetGateway(podNet)
+	}
+	return nil
+}
+
+// probeConnectivity probes each target, and returns the connectivity annotation value that records
+// the result: connectivityOK if every target answered, and otherwise the targets that did not.
+func probeConnectivity(targets []connectivityTarget, probe func(net.IP) (bool, error)) string {
+	var unreachable []string
+	for _, target := range targets {
+		ok, err := probe(target.ip)
+		if err != nil {
+			logrus.Debugf("Failed to probe flannel connectivity to %s: %v", target, err)
+		}
+		if !ok {
+			unreachable = append(unreachable, target.String())
+		}
+	}
+	if len(unreachable) == 0 {
+		return connectivityOK
+	}
+	return "unreachable: " + strings.Join(unreachable, ", ")
+}
+
+// recordConnectivity probes the PodCIDR gateways of other nodes, and sets the connectivity annotation
+// on this node to the result. Nothing is recorded until another node has been assigned a PodCIDR.
+func recordConnectivity(ctx context.Context, lf logrus.Fields, nodeName string, nodes typedcorev1.NodeInterface, netMode int, probe func(net.IP) (bool, error)) error {
+	targets, err := connectivityTargets(ctx, nodeName, nodes, netMode)
+	if err != nil {
+		return errors.Wrap(err, "failed to list nodes")
+	}
+	if len(targets) == 0 {
+		logrus.WithFields(lf).Debug("Not probing flannel connectivity: no other nodes to probe")
+		return nil
+	}
+	result := probeConnectivity(targets, probe)
+	if result != connectivityOK {
+		logrus.WithFields(lf).Warnf("Flannel connectivity probe failed: %s", result)
+	}
+	return annotateNode(ctx, nodes, nodeName, FlannelConnectivityAnnotation, result)
+}
+
+// checkConnectivity waits for flannel to be up, then periodically probes connectivity to other nodes
+// until the context is done. Probing is opt-in, as it sends traffic to every probed node.
+func checkConnectivity(ctx context.Context, lf logrus.Fields, nodeConfig *config.Node, nodes typedcorev1.NodeInterface, netMode int) {
+	if goruntime.GOOS == "windows" {
+		logrus.WithFields(lf).Info("Not probing flannel connectivity: probing is not supported on Windows")
+		return
+	}
+	if err := Ready(ctx, nodeConfig); err != nil {
+		return
+	}
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := recordConnectivity(ctx, lf, nodeConfig.AgentConfig.NodeName, nodes, netMode, connectivityProbe); err != nil {
+			logrus.WithFields(lf).Warnf("Failed to record flannel connectivity: %v", err)
+		}
+	}, connectivityProbeInterval)
+}
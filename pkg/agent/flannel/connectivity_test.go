@@ -0,0 +1,148 @@
+package flannel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func connectivityTestNode(name string, podCIDRs ...string) *v1.Node {
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	if len(podCIDRs) > 0 {
+		node.Spec.PodCIDR = podCIDRs[0]
+		node.Spec.PodCIDRs = podCIDRs
+	}
+	return node
+}
+
+// reachable returns a probe that answers for the given addresses only.
+func reachable(addrs ...string) func(net.IP) (bool, error) {
+	return func(target net.IP) (bool, error) {
+		for _, addr := range addrs {
+			if target.Equal(net.ParseIP(addr)) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+}
+
+func Test_connectivityTargets(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		connectivityTestNode("self", "10.42.0.0/24"),
+		connectivityTestNode("a", "10.42.1.0/24", "2001:db8:42:1::/64"),
+		connectivityTestNode("b", "2001:db8:42:2::/64", "10.42.2.0/24"),
+		connectivityTestNode("pending"),
+		connectivityTestNode("c", "10.42.3.0/24"),
+		connectivityTestNode("d", "10.42.4.0/24"),
+	)
+
+	got, err := connectivityTargets(context.Background(), "self", client.CoreV1().Nodes(), ipv4)
+	if err != nil {
+		t.Fatalf("connectivityTargets() error = %v", err)
+	}
+	want := []connectivityTarget{
+		{"a", net.ParseIP("10.42.1.1")},
+		{"b", net.ParseIP("10.42.2.1")},
+		{"c", net.ParseIP("10.42.3.1")},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("connectivityTargets() = %v, want %v", got, want)
+	}
+
+	got, err = connectivityTargets(context.Background(), "self", client.CoreV1().Nodes(), ipv6)
+	if err != nil {
+		t.Fatalf("connectivityTargets() error = %v", err)
+	}
+	want = []connectivityTarget{
+		{"a", net.ParseIP("2001:db8:42:1::1")},
+		{"b", net.ParseIP("2001:db8:42:2::1")},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("connectivityTargets() = %v, want %v", got, want)
+	}
+}
+
+func Test_recordConnectivity(t *testing.T) {
+	tests := []struct {
+		name  string
+		nodes []*v1.Node
+		probe func(net.IP) (bool, error)
+		want  string
+	}{
+		{
+			name:  "no peers",
+			nodes: []*v1.Node{connectivityTestNode("self", "10.42.0.0/24"), connectivityTestNode("pending")},
+			probe: reachable(),
+			want:  "",
+		},
+		{
+			name:  "all reachable",
+			nodes: []*v1.Node{connectivityTestNode("self", "10.42.0.0/24"), connectivityTestNode("a", "10.42.1.0/24"), connectivityTestNode("b", "10.42.2.0/24")},
+			probe: reachable("10.42.1.1", "10.42.2.1"),
+			want:  connectivityOK,
+		},
+		{
+			name:  "peer unreachable",
+			nodes: []*v1.Node{connectivityTestNode("self", "10.42.0.0/24"), connectivityTestNode("a", "10.42.1.0/24"), connectivityTestNode("b", "10.42.2.0/24")},
+			probe: reachable("10.42.1.1"),
+			want:  "unreachable: b (10.42.2.1)",
+		},
+		{
+			name:  "probe error",
+			nodes: []*v1.Node{connectivityTestNode("self", "10.42.0.0/24"), connectivityTestNode("a", "10.42.1.0/24")},
+			probe: func(net.IP) (bool, error) { return false, errors.New("permission denied") },
+			want:  "unreachable: a (10.42.1.1)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
+			for _, node := range tt.nodes {
+				client.Tracker().Add(node)
+			}
+			nodes := client.CoreV1().Nodes()
+			if err := recordConnectivity(context.Background(), logrus.Fields{}, "self", nodes, ipv4, tt.probe); err != nil {
+				t.Fatalf("recordConnectivity() error = %v", err)
+			}
+			node, err := nodes.Get(context.Background(), "self", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, ok := node.Annotations[FlannelConnectivityAnnotation]
+			if ok != (tt.want != "") || got != tt.want {
+				t.Errorf("connectivity annotation = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_recordConnectivityRecovers(t *testing.T) {
+	client := fake.NewSimpleClientset(connectivityTestNode("self", "10.42.0.0/24"), connectivityTestNode("a", "10.42.1.0/24"))
+	nodes := client.CoreV1().Nodes()
+	for _, tt := range []struct {
+		probe func(net.IP) (bool, error)
+		want  string
+	}{
+		{reachable(), "unreachable: a (10.42.1.1)"},
+		{reachable("10.42.1.1"), connectivityOK},
+	} {
+		if err := recordConnectivity(context.Background(), logrus.Fields{}, "self", nodes, ipv4, tt.probe); err != nil {
+			t.Fatalf("recordConnectivity() error = %v", err)
+		}
+		node, err := nodes.Get(context.Background(), "self", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := node.Annotations[FlannelConnectivityAnnotation]; got != tt.want {
+			t.Errorf("connectivity annotation = %q, want %q", got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package flannel
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/k3s-io/k3s/pkg/daemons/config"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	certutil "k8s.io/client-go/util/cert"
+)
+
+const (
+	// defaultFlannelEtcdPrefix is the flanneld default; the net-conf is stored under <prefix>/config
+	defaultFlannelEtcdPrefix = "/coreos.com/network"
+
+	etcdNetConfTimeout = 10 * time.Second
+)
+
+// putEtcdNetConf stores the net-conf in etcd, where flanneld reads it from when it uses the etcd
+// subnet manager. It is a variable so that tests can replace it.
+var putEtcdNetConf = func(ctx context.Context, nodeConfig *config.Node, key, netConf string) error {
+	tlsConfig, err := etcdTLSConfig(nodeConfig)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, etcdNetConfTimeout)
+	defer cancel()
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   nodeConfig.FlannelEtcdEndpoints,
+		Context:     ctx,
+		DialTimeout: etcdNetConfTimeout,
+		TLS:         tlsConfig,
+	})
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	_, err = client.Put(ctx, key, netConf)
+	return err
+}
+
+// flannelEtcdMode returns true if flannel uses the etcd subnet manager instead of the kube subnet manager.
+func flannelEtcdMode(nodeConfig *config.Node) bool {
+	return len(nodeConfig.FlannelEtcdEndpoints) > 0
+}
+
+// flannelEtcdPrefix returns the etcd prefix under which flannel stores its config and subnet leases.
+func flannelEtcdPrefix(nodeConfig *config.Node) string {
+	if nodeConfig.FlannelEtcdPrefix == "" {
+		return defaultFlannelEtcdPrefix
+	}
+	return strings.TrimSuffix(nodeConfig.FlannelEtcdPrefix, "/")
+}
+
+// validateEtcdConfig checks that the etcd subnet manager can be used: flannel must run as an external
+// flanneld, as the embedded flannel only supports the kube subnet manager, and the endpoints must be
+// https URLs with a client certificate and CA to connect with.
+func validateEtcdConfig(nodeConfig *config.Node) error {
+	if !nodeConfig.FlannelExternalProcess {
+		return errors.New("the flannel etcd subnet manager can only be used with an external flanneld process")
+	}
+	for _, endpoint := range nodeConfig.FlannelEtcdEndpoints {
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("invalid flannel etcd endpoint %q: must be an https URL", endpoint)
+		}
+	}
+	if prefix := nodeConfig.FlannelEtcdPrefix; prefix != "" && !strings.HasPrefix(prefix, "/") {
+		return fmt.Errorf("invalid flannel etcd prefix %q: must start with /", prefix)
+	}
+
+	var missing []string
+	for _, file := range []struct{ name, path string }{
+		{"CA file", nodeConfig.FlannelEtcdCAFile},
+		{"cert file", nodeConfig.FlannelEtcdCertFile},
+		{"key file", nodeConfig.FlannelEtcdKeyFile},
+	} {
+		if file.path == "" {
+			missing = append(missing, file.name)
+		} else if _, err := os.Stat(file.path); err != nil {
+			return errors.Wrapf(err, "invalid flannel etcd %s", file.name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("the flannel etcd subnet manager requires a TLS %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// etcdArgs returns the flanneld args that select the etcd subnet manager.
+func etcdArgs(nodeConfig *config.Node) []string {
+	return []string{
+		"--etcd-endpoints=" + strings.Join(nodeConfig.FlannelEtcdEndpoints, ","),
+		"--etcd-prefix=" + flannelEtcdPrefix(nodeConfig),
+		"--etcd-cafile=" + nodeConfig.FlannelEtcdCAFile,
+		"--etcd-certfile=" + nodeConfig.FlannelEtcdCertFile,
+		"--etcd-keyfile=" + nodeConfig.FlannelEtcdKeyFile,
+	}
+}
+
+// etcdTLSConfig returns the TLS config used to connect to the flannel etcd endpoints.
+func etcdTLSConfig(nodeConfig *config.Node) (*tls.Config, error) {
+	clientCert, err := tls.LoadX509KeyPair(nodeConfig.FlannelEtcdCertFile, nodeConfig.FlannelEtcdKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := certutil.NewPool(nodeConfig.FlannelEtcdCAFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		RootCAs:      pool,
+		Certificates: []tls.Certificate{clientCert},
+	}, nil
+}
+
+// publishEtcdNetConf stores the net-conf that was written for the node in etcd, so that flanneld is
+// started with the same config as it would read from the file with the kube subnet manager.
+func publishEtcdNetConf(ctx context.Context, nodeConfig *config.Node) error {
+	b, err := os.ReadFile(nodeConfig.FlannelConfFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to read flannel configuration")
+	}
+	key := flannelEtcdPrefix(nodeConfig) + "/config"
+	logrus.Infof("Storing the flannel configuration in etcd at %s", key)
+	if err := putEtcdNetConf(ctx, nodeConfig, key, string(b)); err != nil {
+		return errors.Wrap(err, "failed to store flannel configuration in etcd")
+	}
+	return nil
+}
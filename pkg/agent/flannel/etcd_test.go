@@ -0,0 +1,92 @@
+package flannel
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/k3s-io/k3s/pkg/daemons/config"
+)
+
+func Test_validateEtcdConfig(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"ca.crt", "client.crt", "client.key"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		set     func(*config.Node)
+		wantErr string
+	}{
+		{"valid", nil, ""},
+		{"embedded flannel", func(n *config.Node) { n.FlannelExternalProcess = false }, "external flanneld"},
+		{"http endpoint", func(n *config.Node) { n.FlannelEtcdEndpoints = []string{"http://10.0.0.1:2379"} }, `invalid flannel etcd endpoint "http://10.0.0.1:2379"`},
+		{"not a URL", func(n *config.Node) { n.FlannelEtcdEndpoints = []string{"10.0.0.1:2379"} }, `invalid flannel etcd endpoint "10.0.0.1:2379"`},
+		{"relative prefix", func(n *config.Node) { n.FlannelEtcdPrefix = "flannel" }, `invalid flannel etcd prefix "flannel"`},
+		{"no certs", func(n *config.Node) {
+			n.FlannelEtcdCAFile, n.FlannelEtcdCertFile, n.FlannelEtcdKeyFile = "", "", ""
+		}, "requires a TLS CA file, cert file, key file"},
+		{"no key", func(n *config.Node) { n.FlannelEtcdKeyFile = "" }, "requires a TLS key file"},
+		{"missing cert", func(n *config.Node) { n.FlannelEtcdCertFile = filepath.Join(dir, "missing.crt") }, "invalid flannel etcd cert file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodeConfig := &config.Node{
+				FlannelExternalProcess: true,
+				FlannelEtcdEndpoints:   []string{"https://10.0.0.1:2379"},
+				FlannelEtcdCAFile:      filepath.Join(dir, "ca.crt"),
+				FlannelEtcdCertFile:    filepath.Join(dir, "client.crt"),
+				FlannelEtcdKeyFile:     filepath.Join(dir, "client.key"),
+			}
+			if tt.set != nil {
+				tt.set(nodeConfig)
+			}
+			err := validateEtcdConfig(nodeConfig)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validateEtcdConfig() error = %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validateEtcdConfig() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_etcdArgs(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		want   string
+	}{
+		{"default prefix", "", "--etcd-prefix=/coreos.com/network"},
+		{"custom prefix", "/k3s/flannel", "--etcd-prefix=/k3s/flannel"},
+		{"trailing slash", "/k3s/flannel/", "--etcd-prefix=/k3s/flannel"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodeConfig := &config.Node{
+				FlannelEtcdEndpoints: []string{"https://10.0.0.1:2379"},
+				FlannelEtcdPrefix:    tt.prefix,
+				FlannelEtcdCAFile:    "/etc/flannel/ca.crt",
+				FlannelEtcdCertFile:  "/etc/flannel/client.crt",
+				FlannelEtcdKeyFile:   "/etc/flannel/client.key",
+			}
+			want := []string{
+				"--etcd-endpoints=https://10.0.0.1:2379",
+				tt.want,
+				"--etcd-cafile=/etc/flannel/ca.crt",
+				"--etcd-certfile=/etc/flannel/client.crt",
+				"--etcd-keyfile=/etc/flannel/client.key",
+			}
+			if got := etcdArgs(nodeConfig); !reflect.DeepEqual(got, want) {
+				t.Errorf("etcdArgs() = %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -26,40 +26,60 @@ import (
 	"github.com/flannel-io/flannel/pkg/backend"
 	"github.com/flannel-io/flannel/pkg/ip"
 	"github.com/flannel-io/flannel/pkg/subnet/kube"
+	"github.com/flannel-io/flannel/pkg/trafficmngr"
 	"github.com/flannel-io/flannel/pkg/trafficmngr/iptables"
+	"github.com/flannel-io/flannel/pkg/trafficmngr/nftables"
 	"github.com/joho/godotenv"
+	"github.com/k3s-io/k3s/pkg/version"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
 
 	// Backends need to be imported for their init() to get executed and them to register
+	_ "github.com/flannel-io/flannel/pkg/backend/alloc"
 	_ "github.com/flannel-io/flannel/pkg/backend/extension"
 	_ "github.com/flannel-io/flannel/pkg/backend/hostgw"
+	_ "github.com/flannel-io/flannel/pkg/backend/ipip"
 	_ "github.com/flannel-io/flannel/pkg/backend/ipsec"
 	_ "github.com/flannel-io/flannel/pkg/backend/vxlan"
 	_ "github.com/flannel-io/flannel/pkg/backend/wireguard"
 )
 
 const (
-	subnetFile = "/run/flannel/subnet.env"
+	// defaultSubnetFile is where flannel writes its subnet file, unless FlannelSubnetFile is set
+	defaultSubnetFile = "/run/flannel/subnet.env"
 )
 
 var (
 	FlannelBaseAnnotation         = "flannel.alpha.coreos.com"
 	FlannelExternalIPv4Annotation = FlannelBaseAnnotation + "/public-ip-overwrite"
 	FlannelExternalIPv6Annotation = FlannelBaseAnnotation + "/public-ipv6-overwrite"
+
+	// FlannelBackendAnnotation records the k3s flannel backend. It differs from flannel's own
+	// backend-type annotation, which does not distinguish backends built on the same flannel backend type.
+	FlannelBackendAnnotation = "flannel." + version.Program + ".io/backend"
+
+	// FlannelBackendLabel overrides the configured flannel backend on the labelled node.
+	FlannelBackendLabel = "flannel." + version.Program + ".io/backend"
+
+	// FlannelConnectivityAnnotation records the result of the most recent cross-node connectivity probe.
+	FlannelConnectivityAnnotation = "flannel." + version.Program + ".io/connectivity"
+
+	// FlannelWireguardKeyAnnotation records the wireguard public key of the node, for checking peer configs.
+	FlannelWireguardKeyAnnotation = "flannel." + version.Program + ".io/wireguard-pubkey"
 )
 
-func flannel(ctx context.Context, flannelIface *net.Interface, flannelConf, kubeConfigFile string, flannelIPv6Masq bool, netMode int) error {
+func flannel(ctx context.Context, flannelIface *net.Interface, flannelConf, subnetFile, kubeAPIURL, kubeConfigFile, annotationPrefix string, flannelIPMasq, flannelIPv6Masq bool, flannelPublicIP net.IP, netMode int) error {
 	extIface, err := LookupExtInterface(flannelIface, netMode)
 	if err != nil {
 		return errors.Wrap(err, "failed to find the interface")
 	}
+	setPublicIP(extIface, flannelPublicIP)
 
 	sm, err := kube.NewSubnetManager(ctx,
-		"",
+		kubeAPIURL,
 		kubeConfigFile,
-		FlannelBaseAnnotation,
+		annotationPrefix,
 		flannelConf,
 		false)
 	if err != nil {
@@ -83,10 +103,13 @@ func flannel(ctx context.Context, flannelIface *net.Interface, flannelConf, kube
 	if err != nil {
 		return errors.Wrap(err, "failed to register flannel network")
 	}
-	trafficMngr := &iptables.IPTablesManager{}
+	var trafficMngr trafficmngr.TrafficManager = &iptables.IPTablesManager{}
+	if config.EnableNFTables {
+		trafficMngr = &nftables.NFTablesManager{}
+	}
 	err = trafficMngr.Init(ctx, &sync.WaitGroup{})
 	if err != nil {
-		return errors.Wrap(err, "failed to initialize flannel ipTables manager")
+		return errors.Wrap(err, "failed to initialize flannel traffic manager")
 	}
 
 	if netMode == (ipv4+ipv6) || netMode == ipv4 {
@@ -101,12 +124,8 @@ func flannel(ctx context.Context, flannelIface *net.Interface, flannelConf, kube
 
 	prevIPv6Network := ReadIP6CIDRFromSubnetFile(subnetFile, "FLANNEL_IPV6_NETWORK")
 	prevIPv6Subnet := ReadIP6CIDRFromSubnetFile(subnetFile, "FLANNEL_IPV6_SUBNET")
-	if flannelIPv6Masq {
-		err = trafficMngr.SetupAndEnsureMasqRules(ctx, config.Network, prevSubnet, prevNetwork, config.IPv6Network, prevIPv6Subnet, prevIPv6Network, bn.Lease(), 60)
-	} else {
-		//set empty flannel ipv6 Network to prevent masquerading
-		err = trafficMngr.SetupAndEnsureMasqRules(ctx, config.Network, prevSubnet, prevNetwork, ip.IP6Net{}, prevIPv6Subnet, prevIPv6Network, bn.Lease(), 60)
-	}
+	masqNetwork, masqIPv6Network := masqNetworks(config.Network, config.IPv6Network, flannelIPMasq, flannelIPv6Masq)
+	err = trafficMngr.SetupAndEnsureMasqRules(ctx, masqNetwork, prevSubnet, prevNetwork, masqIPv6Network, prevIPv6Subnet, prevIPv6Network, bn.Lease(), 60)
 	if err != nil {
 		return errors.Wrap(err, "failed to setup masq rules")
 	}
@@ -114,7 +133,7 @@ func flannel(ctx context.Context, flannelIface *net.Interface, flannelConf, kube
 	//setup forward rules
 	trafficMngr.SetupAndEnsureForwardRules(ctx, config.Network, config.IPv6Network, 50)
 
-	if err := WriteSubnetFile(subnetFile, config.Network, config.IPv6Network, true, bn, netMode); err != nil {
+	if err := WriteSubnetFile(subnetFile, config.Network, config.IPv6Network, flannelIPMasq || flannelIPv6Masq, bn, netMode); err != nil {
 		// Continue, even though it failed.
 		logrus.Warningf("Failed to write flannel subnet file: %s", err)
 	} else {
@@ -127,6 +146,18 @@ func flannel(ctx context.Context, flannelIface *net.Interface, flannelConf, kube
 	return nil
 }
 
+// masqNetworks returns the networks that flannel sets up masquerading for. Masquerading is disabled
+// for an address family by passing an empty network.
+func masqNetworks(network ip.IP4Net, ipv6Network ip.IP6Net, ipMasq, ipv6Masq bool) (ip.IP4Net, ip.IP6Net) {
+	if !ipMasq {
+		network = ip.IP4Net{}
+	}
+	if !ipv6Masq {
+		ipv6Network = ip.IP6Net{}
+	}
+	return network, ipv6Network
+}
+
 func LookupExtInterface(iface *net.Interface, netMode int) (*backend.ExternalInterface, error) {
 	var ifaceAddr []net.IP
 	var ifacev6Addr []net.IP
@@ -189,6 +220,20 @@ func LookupExtInterface(iface *net.Interface, netMode int) (*backend.ExternalInt
 	}, nil
 }
 
+// setPublicIP overrides the address that flannel advertises to other nodes for the address family
+// of the public IP, if one is set.
+func setPublicIP(extIface *backend.ExternalInterface, publicIP net.IP) {
+	if publicIP == nil {
+		return
+	}
+	if publicIP.To4() != nil {
+		extIface.ExtAddr = publicIP
+	} else {
+		extIface.ExtV6Addr = publicIP
+	}
+	logrus.Infof("Flannel will advertise public address %s", publicIP)
+}
+
 func WriteSubnetFile(path string, nw ip.IP4Net, nwv6 ip.IP6Net, ipMasq bool, bn backend.Network, netMode int) error {
 	dir, name := filepath.Split(path)
 	os.MkdirAll(dir, 0755)
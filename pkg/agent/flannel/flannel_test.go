@@ -0,0 +1,32 @@
+package flannel
+
+import (
+	"testing"
+
+	"github.com/flannel-io/flannel/pkg/ip"
+)
+
+func Test_masqNetworks(t *testing.T) {
+	ipv4Net := ip.FromIPNet(stringToCIDR("10.42.0.0/16")[0])
+	ipv6Net := ip.FromIP6Net(stringToCIDR("2001:cafe:42::/56")[0])
+	tests := []struct {
+		name     string
+		ipMasq   bool
+		ipv6Masq bool
+		wantIPv4 ip.IP4Net
+		wantIPv6 ip.IP6Net
+	}{
+		{"ipv4 only", true, false, ipv4Net, ip.IP6Net{}},
+		{"ipv4 and ipv6", true, true, ipv4Net, ipv6Net},
+		{"ipv6 only", false, true, ip.IP4Net{}, ipv6Net},
+		{"neither", false, false, ip.IP4Net{}, ip.IP6Net{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotIPv4, gotIPv6 := masqNetworks(ipv4Net, ipv6Net, tt.ipMasq, tt.ipv6Masq)
+			if !gotIPv4.Equal(tt.wantIPv4) || !gotIPv6.Equal(tt.wantIPv6) {
+				t.Errorf("masqNetworks() = %v, %v, want %v, %v", gotIPv4, gotIPv6, tt.wantIPv4, tt.wantIPv6)
+			}
+		})
+	}
+}
@@ -0,0 +1,308 @@
+package flannel
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	goruntime "runtime"
+	"slices"
+	"strings"
+
+	"github.com/flannel-io/flannel/pkg/ip"
+	"github.com/k3s-io/k3s/pkg/daemons/config"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	utilsnet "k8s.io/utils/net"
+)
+
+// listInterfaces and defaultGatewayInterface are used to find candidate interfaces for flannel.
+// They are variables so that tests can replace them.
+var (
+	listInterfaces          = net.Interfaces
+	defaultGatewayInterface = func(netMode int) (*net.Interface, error) {
+		if netMode == ipv6 {
+			return ip.GetDefaultV6GatewayInterface()
+		}
+		return ip.GetDefaultGatewayInterface()
+	}
+)
+
+// lookupExtInterface checks that an interface has an address that flannel can use. It is a variable
+// so that tests can replace it.
+var lookupExtInterface = LookupExtInterface
+
+// interfaceAddrs returns the addresses of an interface. It is a variable so that tests can replace it.
+var interfaceAddrs = func(iface net.Interface) ([]net.Addr, error) {
+	return iface.Addrs()
+}
+
+// flannelBridgeName is the bridge that the flannel CNI plugin attaches pods to.
+const flannelBridgeName = "cni0"
+
+// Encapsulation overhead of the backends that support setting the MTU, by underlay address family
+const (
+	vxlanOverheadIPv4     = 50
+	vxlanOverheadIPv6     = 70
+	wireguardOverheadIPv4 = 60
+	wireguardOverheadIPv6 = 80
+)
+
+// underlayMTU returns the MTU of the interface that flannel will use, or of the default gateway
+// interface if none is configured. It is a variable so that tests can replace it.
+var underlayMTU = func(iface *net.Interface, netMode int) (int, error) {
+	if iface == nil {
+		var err error
+		if iface, err = defaultGatewayInterface(netMode); err != nil {
+			return 0, err
+		}
+	}
+	return iface.MTU, nil
+}
+
+// backendMTUOverhead returns the encapsulation overhead of the backend, or false if the MTU
+// cannot be set for the backend. The IPv6 overhead is used if the underlay may be IPv6.
+func backendMTUOverhead(backend string, netMode int) (int, bool) {
+	ipv6Underlay := netMode == ipv6 || netMode == (ipv4+ipv6)
+	switch backend {
+	case config.FlannelBackendVXLAN, config.FlannelBackendHostGWVXLAN:
+		if ipv6Underlay {
+			return vxlanOverheadIPv6, true
+		}
+		return vxlanOverheadIPv4, true
+	case config.FlannelBackendWireguardNative:
+		if ipv6Underlay {
+			return wireguardOverheadIPv6, true
+		}
+		return wireguardOverheadIPv4, true
+	}
+	return 0, false
+}
+
+// DefaultMTUFor returns the overlay MTU for the backend over an IPv4 underlay with the given MTU. Zero
+// is returned for backends whose overhead is not known.
+func DefaultMTUFor(backend string, underlayMTU int) int {
+	return defaultMTUFor(backend, underlayMTU, ipv4)
+}
+
+// defaultMTUFor returns the overlay MTU for the backend with the given underlay MTU, using the IPv6
+// overhead if the underlay may be IPv6. Zero is returned for backends whose overhead is not known.
+func defaultMTUFor(backend string, underlayMTU, netMode int) int {
+	if backend == config.FlannelBackendHostGW {
+		// Traffic is routed without encapsulation
+		return underlayMTU
+	}
+	overhead, ok := backendMTUOverhead(backend, netMode)
+	if !ok {
+		return 0
+	}
+	return underlayMTU - overhead
+}
+
+// checkFlannelMTU warns if the explicitly configured flannel MTU is larger than the underlay can carry
+// once the backend's encapsulation overhead is added.
+func checkFlannelMTU(nodeConfig *config.Node, netMode int) {
+	mtu, err := underlayMTU(nodeConfig.FlannelIface, netMode)
+	if err != nil || mtu <= 0 {
+		logrus.Debugf("Failed to detect flannel underlay MTU: %v", err)
+		return
+	}
+	if maxMTU := defaultMTUFor(nodeConfig.FlannelBackend, mtu, netMode); nodeConfig.FlannelMTU > maxMTU {
+		logrus.Warnf("Flannel MTU %d exceeds the maximum of %d for backend %s with underlay MTU %d; packets may be fragmented or dropped", nodeConfig.FlannelMTU, maxMTU, nodeConfig.FlannelBackend, mtu)
+	}
+}
+
+// detectFlannelMTU returns the overlay MTU for the backend, computed from the MTU of the underlay
+// interface. Zero is returned if the MTU cannot be detected, leaving flannel to pick the MTU itself.
+func detectFlannelMTU(nodeConfig *config.Node, netMode int) int {
+	if _, ok := backendMTUOverhead(nodeConfig.FlannelBackend, netMode); !ok {
+		return 0
+	}
+	mtu, err := underlayMTU(nodeConfig.FlannelIface, netMode)
+	if err != nil {
+		logrus.Debugf("Failed to detect flannel underlay MTU: %v", err)
+		return 0
+	}
+	flannelMTU := defaultMTUFor(nodeConfig.FlannelBackend, mtu, netMode)
+	if flannelMTU < minFlannelMTU {
+		logrus.Warnf("Underlay MTU %d is too small for flannel backend %s; not setting the flannel MTU", mtu, nodeConfig.FlannelBackend)
+		return 0
+	}
+	logrus.Infof("Using flannel MTU %d for backend %s with underlay MTU %d", flannelMTU, nodeConfig.FlannelBackend, mtu)
+	return flannelMTU
+}
+
+// candidateInterfaces returns the interfaces that flannel may use, in order of preference. If a list of
+// interfaces is configured, these are the listed interfaces that are up. If interfaces have been
+// excluded from auto-detection, these are the default gateway interface, if it is not excluded,
+// followed by any other interfaces that are up. Nil is returned if a single interface is explicitly
+// configured or nothing is excluded, in which case flannel uses the default gateway interface.
+func candidateInterfaces(nodeConfig *config.Node, netMode int) ([]net.Interface, error) {
+	if nodeConfig.FlannelIface != nil {
+		return nil, nil
+	}
+	if len(nodeConfig.FlannelIfaces) > 0 {
+		return namedInterfaces(nodeConfig.FlannelIfaces)
+	}
+	if len(nodeConfig.FlannelIfaceExclude) == 0 {
+		return nil, nil
+	}
+
+	var excludes []*regexp.Regexp
+	for _, expr := range nodeConfig.FlannelIfaceExclude {
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid flannel interface exclusion %q", expr)
+		}
+		excludes = append(excludes, re)
+	}
+	excluded := func(name string) bool {
+		for _, re := range excludes {
+			if re.MatchString(name) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var candidates []net.Interface
+	if iface, err := defaultGatewayInterface(netMode); err != nil {
+		logrus.Debugf("Failed to get default gateway interface for flannel: %v", err)
+	} else if excluded(iface.Name) {
+		logrus.Infof("Default gateway interface %s is excluded from use by flannel", iface.Name)
+	} else {
+		candidates = append(candidates, *iface)
+	}
+
+	ifaces, err := listInterfaces()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list interfaces")
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 || excluded(iface.Name) {
+			continue
+		}
+		if len(candidates) > 0 && candidates[0].Name == iface.Name {
+			continue
+		}
+		candidates = append(candidates, iface)
+	}
+
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no interfaces available for flannel after excluding %s", strings.Join(nodeConfig.FlannelIfaceExclude, ", "))
+	}
+	return candidates, nil
+}
+
+// namedInterfaces returns the configured flannel interfaces that exist and are up, in the configured
+// order. An error is returned if none of them are.
+func namedInterfaces(names []string) ([]net.Interface, error) {
+	ifaces, err := listInterfaces()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list interfaces")
+	}
+	var candidates []net.Interface
+	for _, name := range names {
+		i := slices.IndexFunc(ifaces, func(iface net.Interface) bool { return iface.Name == name })
+		switch {
+		case i < 0:
+			logrus.Warnf("Flannel interface %s not found", name)
+		case ifaces[i].Flags&net.FlagUp == 0:
+			logrus.Warnf("Flannel interface %s is down", name)
+		default:
+			candidates = append(candidates, ifaces[i])
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("none of the flannel interfaces %s exist and are up", strings.Join(names, ", "))
+	}
+	return candidates, nil
+}
+
+// checkInterfaceExists returns an error listing the node's interfaces if the configured flannel
+// interface does not exist, or an error if none of a configured list of interfaces are up. Nothing is
+// checked if the interface is auto-detected.
+func checkInterfaceExists(nodeConfig *config.Node) error {
+	if len(nodeConfig.FlannelIfaces) > 0 {
+		_, err := namedInterfaces(nodeConfig.FlannelIfaces)
+		return err
+	}
+	if nodeConfig.FlannelIface == nil {
+		return nil
+	}
+	ifaces, err := listInterfaces()
+	if err != nil {
+		return errors.Wrap(err, "failed to list interfaces")
+	}
+	var names []string
+	for _, iface := range ifaces {
+		if iface.Name == nodeConfig.FlannelIface.Name {
+			return nil
+		}
+		names = append(names, iface.Name)
+	}
+	return fmt.Errorf("flannel interface %q not found; available: [%s]", nodeConfig.FlannelIface.Name, strings.Join(names, ", "))
+}
+
+// checkClusterCIDROverlap warns, or returns an error if FlannelCIDROverlapFatal is set, if a cluster
+// CIDR overlaps the subnet of one of the node's interfaces, as the routes that flannel adds for the
+// cluster CIDR would then capture host traffic. Each address family is checked against its own
+// cluster CIDR. The interfaces that flannel and its CNI plugin create are skipped, as they are
+// expected to have addresses within the cluster CIDR once flannel has run.
+func checkClusterCIDROverlap(nodeConfig *config.Node, netMode int) error {
+	if goruntime.GOOS == "windows" {
+		return nil
+	}
+	ifaces, err := listInterfaces()
+	if err != nil {
+		return errors.Wrap(err, "failed to list interfaces")
+	}
+	skip := append(backendInterfaces(nodeConfig, netMode), flannelBridgeName)
+
+	var overlaps []string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 || slices.Contains(skip, iface.Name) {
+			continue
+		}
+		addrs, err := interfaceAddrs(iface)
+		if err != nil {
+			logrus.Debugf("Failed to get addresses of interface %s: %v", iface.Name, err)
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			subnet := &net.IPNet{IP: ipNet.IP.Mask(ipNet.Mask), Mask: ipNet.Mask}
+			for _, cidr := range flannelNetworks(nodeConfig) {
+				if utilsnet.IsIPv6CIDR(cidr) != utilsnet.IsIPv6CIDR(subnet) {
+					continue
+				}
+				if cidr.Contains(subnet.IP) || subnet.Contains(cidr.IP) {
+					overlaps = append(overlaps, fmt.Sprintf("%s %s overlaps %s", iface.Name, subnet, cidr))
+				}
+			}
+		}
+	}
+	if len(overlaps) == 0 {
+		return nil
+	}
+	msg := fmt.Sprintf("flannel cluster CIDR overlaps the node's interface subnets, so host traffic may be routed to pods: %s", strings.Join(overlaps, ", "))
+	if nodeConfig.FlannelCIDROverlapFatal {
+		return errors.New(msg)
+	}
+	logrus.Warn(msg)
+	return nil
+}
+
+// selectInterface returns the first candidate interface that has an address usable by flannel.
+func selectInterface(candidates []net.Interface, netMode int) (*net.Interface, error) {
+	var names []string
+	for i := range candidates {
+		if _, err := lookupExtInterface(&candidates[i], netMode); err == nil {
+			return &candidates[i], nil
+		}
+		names = append(names, candidates[i].Name)
+	}
+	return nil, fmt.Errorf("none of the candidate flannel interfaces %s have a usable address", strings.Join(names, ", "))
+}
@@ -0,0 +1,317 @@
+package flannel
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/flannel-io/flannel/pkg/backend"
+	"github.com/k3s-io/k3s/pkg/daemons/config"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+func Test_candidateInterfaces(t *testing.T) {
+	ifaces := []net.Interface{
+		{Name: "lo", Flags: net.FlagUp | net.FlagLoopback},
+		{Name: "eth0", Flags: net.FlagUp},
+		{Name: "eth1", Flags: net.FlagUp},
+		{Name: "eth2"},
+		{Name: "storage0", Flags: net.FlagUp},
+	}
+	tests := []struct {
+		name           string
+		iface          *net.Interface
+		exclude        []string
+		defaultGateway string
+		want           []string
+		wantArgs       []string
+		wantErr        bool
+	}{
+		{
+			name:           "no exclusions",
+			defaultGateway: "eth0",
+		},
+		{
+			name:           "explicit interface",
+			iface:          &net.Interface{Name: "eth1"},
+			exclude:        []string{"eth1"},
+			defaultGateway: "eth0",
+			wantArgs:       []string{"--iface=eth1"},
+		},
+		{
+			name:           "default gateway preferred",
+			exclude:        []string{"storage.*"},
+			defaultGateway: "eth1",
+			want:           []string{"eth1", "eth0"},
+			wantArgs:       []string{"--iface=eth1", "--iface=eth0"},
+		},
+		{
+			name:           "default gateway excluded",
+			exclude:        []string{"eth0", "storage.*"},
+			defaultGateway: "eth0",
+			want:           []string{"eth1"},
+			wantArgs:       []string{"--iface=eth1"},
+		},
+		{
+			name:     "no default gateway",
+			exclude:  []string{"eth.*"},
+			want:     []string{"storage0"},
+			wantArgs: []string{"--iface=storage0"},
+		},
+		{
+			name:           "exclusion matches whole name",
+			exclude:        []string{"eth", "storage"},
+			defaultGateway: "eth0",
+			want:           []string{"eth0", "eth1", "storage0"},
+			wantArgs:       []string{"--iface=eth0", "--iface=eth1", "--iface=storage0"},
+		},
+		{
+			name:           "everything excluded",
+			exclude:        []string{"eth.*", "storage.*"},
+			defaultGateway: "eth0",
+			wantErr:        true,
+		},
+		{
+			name:    "invalid expression",
+			exclude: []string{"eth["},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldList, oldDefault := listInterfaces, defaultGatewayInterface
+			t.Cleanup(func() { listInterfaces, defaultGatewayInterface = oldList, oldDefault })
+			listInterfaces = func() ([]net.Interface, error) { return ifaces, nil }
+			defaultGatewayInterface = func(int) (*net.Interface, error) {
+				for i := range ifaces {
+					if ifaces[i].Name == tt.defaultGateway {
+						return &ifaces[i], nil
+					}
+				}
+				return nil, errors.New("no default gateway")
+			}
+
+			nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN)
+			nodeConfig.FlannelIface = tt.iface
+			nodeConfig.FlannelIfaceExclude = tt.exclude
+			candidates, err := candidateInterfaces(nodeConfig, ipv4)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("candidateInterfaces() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var names []string
+			for _, iface := range candidates {
+				names = append(names, iface.Name)
+			}
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("candidateInterfaces() = %v, want %v", names, tt.want)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			args := flanneldArgs(nodeConfig, flanneldIfaces(nodeConfig, candidates))
+			var ifaceArgs []string
+			for _, arg := range args {
+				if strings.HasPrefix(arg, "--iface=") {
+					ifaceArgs = append(ifaceArgs, arg)
+				}
+			}
+			if !reflect.DeepEqual(ifaceArgs, tt.wantArgs) {
+				t.Errorf("flanneldArgs() iface args = %v, want %v", ifaceArgs, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func Test_checkInterfaceExists(t *testing.T) {
+	oldList := listInterfaces
+	t.Cleanup(func() { listInterfaces = oldList })
+	listInterfaces = func() ([]net.Interface, error) {
+		return []net.Interface{{Name: "lo"}, {Name: "eth0"}, {Name: "eth1"}}, nil
+	}
+
+	tests := []struct {
+		name    string
+		iface   *net.Interface
+		wantErr string
+	}{
+		{"auto-detect", nil, ""},
+		{"exists", &net.Interface{Name: "eth1"}, ""},
+		{"missing", &net.Interface{Name: "eht1"}, `flannel interface "eht1" not found; available: [lo, eth0, eth1]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN)
+			nodeConfig.FlannelIface = tt.iface
+			err := checkInterfaceExists(nodeConfig)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkInterfaceExists() error = %v", err)
+				}
+			} else if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("checkInterfaceExists() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_candidateInterfacesNamed(t *testing.T) {
+	oldList := listInterfaces
+	t.Cleanup(func() { listInterfaces = oldList })
+	listInterfaces = func() ([]net.Interface, error) {
+		return []net.Interface{
+			{Name: "lo", Flags: net.FlagUp | net.FlagLoopback},
+			{Name: "eth0", Flags: net.FlagUp},
+			{Name: "eth1"},
+			{Name: "bond0", Flags: net.FlagUp},
+		}, nil
+	}
+
+	tests := []struct {
+		name    string
+		ifaces  []string
+		want    []string
+		wantErr bool
+	}{
+		{"configured order", []string{"bond0", "eth0"}, []string{"bond0", "eth0"}, false},
+		{"down and missing skipped", []string{"eth1", "eth9", "eth0"}, []string{"eth0"}, false},
+		{"none usable", []string{"eth1", "eth9"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN)
+			nodeConfig.FlannelIfaces = tt.ifaces
+			nodeConfig.FlannelIfaceExclude = []string{"bond0"}
+			candidates, err := candidateInterfaces(nodeConfig, ipv4)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("candidateInterfaces() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err := checkInterfaceExists(nodeConfig); (err != nil) != tt.wantErr {
+				t.Errorf("checkInterfaceExists() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var names []string
+			for _, iface := range candidates {
+				names = append(names, iface.Name)
+			}
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("candidateInterfaces() = %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+func Test_selectInterface(t *testing.T) {
+	oldLookup := lookupExtInterface
+	t.Cleanup(func() { lookupExtInterface = oldLookup })
+
+	candidates := []net.Interface{{Name: "bond0"}, {Name: "eth0"}, {Name: "eth1"}}
+	tests := []struct {
+		name      string
+		usable    []string
+		want      string
+		wantTried []string
+		wantErr   string
+	}{
+		{"first usable", []string{"bond0", "eth1"}, "bond0", []string{"bond0"}, ""},
+		{"first unusable", []string{"eth0", "eth1"}, "eth0", []string{"bond0", "eth0"}, ""},
+		{"last usable", []string{"eth1"}, "eth1", []string{"bond0", "eth0", "eth1"}, ""},
+		{"none usable", nil, "", nil, "none of the candidate flannel interfaces bond0, eth0, eth1 have a usable address"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tried []string
+			lookupExtInterface = func(iface *net.Interface, netMode int) (*backend.ExternalInterface, error) {
+				tried = append(tried, iface.Name)
+				if slices.Contains(tt.usable, iface.Name) {
+					return &backend.ExternalInterface{Iface: iface}, nil
+				}
+				return nil, errors.New("no usable address")
+			}
+			got, err := selectInterface(candidates, ipv4)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("selectInterface() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("selectInterface() error = %v", err)
+			}
+			if got.Name != tt.want {
+				t.Errorf("selectInterface() = %s, want %s", got.Name, tt.want)
+			}
+			if !reflect.DeepEqual(tried, tt.wantTried) {
+				t.Errorf("selectInterface() tried %v, want %v", tried, tt.wantTried)
+			}
+		})
+	}
+}
+
+func Test_DefaultMTUFor(t *testing.T) {
+	tests := []struct {
+		backend     string
+		underlayMTU int
+		want        int
+	}{
+		{config.FlannelBackendVXLAN, 1500, 1450},
+		{config.FlannelBackendHostGWVXLAN, 1500, 1450},
+		{config.FlannelBackendWireguardNative, 1500, 1440},
+		{config.FlannelBackendWireguardNative, 9000, 8940},
+		{config.FlannelBackendHostGW, 1500, 1500},
+		{config.FlannelBackendIPIP, 1500, 0},
+		{config.FlannelBackendTailscale, 1500, 0},
+		{config.FlannelBackendNone, 1500, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.backend, func(t *testing.T) {
+			if got := DefaultMTUFor(tt.backend, tt.underlayMTU); got != tt.want {
+				t.Errorf("DefaultMTUFor(%q, %d) = %d, want %d", tt.backend, tt.underlayMTU, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_checkFlannelMTU(t *testing.T) {
+	hook := logtest.NewGlobal()
+	oldUnderlayMTU := underlayMTU
+	t.Cleanup(func() {
+		underlayMTU = oldUnderlayMTU
+		logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+	})
+	underlayMTU = func(*net.Interface, int) (int, error) { return 1500, nil }
+
+	tests := []struct {
+		name     string
+		backend  string
+		netMode  int
+		mtu      int
+		wantWarn bool
+	}{
+		{"vxlan fits", config.FlannelBackendVXLAN, ipv4, 1450, false},
+		{"vxlan too large", config.FlannelBackendVXLAN, ipv4, 1460, true},
+		{"vxlan ipv6 underlay too large", config.FlannelBackendVXLAN, ipv4 + ipv6, 1450, true},
+		{"wireguard fits", config.FlannelBackendWireguardNative, ipv4, 1440, false},
+		{"wireguard vxlan mtu", config.FlannelBackendWireguardNative, ipv4, 1450, true},
+		{"wireguard ipv6 fits", config.FlannelBackendWireguardNative, ipv6, 1420, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook.Reset()
+			nodeConfig := &config.Node{FlannelBackend: tt.backend, FlannelMTU: tt.mtu}
+			checkFlannelMTU(nodeConfig, tt.netMode)
+			var warned bool
+			for _, entry := range hook.AllEntries() {
+				if entry.Level == logrus.WarnLevel && strings.Contains(entry.Message, "exceeds the maximum") {
+					warned = true
+				}
+			}
+			if warned != tt.wantWarn {
+				t.Errorf("checkFlannelMTU() warned = %v, want %v", warned, tt.wantWarn)
+			}
+		})
+	}
+}
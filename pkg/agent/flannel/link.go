@@ -0,0 +1,22 @@
+//go:build !windows
+
+package flannel
+
+import (
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink"
+)
+
+// deleteLink deletes the named network interface, along with the routes through it.
+// It is a variable so that tests can replace it.
+var deleteLink = func(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return nil
+		}
+		return err
+	}
+	return netlink.LinkDel(link)
+}
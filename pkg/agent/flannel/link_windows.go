@@ -0,0 +1,6 @@
+package flannel
+
+// deleteLink is a no-op on Windows, where flannel does not create its own interfaces.
+var deleteLink = func(name string) error {
+	return nil
+}
@@ -0,0 +1,37 @@
+package flannel
+
+import (
+	"sync"
+
+	"github.com/k3s-io/k3s/pkg/metrics"
+	"github.com/k3s-io/k3s/pkg/version"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	flannelRestartsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: version.Program + "_flannel_restarts_total",
+		Help: "Total number of times flannel has been restarted after exiting with an error.",
+	})
+
+	flannelPodCIDRWaitSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    version.Program + "_flannel_pod_cidr_wait_seconds",
+		Help:    "Time spent waiting for the node's PodCIDRs to be assigned before starting flannel.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 12),
+	})
+
+	flannelBackendInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: version.Program + "_flannel_backend_info",
+		Help: "Flannel backend in use on the node; the value is always 1.",
+	}, []string{"backend"})
+)
+
+var registerMetricsOnce sync.Once
+
+// registerMetrics registers the flannel metrics with the agent's metrics registry. It may be called
+// more than once, as Run is retried if the PodCIDR is not assigned in time.
+func registerMetrics() {
+	registerMetricsOnce.Do(func() {
+		metrics.DefaultRegisterer.MustRegister(flannelRestartsTotal, flannelPodCIDRWaitSeconds, flannelBackendInfo)
+	})
+}
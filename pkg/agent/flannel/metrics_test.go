@@ -0,0 +1,63 @@
+package flannel
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// podCIDRWaitCount returns the number of observations of the PodCIDR wait histogram.
+func podCIDRWaitCount(t *testing.T) uint64 {
+	t.Helper()
+	m := &dto.Metric{}
+	if err := flannelPodCIDRWaitSeconds.Write(m); err != nil {
+		t.Fatalf("Failed to read PodCIDR wait histogram: %v", err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func Test_flannelRestartsTotal(t *testing.T) {
+	setFlannelRestartPolicy(t, 10, time.Minute)
+	before := testutil.ToFloat64(flannelRestartsTotal)
+	var calls int
+	err := superviseFlannel(context.Background(), nil, func(ctx context.Context) error {
+		if calls++; calls <= 3 {
+			return errors.New("transient failure")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("superviseFlannel() error = %v", err)
+	}
+	if got := testutil.ToFloat64(flannelRestartsTotal) - before; got != 3 {
+		t.Errorf("flannel restarts increased by %v, want 3", got)
+	}
+}
+
+func Test_flannelPodCIDRWaitSeconds(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	before := podCIDRWaitCount(t)
+	node := newTestNode([]string{"10.42.0.0/24"})
+	if _, err := waitForPodCIDR(ctx, node.Name, fake.NewSimpleClientset(node).CoreV1().Nodes(), ipv4, 0); err != nil {
+		t.Fatalf("waitForPodCIDR() error = %v", err)
+	}
+	if got := podCIDRWaitCount(t) - before; got != 1 {
+		t.Errorf("PodCIDR wait observations increased by %d, want 1", got)
+	}
+
+	// A timed out wait is not observed
+	node = newTestNode(nil)
+	if _, err := waitForPodCIDR(ctx, node.Name, fake.NewSimpleClientset(node).CoreV1().Nodes(), ipv4, 100*time.Millisecond); err == nil {
+		t.Fatal("waitForPodCIDR() expected timeout error, got nil")
+	}
+	if got := podCIDRWaitCount(t) - before; got != 1 {
+		t.Errorf("PodCIDR wait observations increased by %d, want 1", got)
+	}
+}
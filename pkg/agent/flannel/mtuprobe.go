@@ -0,0 +1,114 @@
+package flannel
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/k3s-io/k3s/pkg/daemons/config"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	utilsnet "k8s.io/utils/net"
+)
+
+const (
+	// Each probe that is not answered waits for the probe timeout, so the step and the number of
+	// peers bound the startup latency that probing adds.
+	mtuProbeStep       = 20
+	mtuProbeMaxTargets = 3
+)
+
+// pathMTUProbe sends a packet of the given size to the target with fragmentation disallowed, and
+// reports whether it was answered. It is a variable so that tests can replace it.
+var pathMTUProbe = pingDF
+
+// probePathMTU returns the largest packet size, from start down to min in steps, that reaches
+// every target without fragmentation.
+func probePathMTU(targets []net.IP, start, min int, probe func(net.IP, int) (bool, error)) (int, error) {
+	mtu := start
+	for _, target := range targets {
+		for {
+			if mtu < min {
+				return 0, fmt.Errorf("no packets of %d bytes or more reached %s without fragmentation", min, target)
+			}
+			ok, err := probe(target, mtu)
+			if err != nil {
+				return 0, errors.Wrapf(err, "failed to probe %s", target)
+			}
+			if ok {
+				break
+			}
+			mtu -= mtuProbeStep
+		}
+	}
+	return mtu, nil
+}
+
+// mtuProbeTargets returns the internal IPs of up to mtuProbeMaxTargets other nodes, in the
+// address family that the flannel underlay uses.
+func mtuProbeTargets(ctx context.Context, nodeName string, nodes typedcorev1.NodeInterface, netMode int) ([]net.IP, error) {
+	nodeList, err := nodes.List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	wantIPv6 := netMode == ipv6
+	var targets []net.IP
+	for _, node := range nodeList.Items {
+		if node.Name == nodeName {
+			continue
+		}
+		for _, addr := range node.Status.Addresses {
+			ip := net.ParseIP(addr.Address)
+			if addr.Type != v1.NodeInternalIP || ip == nil || utilsnet.IsIPv6(ip) != wantIPv6 {
+				continue
+			}
+			targets = append(targets, ip)
+			break
+		}
+		if len(targets) == mtuProbeMaxTargets {
+			break
+		}
+	}
+	return targets, nil
+}
+
+// probeWireguardMTU probes the path MTU to other nodes, and rewrites the flannel config with a
+// lower wireguard MTU if the path MTU is below the underlay interface MTU. Probing is best-effort:
+// if it fails, flannel is started with the MTU that was already configured.
+func probeWireguardMTU(ctx context.Context, nodeConfig *config.Node, nodes typedcorev1.NodeInterface, netMode int) {
+	overhead, _ := backendMTUOverhead(config.FlannelBackendWireguardNative, netMode)
+	underlay, err := underlayMTU(nodeConfig.FlannelIface, netMode)
+	if err != nil {
+		logrus.Warnf("Not probing flannel path MTU: failed to detect underlay MTU: %v", err)
+		return
+	}
+	targets, err := mtuProbeTargets(ctx, nodeConfig.AgentConfig.NodeName, nodes, netMode)
+	if err != nil {
+		logrus.Warnf("Not probing flannel path MTU: failed to list nodes: %v", err)
+		return
+	}
+	if len(targets) == 0 {
+		logrus.Info("Not probing flannel path MTU: no other nodes to probe")
+		return
+	}
+
+	mtu, err := probePathMTU(targets, underlay, minFlannelMTU+overhead, pathMTUProbe)
+	if err != nil {
+		logrus.Warnf("Failed to probe flannel path MTU: %v", err)
+		return
+	}
+	if mtu >= underlay {
+		logrus.Infof("Flannel path MTU to %v matches underlay MTU %d", targets, underlay)
+		return
+	}
+
+	logrus.Infof("Reducing flannel MTU to %d for backend %s: path MTU to %v is %d", mtu-overhead, nodeConfig.FlannelBackend, targets, mtu)
+	probed := *nodeConfig
+	probed.FlannelMTU = mtu - overhead
+	if err := createFlannelConf(&probed); err != nil {
+		logrus.Warnf("Failed to write flannel config with probed MTU: %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+//go:build linux
+// +build linux
+
+package flannel
+
+import (
+	"errors"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/net/icmp"
+	netipv4 "golang.org/x/net/ipv4"
+	netipv6 "golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+const mtuProbeTimeout = time.Second
+
+// pingDF sends an ICMP echo request of the given size, including the IP header, with the don't
+// fragment bit set, and reports whether a reply was received before the probe timeout.
+func pingDF(target net.IP, size int) (bool, error) {
+	network, proto, headerLen := "ip4:icmp", 1, netipv4.HeaderLen
+	var echoType, replyType icmp.Type = netipv4.ICMPTypeEcho, netipv4.ICMPTypeEchoReply
+	level, opt, value := unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_PROBE
+	if target.To4() == nil {
+		network, proto, headerLen = "ip6:ipv6-icmp", 58, netipv6.HeaderLen
+		echoType, replyType = netipv6.ICMPTypeEchoRequest, netipv6.ICMPTypeEchoReply
+		level, opt, value = unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_PROBE
+	}
+
+	c, err := net.ListenPacket(network, "")
+	if err != nil {
+		return false, err
+	}
+	defer c.Close()
+	conn := c.(*net.IPConn)
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return false, err
+	}
+	var sockErr error
+	if err := rc.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), level, opt, value)
+	}); err != nil {
+		return false, err
+	}
+	if sockErr != nil {
+		return false, sockErr
+	}
+
+	id, seq := os.Getpid()&0xffff, size&0xffff
+	msg := icmp.Message{
+		Type: echoType,
+		Body: &icmp.Echo{ID: id, Seq: seq, Data: make([]byte, size-headerLen-8)},
+	}
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return false, err
+	}
+	if _, err := conn.WriteTo(b, &net.IPAddr{IP: target}); err != nil {
+		// A packet larger than the known path MTU is rejected locally
+		if errors.Is(err, unix.EMSGSIZE) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(mtuProbeTimeout)); err != nil {
+		return false, err
+	}
+	buf := make([]byte, size)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			if os.IsTimeout(err) {
+				return false, nil
+			}
+			return false, err
+		}
+		reply, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil || reply.Type != replyType || !peer.(*net.IPAddr).IP.Equal(target) {
+			continue
+		}
+		if echo, ok := reply.Body.(*icmp.Echo); ok && echo.ID == id && echo.Seq == seq {
+			return true, nil
+		}
+	}
+}
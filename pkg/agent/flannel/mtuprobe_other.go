@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package flannel
+
+import (
+	"errors"
+	"net"
+)
+
+// pingDF is not implemented on this platform.
+func pingDF(target net.IP, size int) (bool, error) {
+	return false, errors.New("path MTU probing is not supported on this platform")
+}
@@ -0,0 +1,128 @@
+package flannel
+
+import (
+	"context"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/k3s-io/k3s/pkg/daemons/config"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// pathMTUs returns a probe that answers packets up to the path MTU of each target.
+func pathMTUs(mtus map[string]int) func(net.IP, int) (bool, error) {
+	return func(target net.IP, size int) (bool, error) {
+		return size <= mtus[target.String()], nil
+	}
+}
+
+func Test_probePathMTU(t *testing.T) {
+	a, b := net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.3")
+	tests := []struct {
+		name    string
+		targets []net.IP
+		mtus    map[string]int
+		want    int
+		wantErr bool
+	}{
+		{"unchanged", []net.IP{a, b}, map[string]int{"10.0.0.2": 1500, "10.0.0.3": 9000}, 1500, false},
+		{"reduced", []net.IP{a}, map[string]int{"10.0.0.2": 1450}, 1440, false},
+		{"lowest peer wins", []net.IP{a, b}, map[string]int{"10.0.0.2": 1480, "10.0.0.3": 1400}, 1400, false},
+		{"below minimum", []net.IP{a}, map[string]int{"10.0.0.2": 600}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := probePathMTU(tt.targets, 1500, minFlannelMTU+wireguardOverheadIPv4, pathMTUs(tt.mtus))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("probePathMTU() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("probePathMTU() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_mtuProbeTargets(t *testing.T) {
+	node := func(name string, addrs ...string) *v1.Node {
+		n := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}}
+		for _, addr := range addrs {
+			n.Status.Addresses = append(n.Status.Addresses, v1.NodeAddress{Type: v1.NodeInternalIP, Address: addr})
+		}
+		n.Status.Addresses = append(n.Status.Addresses, v1.NodeAddress{Type: v1.NodeExternalIP, Address: "203.0.113.1"})
+		return n
+	}
+	client := fake.NewSimpleClientset(
+		node("self", "10.0.0.1"),
+		node("a", "10.0.0.2", "2001:db8::2"),
+		node("b", "2001:db8::3", "10.0.0.3"),
+		node("c", "10.0.0.4"),
+		node("d", "10.0.0.5"),
+	)
+
+	got, err := mtuProbeTargets(context.Background(), "self", client.CoreV1().Nodes(), ipv4)
+	if err != nil {
+		t.Fatalf("mtuProbeTargets() error = %v", err)
+	}
+	want := []net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.3"), net.ParseIP("10.0.0.4")}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mtuProbeTargets() = %v, want %v", got, want)
+	}
+
+	got, err = mtuProbeTargets(context.Background(), "self", client.CoreV1().Nodes(), ipv6)
+	if err != nil {
+		t.Fatalf("mtuProbeTargets() error = %v", err)
+	}
+	want = []net.IP{net.ParseIP("2001:db8::2"), net.ParseIP("2001:db8::3")}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mtuProbeTargets() = %v, want %v", got, want)
+	}
+}
+
+func Test_probeWireguardMTU(t *testing.T) {
+	oldUnderlayMTU := underlayMTU
+	oldPathMTUProbe := pathMTUProbe
+	t.Cleanup(func() {
+		underlayMTU = oldUnderlayMTU
+		pathMTUProbe = oldPathMTUProbe
+	})
+	underlayMTU = func(*net.Interface, int) (int, error) { return 1500, nil }
+
+	tests := []struct {
+		name       string
+		pathMTU    int
+		wantWrite  bool
+		wantConfig string
+	}{
+		{"unchanged", 1500, false, ""},
+		{"reduced", 1450, true, `{"Backend": {"MTU": 1380}}`},
+		{"probe failure", 500, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pathMTUProbe = pathMTUs(map[string]int{"10.0.0.2": tt.pathMTU})
+			client := fake.NewSimpleClientset(&v1.Node{
+				ObjectMeta: metav1.ObjectMeta{Name: "peer"},
+				Status:     v1.NodeStatus{Addresses: []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "10.0.0.2"}}},
+			})
+			nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendWireguardNative)
+			nodeConfig.AgentConfig.NodeName = "self"
+			probeWireguardMTU(context.Background(), nodeConfig, client.CoreV1().Nodes(), ipv4)
+
+			_, err := os.Stat(nodeConfig.FlannelConfFile)
+			if written := err == nil; written != tt.wantWrite {
+				t.Fatalf("probeWireguardMTU() wrote flannel conf = %v, want %v", written, tt.wantWrite)
+			}
+			if tt.wantWrite {
+				assertNetConf(t, nodeConfig.FlannelConfFile, tt.wantConfig)
+			}
+			if nodeConfig.FlannelMTU != 0 {
+				t.Errorf("probeWireguardMTU() changed the configured MTU to %d", nodeConfig.FlannelMTU)
+			}
+		})
+	}
+}
@@ -0,0 +1,279 @@
+package flannel
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	goruntime "runtime"
+	"strconv"
+	"strings"
+
+	"github.com/k3s-io/k3s/pkg/daemons/config"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const defaultFlannelBinary = "flanneld"
+
+// netnsDir is where `ip netns add` binds named network namespaces. It is a variable so that tests can
+// replace it.
+var netnsDir = "/var/run/netns"
+
+// klogLineRegexp matches the header that flanneld adds to each log line, capturing the severity and
+// the message.
+var klogLineRegexp = regexp.MustCompile(`^([IWEF])\d{4} \d{2}:\d{2}:\d{2}\.\d+\s+\d+ [^\]]+\] (.*)$`)
+
+// flanneldArgs returns the flanneld command line that runs flannel with the same settings as the
+// embedded flannel: kube subnet manager, the generated net-conf, and the agent's kubeconfig. With
+// the etcd subnet manager, flanneld reads the net-conf from etcd instead.
+// Flanneld tries each of the given interfaces in order. Extra args are appended last, so that they
+// can override the managed args.
+func flanneldArgs(nodeConfig *config.Node, ifaces []string) []string {
+	var args []string
+	if flannelEtcdMode(nodeConfig) {
+		args = etcdArgs(nodeConfig)
+	} else {
+		args = []string{
+			"--kube-subnet-mgr",
+			"--kubeconfig-file=" + flannelKubeConfig(nodeConfig),
+			"--kube-annotation-prefix=" + AnnotationPrefix(nodeConfig),
+			"--net-config-path=" + nodeConfig.FlannelConfFile,
+		}
+		if nodeConfig.FlannelKubeAPIURL != "" {
+			args = append(args, "--kube-api-url="+nodeConfig.FlannelKubeAPIURL)
+		}
+	}
+	args = append(args, "--subnet-file="+flannelSubnetFile(nodeConfig))
+	// Flanneld has a single switch for masquerading, which covers both address families. It is off by
+	// default, but is turned off explicitly, so that it is clear from the command line.
+	if ipv4Masq, ipv6Masq := ipMasq(nodeConfig); ipv4Masq || ipv6Masq {
+		args = append(args, "--ip-masq")
+	} else {
+		args = append(args, "--ip-masq=false")
+	}
+	for _, iface := range ifaces {
+		args = append(args, "--iface="+iface)
+	}
+	if publicIP := net.ParseIP(nodeConfig.FlannelPublicIP); publicIP != nil {
+		if publicIP.To4() != nil {
+			args = append(args, "--public-ip="+publicIP.String())
+		} else {
+			args = append(args, "--public-ipv6="+publicIP.String())
+		}
+	}
+	// Flanneld only serves healthz if a port is set; without an IP it listens on all addresses
+	if nodeConfig.FlannelHealthzPort > 0 {
+		if nodeConfig.FlannelHealthzIP != "" {
+			args = append(args, "--healthz-ip="+nodeConfig.FlannelHealthzIP)
+		}
+		args = append(args, "--healthz-port="+strconv.Itoa(nodeConfig.FlannelHealthzPort))
+	}
+	if level := flannelLogLevel(nodeConfig); level > 0 {
+		args = append(args, "-v="+strconv.Itoa(level))
+	}
+	if len(nodeConfig.FlannelExtraArgs) > 0 {
+		logrus.Debugf("Appending extra flannel args %s", config.ArgString(nodeConfig.FlannelExtraArgs))
+		args = append(args, nodeConfig.FlannelExtraArgs...)
+	}
+	return args
+}
+
+// flanneldIfaces returns the names of the interfaces that flanneld should try: the explicitly
+// configured interface, or the candidate interfaces in order of preference. In a network namespace,
+// the interfaces of the host namespace are not visible to flanneld, so only the configured interface
+// names are passed, and flanneld picks its default interface if there are none.
+func flanneldIfaces(nodeConfig *config.Node, candidates []net.Interface) []string {
+	var ifaces []string
+	if nodeConfig.FlannelIface != nil {
+		ifaces = append(ifaces, nodeConfig.FlannelIface.Name)
+	}
+	if nodeConfig.FlannelNetns != "" {
+		return append(ifaces, nodeConfig.FlannelIfaces...)
+	}
+	for _, iface := range candidates {
+		ifaces = append(ifaces, iface.Name)
+	}
+	return ifaces
+}
+
+// flannelProcess runs flanneld as a child process until it exits or the context is cancelled.
+func flannelProcess(ctx context.Context, nodeConfig *config.Node, candidates []net.Interface) error {
+	bin := nodeConfig.FlannelBinary
+	if bin == "" {
+		bin = defaultFlannelBinary
+	}
+	args := flanneldArgs(nodeConfig, flanneldIfaces(nodeConfig, candidates))
+
+	// The net-conf is published on each start, so that a restart after a reload picks up the new config
+	if flannelEtcdMode(nodeConfig) {
+		if err := publishEtcdNetConf(ctx, nodeConfig); err != nil {
+			return err
+		}
+	}
+
+	logrus.Infof("Running flannel %s", config.ArgString(args))
+	bin, args = flanneldCommand(nodeConfig, bin, args)
+	cmd := exec.CommandContext(ctx, bin, args...)
+	// The same writer is used for both, so that exec does not write to it concurrently
+	out := &flannelLogWriter{entry: logrus.WithFields(logFields(nodeConfig)).WithField("component", "flannel")}
+	defer out.Flush()
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.Env = append(os.Environ(), "NODE_NAME="+nodeConfig.AgentConfig.NodeName)
+	addDeathSig(cmd)
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return errors.Wrapf(err, "%s exited", bin)
+	}
+	return nil
+}
+
+// flanneldCommand returns the command that runs flanneld: flanneld itself, or, with a network
+// namespace, `ip netns exec` with the flanneld command line.
+func flanneldCommand(nodeConfig *config.Node, bin string, args []string) (string, []string) {
+	if nodeConfig.FlannelNetns == "" {
+		return bin, args
+	}
+	return "ip", append([]string{"netns", "exec", nodeConfig.FlannelNetns, bin}, args...)
+}
+
+// validateNetns checks that flannel can be run in the configured network namespace. Only an external
+// flanneld process can be run in another namespace, as the embedded flannel shares the namespace of
+// the agent. The namespace must already exist; it is not created, and the links between it and the
+// host namespace that pod traffic needs, and the routes over them, are left to the administrator.
+func validateNetns(nodeConfig *config.Node) error {
+	if nodeConfig.FlannelNetns == "" {
+		return nil
+	}
+	if goruntime.GOOS == "windows" {
+		return errors.New("flannel network namespaces are not supported on Windows")
+	}
+	if !nodeConfig.FlannelExternalProcess {
+		return errors.New("flannel can only run in a network namespace as an external flanneld process")
+	}
+	if strings.ContainsRune(nodeConfig.FlannelNetns, '/') {
+		return fmt.Errorf("invalid flannel network namespace %q: expected the name of a namespace in %s", nodeConfig.FlannelNetns, netnsDir)
+	}
+	if _, err := os.Stat(filepath.Join(netnsDir, nodeConfig.FlannelNetns)); err != nil {
+		return errors.Wrapf(err, "flannel network namespace %q not found", nodeConfig.FlannelNetns)
+	}
+	if _, err := lookPath("ip"); err != nil {
+		return errors.Wrap(err, "the ip command is required to run flannel in a network namespace")
+	}
+	return nil
+}
+
+// maxFlannelLogLevel is the highest klog verbosity that flanneld logs at.
+const maxFlannelLogLevel = 10
+
+// flannelLogLevel returns the klog verbosity of flanneld: the flannel log level if one is configured,
+// and otherwise the agent's verbosity.
+func flannelLogLevel(nodeConfig *config.Node) int {
+	if nodeConfig.FlannelLogLevel != nil {
+		return *nodeConfig.FlannelLogLevel
+	}
+	return nodeConfig.AgentConfig.VLevel
+}
+
+// validateLogLevel checks that a configured flannel log level is a klog verbosity. A log level can only
+// be set for an external flanneld process: the embedded flannel logs through the agent's klog, so its
+// verbosity cannot be changed without also changing that of the other components in the agent.
+func validateLogLevel(nodeConfig *config.Node) error {
+	level := nodeConfig.FlannelLogLevel
+	if level == nil {
+		return nil
+	}
+	if *level < 0 || *level > maxFlannelLogLevel {
+		return fmt.Errorf("invalid flannel log level %d: must be between 0 and %d", *level, maxFlannelLogLevel)
+	}
+	if !nodeConfig.FlannelExternalProcess {
+		return fmt.Errorf("flannel log level %d is set, but can only be used with an external flanneld process; the embedded flannel logs at the agent's log level", *level)
+	}
+	return nil
+}
+
+// validateExtraArgs checks that extra flannel args are only set for an external flanneld process, as the
+// embedded flannel has no command line to pass them on.
+func validateExtraArgs(nodeConfig *config.Node) error {
+	if len(nodeConfig.FlannelExtraArgs) > 0 && !nodeConfig.FlannelExternalProcess {
+		return fmt.Errorf("extra flannel args %s are set, but can only be passed to an external flanneld process", config.ArgString(nodeConfig.FlannelExtraArgs))
+	}
+	return nil
+}
+
+// validateHealthz checks the flanneld healthz address. A port of 0, the flanneld default, disables
+// healthz, in which case an IP cannot be set. Healthz is only served by an external flanneld process.
+func validateHealthz(nodeConfig *config.Node) error {
+	if nodeConfig.FlannelHealthzPort < 0 || nodeConfig.FlannelHealthzPort > 65535 {
+		return fmt.Errorf("invalid flannel healthz port %d: must be between 0 and 65535", nodeConfig.FlannelHealthzPort)
+	}
+	if nodeConfig.FlannelHealthzPort > 0 && !nodeConfig.FlannelExternalProcess {
+		return fmt.Errorf("flannel healthz port %d is set, but healthz is only served by an external flanneld process", nodeConfig.FlannelHealthzPort)
+	}
+	if nodeConfig.FlannelHealthzIP == "" {
+		return nil
+	}
+	if net.ParseIP(nodeConfig.FlannelHealthzIP) == nil {
+		return fmt.Errorf("invalid flannel healthz IP %q", nodeConfig.FlannelHealthzIP)
+	}
+	if nodeConfig.FlannelHealthzPort == 0 {
+		return fmt.Errorf("flannel healthz IP %s is set, but healthz is disabled as no healthz port is set", nodeConfig.FlannelHealthzIP)
+	}
+	return nil
+}
+
+// flannelLogWriter logs the output of flanneld through logrus, one message per line. The klog
+// header is removed from each line, and its severity is used as the log level.
+type flannelLogWriter struct {
+	entry *logrus.Entry
+	buf   []byte
+}
+
+func (w *flannelLogWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.logLine(string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush logs any output that was not terminated by a newline.
+func (w *flannelLogWriter) Flush() {
+	if len(w.buf) > 0 {
+		w.logLine(string(w.buf))
+		w.buf = nil
+	}
+}
+
+func (w *flannelLogWriter) logLine(line string) {
+	if line == "" {
+		return
+	}
+	m := klogLineRegexp.FindStringSubmatch(line)
+	if m == nil {
+		w.entry.Info(line)
+		return
+	}
+	switch m[1] {
+	case "W":
+		w.entry.Warn(m[2])
+	case "E", "F":
+		// A fatal flanneld error only ends flanneld, not the agent
+		w.entry.Error(m[2])
+	default:
+		w.entry.Info(m[2])
+	}
+}
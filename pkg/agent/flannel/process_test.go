@@ -0,0 +1,527 @@
+//go:build linux
+// +build linux
+
+package flannel
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/k3s/pkg/daemons/config"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"k8s.io/utils/ptr"
+)
+
+// writeStubFlanneld writes a shell script that records its arguments and environment, then runs body.
+func writeStubFlanneld(t *testing.T, body string) (bin, argsFile string) {
+	t.Helper()
+	dir := t.TempDir()
+	bin = filepath.Join(dir, "flanneld")
+	argsFile = filepath.Join(dir, "args")
+	script := "#!/bin/sh\necho \"NODE_NAME=$NODE_NAME $@\" > " + argsFile + "\n" + body + "\n"
+	if err := os.WriteFile(bin, []byte(script), 0755); err != nil {
+		t.Fatalf("Failed to write stub flanneld: %v", err)
+	}
+	return bin, argsFile
+}
+
+func Test_flanneldArgs(t *testing.T) {
+	baseArgs := []string{
+		"--kube-subnet-mgr",
+		"--kubeconfig-file=/var/lib/rancher/k3s/agent/kubelet.kubeconfig",
+		"--kube-annotation-prefix=flannel.alpha.coreos.com",
+		"--net-config-path=/var/lib/rancher/k3s/agent/etc/flannel/net-conf.json",
+		"--subnet-file=/run/flannel/subnet.env",
+		"--ip-masq",
+	}
+	tests := []struct {
+		name      string
+		ifaces    []string
+		publicIP  string
+		extraArgs []string
+		want      []string
+	}{
+		{"defaults", nil, "", nil, baseArgs},
+		{"interfaces", []string{"eth1", "eth2"}, "", nil, append(slices.Clone(baseArgs), "--iface=eth1", "--iface=eth2")},
+		{"public ipv4", []string{"eth1"}, "203.0.113.10", nil, append(slices.Clone(baseArgs), "--iface=eth1", "--public-ip=203.0.113.10")},
+		{"public ipv6", nil, "2001:db8::10", nil, append(slices.Clone(baseArgs), "--public-ipv6=2001:db8::10")},
+		{"extra args", []string{"eth1"}, "", []string{"--iptables-resync=10", "--ip-masq=false"}, append(slices.Clone(baseArgs), "--iface=eth1", "--iptables-resync=10", "--ip-masq=false")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodeConfig := &config.Node{
+				FlannelConfFile:  "/var/lib/rancher/k3s/agent/etc/flannel/net-conf.json",
+				FlannelPublicIP:  tt.publicIP,
+				FlannelExtraArgs: tt.extraArgs,
+			}
+			nodeConfig.AgentConfig.KubeConfigKubelet = "/var/lib/rancher/k3s/agent/kubelet.kubeconfig"
+			if got := flanneldArgs(nodeConfig, tt.ifaces); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("flanneldArgs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_flanneldArgsKubeConfig(t *testing.T) {
+	nodeConfig := &config.Node{
+		FlannelConfFile:   "/var/lib/rancher/k3s/agent/etc/flannel/net-conf.json",
+		FlannelKubeConfig: "/etc/flannel/kubeconfig",
+		FlannelKubeAPIURL: "https://10.0.0.1:6443",
+	}
+	nodeConfig.AgentConfig.KubeConfigKubelet = "/var/lib/rancher/k3s/agent/kubelet.kubeconfig"
+	want := "--kube-subnet-mgr --kubeconfig-file=/etc/flannel/kubeconfig --kube-annotation-prefix=flannel.alpha.coreos.com --net-config-path=/var/lib/rancher/k3s/agent/etc/flannel/net-conf.json --kube-api-url=https://10.0.0.1:6443 --subnet-file=/run/flannel/subnet.env --ip-masq"
+	if got := strings.Join(flanneldArgs(nodeConfig, nil), " "); got != want {
+		t.Errorf("flanneldArgs() = %s, want %s", got, want)
+	}
+}
+
+func Test_flanneldArgsIPMasq(t *testing.T) {
+	tests := []struct {
+		name        string
+		noIPMasq    bool
+		ipv6Masq    bool
+		disableMasq bool
+		want        string
+	}{
+		{"ipv4 only", false, false, false, "--ip-masq"},
+		{"ipv4 and ipv6", false, true, false, "--ip-masq"},
+		{"ipv6 only", true, true, false, "--ip-masq"},
+		{"neither", true, false, false, "--ip-masq=false"},
+		{"disabled", false, false, true, "--ip-masq=false"},
+		{"disabled with ipv6", false, true, true, "--ip-masq=false"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodeConfig := &config.Node{FlannelNoIPMasq: tt.noIPMasq, FlannelIPv6Masq: tt.ipv6Masq, FlannelDisableMasq: tt.disableMasq}
+			var got []string
+			for _, arg := range flanneldArgs(nodeConfig, nil) {
+				if strings.HasPrefix(arg, "--ip-masq") {
+					got = append(got, arg)
+				}
+			}
+			if !reflect.DeepEqual(got, []string{tt.want}) {
+				t.Errorf("flanneldArgs() masquerade args = %v, want [%s]", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_flanneldArgsHealthz(t *testing.T) {
+	tests := []struct {
+		name string
+		ip   string
+		port int
+		want []string
+	}{
+		{"disabled", "", 0, nil},
+		{"port", "", 8471, []string{"--healthz-port=8471"}},
+		{"ip and port", "127.0.0.1", 8471, []string{"--healthz-ip=127.0.0.1", "--healthz-port=8471"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodeConfig := &config.Node{FlannelHealthzIP: tt.ip, FlannelHealthzPort: tt.port}
+			var got []string
+			for _, arg := range flanneldArgs(nodeConfig, nil) {
+				if strings.HasPrefix(arg, "--healthz-") {
+					got = append(got, arg)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("flanneldArgs() healthz args = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_flanneldArgsSubnetFile(t *testing.T) {
+	tests := []struct {
+		name       string
+		subnetFile string
+		want       []string
+	}{
+		{"default", "", []string{"--subnet-file=/run/flannel/subnet.env"}},
+		{"configured", "/var/lib/flannel/subnet.env", []string{"--subnet-file=/var/lib/flannel/subnet.env"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodeConfig := &config.Node{FlannelSubnetFile: tt.subnetFile}
+			var got []string
+			for _, arg := range flanneldArgs(nodeConfig, nil) {
+				if strings.HasPrefix(arg, "--subnet-file") {
+					got = append(got, arg)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("flanneldArgs() subnet file args = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_flanneldArgsAnnotationPrefix(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		want   []string
+	}{
+		{"default", "", []string{"--kube-annotation-prefix=flannel.alpha.coreos.com"}},
+		{"configured", "flannel.storage.example.com", []string{"--kube-annotation-prefix=flannel.storage.example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodeConfig := &config.Node{FlannelAnnotationPrefix: tt.prefix}
+			var got []string
+			for _, arg := range flanneldArgs(nodeConfig, nil) {
+				if strings.HasPrefix(arg, "--kube-annotation-prefix") {
+					got = append(got, arg)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("flanneldArgs() annotation prefix args = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_flanneldArgsLogLevel(t *testing.T) {
+	tests := []struct {
+		name     string
+		logLevel *int
+		vLevel   int
+		want     []string
+	}{
+		{"default", nil, 0, nil},
+		{"agent level", nil, 2, []string{"-v=2"}},
+		{"flannel level", ptr.To(4), 0, []string{"-v=4"}},
+		{"flannel level overrides agent level", ptr.To(6), 2, []string{"-v=6"}},
+		{"flannel level lowers agent level", ptr.To(0), 2, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodeConfig := &config.Node{FlannelLogLevel: tt.logLevel}
+			nodeConfig.AgentConfig.VLevel = tt.vLevel
+			var got []string
+			for _, arg := range flanneldArgs(nodeConfig, nil) {
+				if strings.HasPrefix(arg, "-v=") {
+					got = append(got, arg)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("flanneldArgs() verbosity args = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_validateLogLevel(t *testing.T) {
+	tests := []struct {
+		name     string
+		logLevel *int
+		external bool
+		wantErr  bool
+	}{
+		{"unset", nil, false, false},
+		{"lowest", ptr.To(0), true, false},
+		{"highest", ptr.To(10), true, false},
+		{"embedded flannel", ptr.To(2), false, true},
+		{"negative", ptr.To(-1), true, true},
+		{"too high", ptr.To(11), true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateLogLevel(&config.Node{FlannelLogLevel: tt.logLevel, FlannelExternalProcess: tt.external}); (err != nil) != tt.wantErr {
+				t.Errorf("validateLogLevel() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_validateExtraArgs(t *testing.T) {
+	tests := []struct {
+		name      string
+		extraArgs []string
+		external  bool
+		wantErr   bool
+	}{
+		{"unset", nil, false, false},
+		{"external flanneld", []string{"--iptables-resync=10"}, true, false},
+		{"embedded flannel", []string{"--iptables-resync=10"}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodeConfig := &config.Node{FlannelExtraArgs: tt.extraArgs, FlannelExternalProcess: tt.external}
+			if err := validateExtraArgs(nodeConfig); (err != nil) != tt.wantErr {
+				t.Errorf("validateExtraArgs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_validateHealthz(t *testing.T) {
+	tests := []struct {
+		name     string
+		ip       string
+		port     int
+		external bool
+		wantErr  bool
+	}{
+		{"disabled", "", 0, false, false},
+		{"port", "", 8471, true, false},
+		{"ipv4", "127.0.0.1", 8471, true, false},
+		{"ipv6", "::1", 8471, true, false},
+		{"embedded flannel", "", 8471, false, true},
+		{"negative port", "", -1, true, true},
+		{"port too large", "", 65536, true, true},
+		{"invalid ip", "localhost", 8471, true, true},
+		{"ip without port", "127.0.0.1", 0, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodeConfig := &config.Node{FlannelHealthzIP: tt.ip, FlannelHealthzPort: tt.port, FlannelExternalProcess: tt.external}
+			if err := validateHealthz(nodeConfig); (err != nil) != tt.wantErr {
+				t.Errorf("validateHealthz() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_flannelProcess(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr bool
+	}{
+		{"clean exit", "exit 0", false},
+		{"failure", "exit 1", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bin, argsFile := writeStubFlanneld(t, tt.body)
+			nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN)
+			nodeConfig.FlannelBinary = bin
+			nodeConfig.AgentConfig.NodeName = "test-node"
+			if err := flannelProcess(context.Background(), nodeConfig, nil); (err != nil) != tt.wantErr {
+				t.Fatalf("flannelProcess() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			data, err := os.ReadFile(argsFile)
+			if err != nil {
+				t.Fatalf("Failed to read stub flanneld args: %v", err)
+			}
+			if got := string(data); !strings.HasPrefix(got, "NODE_NAME=test-node --kube-subnet-mgr") || !strings.Contains(got, "--net-config-path="+nodeConfig.FlannelConfFile) {
+				t.Errorf("stub flanneld ran with %q", got)
+			}
+		})
+	}
+}
+
+func Test_flannelProcessEtcd(t *testing.T) {
+	oldPutEtcdNetConf := putEtcdNetConf
+	t.Cleanup(func() { putEtcdNetConf = oldPutEtcdNetConf })
+	var gotKey, gotConf string
+	putEtcdNetConf = func(_ context.Context, _ *config.Node, key, netConf string) error {
+		gotKey, gotConf = key, netConf
+		return nil
+	}
+
+	bin, argsFile := writeStubFlanneld(t, "exit 0")
+	nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN)
+	nodeConfig.FlannelBinary = bin
+	nodeConfig.FlannelExternalProcess = true
+	nodeConfig.FlannelEtcdEndpoints = []string{"https://10.0.0.1:2379", "https://10.0.0.2:2379"}
+	nodeConfig.FlannelEtcdPrefix = "/k3s/flannel/"
+	nodeConfig.FlannelEtcdCAFile = "/etc/flannel/ca.crt"
+	nodeConfig.FlannelEtcdCertFile = "/etc/flannel/client.crt"
+	nodeConfig.FlannelEtcdKeyFile = "/etc/flannel/client.key"
+	if err := createFlannelConf(nodeConfig); err != nil {
+		t.Fatalf("createFlannelConf() error = %v", err)
+	}
+	if err := flannelProcess(context.Background(), nodeConfig, nil); err != nil {
+		t.Fatalf("flannelProcess() error = %v", err)
+	}
+
+	wantConf, err := os.ReadFile(nodeConfig.FlannelConfFile)
+	if err != nil {
+		t.Fatalf("Failed to read flannel conf: %v", err)
+	}
+	if gotKey != "/k3s/flannel/config" || gotConf != string(wantConf) {
+		t.Errorf("flannelProcess() stored %s = %q, want /k3s/flannel/config = %q", gotKey, gotConf, wantConf)
+	}
+	data, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatalf("Failed to read stub flanneld args: %v", err)
+	}
+	want := "--etcd-endpoints=https://10.0.0.1:2379,https://10.0.0.2:2379 --etcd-prefix=/k3s/flannel --etcd-cafile=/etc/flannel/ca.crt --etcd-certfile=/etc/flannel/client.crt --etcd-keyfile=/etc/flannel/client.key --subnet-file=/run/flannel/subnet.env --ip-masq"
+	if got := strings.TrimSpace(string(data)); !strings.HasSuffix(got, want) || strings.Contains(got, "--kube-subnet-mgr") {
+		t.Errorf("stub flanneld ran with %q, want %q", got, want)
+	}
+}
+
+func Test_flannelProcessLogs(t *testing.T) {
+	hook := logtest.NewGlobal()
+	t.Cleanup(func() { logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks)) })
+
+	bin, _ := writeStubFlanneld(t, `echo "I1014 12:00:00.000001       1 main.go:211] CLI flags config"
+echo "W1014 12:00:00.000002       1 main.go:240] no public IP" >&2
+echo "E1014 12:00:00.000003       1 main.go:300] failed to acquire lease" >&2
+echo plain output
+printf unterminated`)
+	nodeConfig := &config.Node{FlannelBinary: bin}
+	if err := flannelProcess(context.Background(), nodeConfig, nil); err != nil {
+		t.Fatalf("flannelProcess() error = %v", err)
+	}
+
+	want := []struct {
+		level   logrus.Level
+		message string
+	}{
+		{logrus.InfoLevel, "CLI flags config"},
+		{logrus.WarnLevel, "no public IP"},
+		{logrus.ErrorLevel, "failed to acquire lease"},
+		{logrus.InfoLevel, "plain output"},
+		{logrus.InfoLevel, "unterminated"},
+	}
+	var got []*logrus.Entry
+	for _, entry := range hook.AllEntries() {
+		if entry.Data["component"] == "flannel" {
+			got = append(got, entry)
+		}
+	}
+	if len(got) != len(want) {
+		t.Fatalf("flannelProcess() logged %d flannel lines, want %d", len(got), len(want))
+	}
+	for i, entry := range got {
+		if entry.Level != want[i].level || entry.Message != want[i].message {
+			t.Errorf("flannelProcess() logged %s %q, want %s %q", entry.Level, entry.Message, want[i].level, want[i].message)
+		}
+	}
+}
+
+func Test_flannelProcessCancel(t *testing.T) {
+	bin, _ := writeStubFlanneld(t, "exec sleep 60")
+	nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN)
+	nodeConfig.FlannelBinary = bin
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() { errs <- flannelProcess(ctx, nodeConfig, nil) }()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-errs:
+		if err != context.Canceled {
+			t.Errorf("flannelProcess() error = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("flannelProcess() did not stop the child process after the context was cancelled")
+	}
+}
+
+func Test_flannelProcessRestart(t *testing.T) {
+	setFlannelRestartPolicy(t, 5, time.Minute)
+	dir := t.TempDir()
+	countFile := filepath.Join(dir, "count")
+	// Fail on the first two runs, then exit cleanly
+	bin, _ := writeStubFlanneld(t, "echo run >> "+countFile+"\n[ $(wc -l < "+countFile+") -ge 3 ]")
+	nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN)
+	nodeConfig.FlannelBinary = bin
+
+	err := superviseFlannel(context.Background(), nil, func(ctx context.Context) error {
+		return flannelProcess(ctx, nodeConfig, nil)
+	})
+	if err != nil {
+		t.Fatalf("superviseFlannel() error = %v", err)
+	}
+	data, err := os.ReadFile(countFile)
+	if err != nil {
+		t.Fatalf("Failed to read run count: %v", err)
+	}
+	if runs := strings.Count(string(data), "run"); runs != 3 {
+		t.Errorf("stub flanneld ran %d times, want 3", runs)
+	}
+}
+
+func Test_flannelProcessNetns(t *testing.T) {
+	// The stub ip command records the netns args, and the stub flanneld that it runs records its own args
+	ipBin, ipArgsFile := writeStubFlanneld(t, "shift 3\nexec \"$@\"")
+	binDir := filepath.Join(t.TempDir(), "bin")
+	if err := os.MkdirAll(binDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(ipBin, filepath.Join(binDir, "ip")); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	bin, argsFile := writeStubFlanneld(t, "exit 0")
+	nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN)
+	nodeConfig.FlannelBinary = bin
+	nodeConfig.FlannelNetns = "flannel"
+	nodeConfig.FlannelIfaces = []string{"eth1"}
+	nodeConfig.AgentConfig.NodeName = "test-node"
+	if err := flannelProcess(context.Background(), nodeConfig, []net.Interface{{Name: "eth0"}}); err != nil {
+		t.Fatalf("flannelProcess() error = %v", err)
+	}
+
+	data, err := os.ReadFile(ipArgsFile)
+	if err != nil {
+		t.Fatalf("Failed to read stub ip args: %v", err)
+	}
+	if got := string(data); !strings.HasPrefix(got, "NODE_NAME=test-node netns exec flannel "+bin+" --kube-subnet-mgr") {
+		t.Errorf("stub ip ran with %q", got)
+	}
+	data, err = os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatalf("Failed to read stub flanneld args: %v", err)
+	}
+	got := string(data)
+	if !strings.Contains(got, "--iface=eth1") || strings.Contains(got, "--iface=eth0") {
+		t.Errorf("stub flanneld ran with %q, want only the configured interfaces", got)
+	}
+}
+
+func Test_validateNetns(t *testing.T) {
+	oldNetnsDir, oldLookPath := netnsDir, lookPath
+	t.Cleanup(func() {
+		netnsDir = oldNetnsDir
+		lookPath = oldLookPath
+	})
+	netnsDir = t.TempDir()
+	if err := os.WriteFile(filepath.Join(netnsDir, "flannel"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	lookPath = func(file string) (string, error) { return "/usr/sbin/" + file, nil }
+
+	tests := []struct {
+		name     string
+		netns    string
+		external bool
+		wantErr  string
+	}{
+		{"no netns", "", false, ""},
+		{"external", "flannel", true, ""},
+		{"embedded", "flannel", false, "external flanneld process"},
+		{"missing", "other", true, "not found"},
+		{"path", "../flannel", true, "expected the name of a namespace"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodeConfig := &config.Node{FlannelNetns: tt.netns, FlannelExternalProcess: tt.external}
+			err := validateNetns(nodeConfig)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validateNetns() error = %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validateNetns() error = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package flannel
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/k3s-io/k3s/pkg/daemons/config"
+	"github.com/sirupsen/logrus"
+)
+
+// notifyReload returns a channel that receives when the agent is sent SIGHUP.
+// It is a variable so that tests can replace it.
+var notifyReload = func(ctx context.Context) <-chan os.Signal {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		<-ctx.Done()
+		signal.Stop(ch)
+	}()
+	return ch
+}
+
+// watchReload re-renders the CNI conf and the flannel config each time reload receives, so that
+// changes to the files they are rendered from are picked up without restarting the agent. The CNI
+// conf is read by the CNI plugin for each pod, so it applies right away. Flanneld cannot reload its
+// config, so an external flanneld is restarted through restart if its config changed; embedded
+// flannel cannot be restarted in place, so the agent must be restarted instead.
+func watchReload(ctx context.Context, lf logrus.Fields, nodeConfig *config.Node, reload <-chan os.Signal, restart chan<- struct{}) {
+	current, _ := os.ReadFile(nodeConfig.FlannelConfFile)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reload:
+		}
+
+		logrus.WithFields(lf).Info("Reloading flannel configuration")
+		if err := createCNIConf(nodeConfig.AgentConfig.CNIConfDir, nodeConfig); err != nil {
+			logrus.WithFields(lf).Errorf("Failed to reload flannel CNI conf: %v", err)
+		}
+		if err := createFlannelConf(nodeConfig); err != nil {
+			logrus.WithFields(lf).Errorf("Failed to reload flannel configuration: %v", err)
+			continue
+		}
+
+		conf, err := os.ReadFile(nodeConfig.FlannelConfFile)
+		if err != nil {
+			logrus.WithFields(lf).Errorf("Failed to read reloaded flannel configuration: %v", err)
+			continue
+		}
+		if bytes.Equal(conf, current) {
+			logrus.WithFields(lf).Info("Flannel configuration is unchanged")
+			continue
+		}
+		current = conf
+		if !nodeConfig.FlannelExternalProcess {
+			logrus.WithFields(lf).Warn("Flannel configuration changed; restart the agent to apply it to the embedded flannel")
+			continue
+		}
+		logrus.WithFields(lf).Info("Flannel configuration changed; restarting flanneld")
+		select {
+		case restart <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// restartOn wraps run so that it is stopped and started again each time restart receives. Unlike
+// a failure, a requested restart does not count towards the restart limit in superviseFlannel.
+func restartOn(restart <-chan struct{}, run func(ctx context.Context) error) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		for {
+			runCtx, cancel := context.WithCancel(ctx)
+			done := make(chan error, 1)
+			go func() { done <- run(runCtx) }()
+			select {
+			case err := <-done:
+				cancel()
+				return err
+			case <-restart:
+				cancel()
+				<-done
+			}
+		}
+	}
+}
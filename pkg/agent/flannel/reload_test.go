@@ -0,0 +1,110 @@
+//go:build linux
+// +build linux
+
+package flannel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/k3s/pkg/daemons/config"
+)
+
+func Test_watchReload(t *testing.T) {
+	oldUnderlayMTU := underlayMTU
+	t.Cleanup(func() { underlayMTU = oldUnderlayMTU })
+	underlayMTU = func(*net.Interface, int) (int, error) { return 0, nil }
+
+	for _, external := range []bool{true, false} {
+		name := "embedded"
+		if external {
+			name = "external process"
+		}
+		t.Run(name, func(t *testing.T) {
+			cniDir := t.TempDir()
+			template := filepath.Join(t.TempDir(), "cni-template.json")
+			if err := os.WriteFile(template, []byte(cniConf), 0644); err != nil {
+				t.Fatalf("Failed to write CNI conf template: %v", err)
+			}
+			nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN)
+			nodeConfig.FlannelExternalProcess = external
+			nodeConfig.AgentConfig.CNIConfDir = cniDir
+			nodeConfig.AgentConfig.CNIConfForce = true
+			nodeConfig.AgentConfig.FlannelCniConfTemplate = template
+			if err := createCNIConf(cniDir, nodeConfig); err != nil {
+				t.Fatalf("createCNIConf() error = %v", err)
+			}
+			if err := createFlannelConf(nodeConfig); err != nil {
+				t.Fatalf("createFlannelConf() error = %v", err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			reload := make(chan os.Signal)
+			restart := make(chan struct{}, 1)
+			done := make(chan struct{})
+			go func() {
+				watchReload(ctx, nil, nodeConfig, reload, restart)
+				close(done)
+			}()
+
+			// Change both the CNI conf template and the flannel config, then reload
+			if err := os.WriteFile(template, []byte(strings.Replace(cniConf, `"type":"bandwidth"`, `"type":"tuning"`, 1)), 0644); err != nil {
+				t.Fatalf("Failed to write CNI conf template: %v", err)
+			}
+			nodeConfig.FlannelVNI = 42
+			reload <- syscall.SIGHUP
+			if external {
+				select {
+				case <-restart:
+				case <-time.After(5 * time.Second):
+					t.Fatal("Timed out waiting for flanneld to be restarted")
+				}
+			}
+
+			// Reloading an unchanged config must not restart flannel
+			reload <- syscall.SIGHUP
+			cancel()
+			<-done
+			select {
+			case <-restart:
+				t.Error("watchReload() restarted flannel without a config change")
+			default:
+			}
+			assertFileContains(t, filepath.Join(cniDir, "10-flannel.conflist"), []string{`"type":"tuning"`})
+			assertNetConf(t, nodeConfig.FlannelConfFile, `{"Backend": {"VNI": 42}}`)
+		})
+	}
+}
+
+func Test_restartOn(t *testing.T) {
+	restart := make(chan struct{})
+	var starts atomic.Int32
+	errDone := errors.New("done")
+	run := restartOn(restart, func(ctx context.Context) error {
+		if starts.Add(1) == 3 {
+			return errDone
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	result := make(chan error, 1)
+	go func() { result <- run(context.Background()) }()
+	restart <- struct{}{}
+	restart <- struct{}{}
+	if err := <-result; !errors.Is(err, errDone) {
+		t.Errorf("restartOn() error = %v, want %v", err, errDone)
+	}
+	if got := starts.Load(); got != 3 {
+		t.Errorf("restartOn() started run %d times, want 3", got)
+	}
+}
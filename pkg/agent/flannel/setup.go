@@ -2,135 +2,1532 @@ package flannel
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"math/rand"
 	"net"
+	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
 	goruntime "runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/k3s-io/k3s/pkg/agent/util"
 	"github.com/k3s-io/k3s/pkg/daemons/config"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/runtime"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/apimachinery/pkg/watch"
 	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/tools/cache"
 	toolswatch "k8s.io/client-go/tools/watch"
+	"k8s.io/client-go/util/retry"
 	utilsnet "k8s.io/utils/net"
 )
 
 const (
-	flannelConf = `{
-	"Network": "%CIDR%",
-	"EnableIPv6": %IPV6_ENABLED%,
-	"EnableIPv4": %IPV4_ENABLED%,
-	"IPv6Network": "%CIDR_IPV6%",
-	"Backend": %backend%
-}
-`
-
-	hostGWBackend = `{
-	"Type": "host-gw"
-}`
-
-	tailscaledBackend = `{
-	"Type": "extension",
-	"PostStartupCommand": "tailscale set --accept-routes --advertise-routes=%Routes%",
-	"ShutdownCommand": "tailscale down"
-}`
-
-	wireguardNativeBackend = `{
-	"Type": "wireguard",
-	"PersistentKeepaliveInterval": %PersistentKeepaliveInterval%,
-	"Mode": "%Mode%"
-}`
+	cniPortmapPlugin = `
+    {
+      "type":"portmap",
+      "capabilities":{
+        "portMappings":true
+      }
+    },`
+
+	// The portmap plugin uses iptables unless told otherwise, which would mix iptables and nftables rules
+	cniPortmapNFTablesPlugin = `
+    {
+      "type":"portmap",
+      "backend":"nftables",
+      "capabilities":{
+        "portMappings":true
+      }
+    },`
+
+	// The conditions are added to the rules that match the host ports of each pod
+	cniPortmapRangePlugin = `
+    {
+      "type":"portmap",
+      "capabilities":{
+        "portMappings":true
+      },
+      "conditionsV4":["-m","multiport","--dports","%[1]s"],
+      "conditionsV6":["-m","multiport","--dports","%[1]s"]
+    },`
 
 	emptyIPv6Network = "::/0"
 
-	ipv4 = iota
+	// Flannel's extension backend does not run the shutdown command itself, see teardownBackend
+	tailscaleShutdownCommand = "tailscale down"
+
+	// VXLAN network identifiers are 24 bits wide
+	maxVXLANVNI = 1<<24 - 1
+
+	wireguardKeyFileEnv  = "WIREGUARD_KEY_FILE"
+	wireguardKeyFileName = "wgkey"
+
+	// Default wireguard persistent keepalive interval, in seconds
+	defaultWireguardKeepalive = 25
+
+	// Bounds for an explicitly configured flannel MTU
+	minFlannelMTU = 576
+	maxFlannelMTU = 9216
+
+	defaultCNIVersion     = "1.0.0"
+	defaultCNINetworkName = "cbr0"
+	defaultCNIConfPrefix  = "10"
+
+	// The flannel CNI conf is written to <prefix>-flannel.conflist, or to <prefix>-flannel.conf as a
+	// single plugin conf for container runtimes that do not load conflists
+	cniConfSuffix       = "-flannel.conflist"
+	cniSingleConfSuffix = "-flannel.conf"
+)
+
+// Address families of the cluster CIDRs. Each is a bit of its own, so that a dual-stack netMode,
+// ipv4 + ipv6, is distinct from both, and 0 is no address family.
+const (
+	ipv4 = 1 << iota
 	ipv6
 )
 
+// ErrPodCIDRTimeout is returned by Run if the node's PodCIDR is not assigned in time. Nothing has been
+// started when it is returned, so Run can be called again.
+var ErrPodCIDRTimeout = errors.New("timed out waiting for PodCIDR")
+
+// Restart policy for flannel, see superviseFlannel. These are variables so that tests can shorten them.
+var (
+	flannelRestartBackoff    = time.Second
+	flannelRestartMaxBackoff = 30 * time.Second
+	flannelRestartWindow     = 5 * time.Minute
+	flannelRestartLimit      = 5
+
+	// Each restart delay is lengthened by a random fraction of up to flannelRestartJitter, so that
+	// nodes whose flannel failed at the same moment do not all restart it in lockstep. The random
+	// source is a variable so that tests can make the delays deterministic.
+	flannelRestartJitter = 0.2
+	flannelRestartRand   = rand.Float64
+
+	// RunWithRetry retries Run this many times when the PodCIDR is not assigned in time, waiting as long
+	// as before a flannel restart
+	flannelSetupRetryLimit = 10
+)
+
+// Retry policy for writing the flannel and CNI confs: up to ~3 seconds, so that a transient filesystem
+// error does not fail Prepare. The writer and backoff are variables so that tests can replace them.
+var (
+	writeConfFile    = util.WriteFile
+	writeConfBackoff = wait.Backoff{
+		Steps:    5,
+		Duration: 200 * time.Millisecond,
+		Factor:   2.0,
+		Jitter:   0.1,
+	}
+)
+
+// cniNameRegexp matches valid CNI network names, as defined by the CNI spec.
+var cniNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.\-]*$`)
+
+// cniConfPrefixRegexp matches valid CNI conf ordering prefixes.
+var cniConfPrefixRegexp = regexp.MustCompile(`^[0-9]+$`)
+
+// supportedCNIVersions lists the CNI spec versions that the CNI conf can be written as.
+var supportedCNIVersions = []string{"0.3.1", "0.4.0", "1.0.0"}
+
+// netConf is the flannel net-conf. It is marshaled rather than rendered from a template, so that
+// keys are always written in the order they are declared here; unset optional keys are omitted.
+type netConf struct {
+	Network        string `json:",omitempty"`
+	SubnetLen      int    `json:",omitempty"`
+	SubnetMin      string `json:",omitempty"`
+	SubnetMax      string `json:",omitempty"`
+	EnableIPv6     bool
+	EnableIPv4     bool
+	IPv6Network    string
+	EnableNFTables bool `json:",omitempty"`
+	Backend        interface{}
+}
+
+type vxlanBackend struct {
+	Type          string
+	VNI           int  `json:",omitempty"`
+	Port          int  `json:",omitempty"`
+	MTU           int  `json:",omitempty"`
+	GBP           bool `json:",omitempty"`
+	DirectRouting bool `json:",omitempty"`
+}
+
+type hostGWBackend struct {
+	Type string
+}
+
+// allocBackend only leases a subnet to the node. No overlay or routes are set up, so routes to the
+// subnets of other nodes must be programmed by something else, such as a BGP speaker.
+type allocBackend struct {
+	Type string
+}
+
+type ipipBackend struct {
+	Type          string
+	DirectRouting bool
+}
+
+type extensionBackend struct {
+	Type               string
+	PostStartupCommand string
+	ShutdownCommand    string
+}
+
+// The native wireguard backend requires flannel v0.14.0 or newer
+type wireguardBackend struct {
+	Type                        string
+	MTU                         int `json:",omitempty"`
+	ListenPort                  int `json:",omitempty"`
+	ListenPortV6                int `json:",omitempty"`
+	PersistentKeepaliveInterval int
+	Mode                        string
+}
+
+// interfaceExists and subnetFileWritten are used to check flannel readiness.
+// They are variables so that tests can replace them.
+var (
+	interfaceExists = func(name string) bool {
+		_, err := net.InterfaceByName(name)
+		return err == nil
+	}
+	subnetFileWritten = func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+)
+
+// Where the kernel lists its modules; these are variables so that tests can replace them
+var (
+	sysModuleDir    = "/sys/module"
+	procModulesFile = "/proc/modules"
+)
+
+// kernelModuleLoaded reports whether the named kernel module is loaded or built in: it has an entry in
+// /sys/module, or is listed in /proc/modules. It is a variable so that tests can replace it.
+var kernelModuleLoaded = func(name string) bool {
+	if _, err := os.Stat(filepath.Join(sysModuleDir, name)); err == nil {
+		return true
+	}
+	data, err := os.ReadFile(procModulesFile)
+	if err != nil {
+		return false
+	}
+	// Each line starts with the module name, in which the kernel replaces dashes with underscores
+	name = strings.ReplaceAll(name, "-", "_")
+	for _, line := range strings.Split(string(data), "\n") {
+		if module, _, _ := strings.Cut(line, " "); module == name {
+			return true
+		}
+	}
+	return false
+}
+
+// loadKernelModule loads the named kernel module with modprobe. It is a variable so that tests can
+// replace it.
+var loadKernelModule = func(name string) error {
+	modprobe, err := lookPath("modprobe")
+	if err != nil {
+		return err
+	}
+	if out, err := exec.Command(modprobe, name).CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// ensureKernelModule checks that the named kernel module is loaded, and loads it with modprobe if it
+// is available but not loaded, so that flannel does not fail later with a cryptic error from the
+// kernel. Nothing is loaded in a dry run, for which a module that is available is enough.
+func ensureKernelModule(nodeConfig *config.Node, name string) error {
+	if kernelModuleLoaded(name) {
+		return nil
+	}
+	if !kernelModuleAvailable(name) {
+		return fmt.Errorf("the %s kernel module is not available", name)
+	}
+	if nodeConfig.FlannelDryRun {
+		return nil
+	}
+	logrus.Infof("Loading the %s kernel module for flannel", name)
+	if err := loadKernelModule(name); err != nil {
+		return fmt.Errorf("the %s kernel module is not loaded, and loading it failed: %v", name, err)
+	}
+	if !kernelModuleLoaded(name) {
+		return fmt.Errorf("the %s kernel module is not loaded, although modprobe succeeded", name)
+	}
+	return nil
+}
+
+// kernelModuleAvailable reports whether the named kernel module is loaded, built in, or can be loaded
+// by the kernel on demand. It is a variable so that tests can replace it.
+var kernelModuleAvailable = func(name string) bool {
+	if kernelModuleLoaded(name) {
+		return true
+	}
+	release, err := os.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return false
+	}
+	dir := filepath.Join("/lib/modules", strings.TrimSpace(string(release)))
+	for _, index := range []string{"modules.builtin", "modules.dep"} {
+		data, err := os.ReadFile(filepath.Join(dir, index))
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			// Each line starts with the module path, which may be compressed, eg kernel/drivers/net/vxlan/vxlan.ko.zst
+			path, _, _ := strings.Cut(line, ":")
+			if base := filepath.Base(path); base == name+".ko" || strings.HasPrefix(base, name+".ko.") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// lookPath finds an executable in PATH. It is a variable so that tests can replace it.
+var lookPath = exec.LookPath
+
+// validateBackend checks that this node has what the flannel backend needs, and returns an error
+// listing everything that is missing.
+func validateBackend(nodeConfig *config.Node) error {
+	if err := checkBackendSupported(nodeConfig.FlannelBackend); err != nil {
+		return err
+	}
+
+	var missing []string
+	if goruntime.GOOS != "windows" {
+		switch nodeConfig.FlannelBackend {
+		case config.FlannelBackendVXLAN, config.FlannelBackendHostGWVXLAN:
+			if err := ensureKernelModule(nodeConfig, "vxlan"); err != nil {
+				missing = append(missing, err.Error()+"; install the kernel modules package for the running kernel")
+			}
+		case config.FlannelBackendIPIP:
+			if err := ensureKernelModule(nodeConfig, "ipip"); err != nil {
+				missing = append(missing, err.Error()+"; install the kernel modules package for the running kernel")
+			}
+		case config.FlannelBackendWireguardNative:
+			if err := ensureKernelModule(nodeConfig, "wireguard"); err != nil {
+				missing = append(missing, err.Error()+"; use Linux 5.6 or newer, or install the wireguard kernel module")
+			}
+		}
+	}
+	if nodeConfig.FlannelNFTables && nodeConfig.FlannelBackend != config.FlannelBackendNone {
+		if goruntime.GOOS == "windows" {
+			return errors.New("flannel nftables mode is not supported on Windows")
+		}
+		if !kernelModuleAvailable("nf_tables") {
+			missing = append(missing, "nftables mode requires the nf_tables kernel module, which is not available")
+		}
+		if _, err := lookPath("nft"); err != nil {
+			missing = append(missing, "nftables mode requires the nft binary, which was not found in PATH")
+		}
+	}
+	if nodeConfig.FlannelVXLANGBP {
+		if nodeConfig.FlannelBackend != config.FlannelBackendVXLAN && nodeConfig.FlannelBackend != config.FlannelBackendHostGWVXLAN {
+			return fmt.Errorf("flannel vxlan GBP can only be used with the %s or %s backend, not '%s'", config.FlannelBackendVXLAN, config.FlannelBackendHostGWVXLAN, nodeConfig.FlannelBackend)
+		}
+		if goruntime.GOOS == "windows" {
+			return errors.New("flannel vxlan GBP is not supported on Windows")
+		}
+		if !vxlanGBPSupported() {
+			missing = append(missing, "vxlan GBP requires Linux 4.0 or newer")
+		}
+	}
+	if nodeConfig.FlannelBackend == config.FlannelBackendTailscale {
+		if _, err := lookPath("tailscale"); err != nil {
+			missing = append(missing, "the tailscale binary was not found in PATH; install tailscale and log in with 'tailscale up'")
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("flannel backend '%s' cannot be used on this node: %s", nodeConfig.FlannelBackend, strings.Join(missing, "; "))
+	}
+	return nil
+}
+
 func Prepare(ctx context.Context, nodeConfig *config.Node) error {
+	// Remove the ready file first, so that it is only present if this Prepare succeeds
+	if err := removeReadyFile(nodeConfig); err != nil {
+		return err
+	}
+
+	// Check the backend before writing anything, so that an unusable backend does not leave a CNI conf behind
+	if err := validateBackend(nodeConfig); err != nil {
+		return err
+	}
+	if err := validateExtraArgs(nodeConfig); err != nil {
+		return err
+	}
+	if err := validateHealthz(nodeConfig); err != nil {
+		return err
+	}
+	if err := validateLogLevel(nodeConfig); err != nil {
+		return err
+	}
+	if flannelEtcdMode(nodeConfig) {
+		if err := validateEtcdConfig(nodeConfig); err != nil {
+			return err
+		}
+	}
+	if nodeConfig.FlannelBackend != config.FlannelBackendNone {
+		// The interfaces of a flannel network namespace are not visible from the host namespace
+		if nodeConfig.FlannelNetns == "" {
+			if err := checkInterfaceExists(nodeConfig); err != nil {
+				return err
+			}
+		}
+		netMode, err := findNetMode(nodeConfig.AgentConfig.ClusterCIDRs)
+		if err != nil {
+			return errors.Wrap(err, "failed to check netMode for flannel")
+		}
+		if err := checkClusterCIDROverlap(nodeConfig, netMode); err != nil {
+			return err
+		}
+	}
+
+	if err := checkCNIConfDirWritable(nodeConfig); err != nil {
+		return err
+	}
 	if err := createCNIConf(nodeConfig.AgentConfig.CNIConfDir, nodeConfig); err != nil {
 		return err
 	}
 
-	return createFlannelConf(nodeConfig)
+	// With the none backend another CNI provides pod networking, so only the CNI conf is written, if requested
+	if nodeConfig.FlannelBackend == config.FlannelBackendNone {
+		return writeReadyFile(nodeConfig)
+	}
+
+	if err := createFlannelConf(nodeConfig); err != nil {
+		return err
+	}
+
+	if nodeConfig.FlannelBackend == config.FlannelBackendWireguardNative {
+		if nodeConfig.FlannelDryRun {
+			logrus.Info("Dry run: not setting up the wireguard private key")
+			return nil
+		}
+		if err := setupWireguardKey(nodeConfig); err != nil {
+			return err
+		}
+	}
+	return writeReadyFile(nodeConfig)
+}
+
+// writeReadyFile writes the ready file, if one is configured, to signal that the flannel CNI conf
+// and config are in place. It records the backend and when the configs were written.
+func writeReadyFile(nodeConfig *config.Node) error {
+	if nodeConfig.FlannelReadyFile == "" || nodeConfig.FlannelDryRun {
+		return nil
+	}
+	content := fmt.Sprintf("backend=%s\ntime=%s\n", nodeConfig.FlannelBackend, time.Now().UTC().Format(time.RFC3339))
+	if err := util.WriteFile(nodeConfig.FlannelReadyFile, content); err != nil {
+		return errors.Wrap(err, "failed to write flannel ready file")
+	}
+	return nil
+}
+
+// removeReadyFile removes the ready file, if one is configured.
+func removeReadyFile(nodeConfig *config.Node) error {
+	if nodeConfig.FlannelReadyFile == "" || nodeConfig.FlannelDryRun {
+		return nil
+	}
+	if err := os.Remove(nodeConfig.FlannelReadyFile); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to remove flannel ready file")
+	}
+	return nil
+}
+
+func Run(ctx context.Context, nodeConfig *config.Node, nodes typedcorev1.NodeInterface) (err error) {
+	lf := logFields(nodeConfig)
+	if nodeConfig.FlannelBackend == config.FlannelBackendNone {
+		logrus.WithFields(lf).Info("Flannel backend is none; not starting flannel")
+		return nil
+	}
+	// A setup failure is also reported in the FlannelReady condition; a dry run makes no API calls
+	defer func() {
+		if err != nil && !nodeConfig.FlannelDryRun && ctx.Err() == nil {
+			reportFlannelReady(ctx, lf, nodes, nodeConfig.AgentConfig.NodeName, v1.ConditionFalse, flannelSetupFailedReason, err.Error())
+		}
+	}()
+	netMode, err := findNetMode(nodeConfig.AgentConfig.ClusterCIDRs)
+	if err != nil {
+		return errors.Wrap(err, "failed to check netMode for flannel")
+	}
+
+	if err := validateNetns(nodeConfig); err != nil {
+		return err
+	}
+	// The interfaces of a flannel network namespace are not visible from the host namespace, and the alloc
+	// backend sets up nothing on the interface; flannel then uses the configured or default interface.
+	var candidates []net.Interface
+	if nodeConfig.FlannelNetns == "" && nodeConfig.FlannelBackend != config.FlannelBackendAlloc {
+		candidates, err = candidateInterfaces(nodeConfig, netMode)
+		if err != nil {
+			return errors.Wrap(err, "failed to find an interface for flannel")
+		}
+	}
+
+	publicIP, err := parsePublicIP(nodeConfig.FlannelPublicIP)
+	if err != nil {
+		return err
+	}
+	if err := validateFlannelKubeConfig(nodeConfig); err != nil {
+		return err
+	}
+	if err := validateAnnotationPrefix(nodeConfig); err != nil {
+		return err
+	}
+	if err := validateHealthz(nodeConfig); err != nil {
+		return err
+	}
+	if err := validateLogLevel(nodeConfig); err != nil {
+		return err
+	}
+	if err := validateExtraArgs(nodeConfig); err != nil {
+		return err
+	}
+	if err := ensureSubnetFileDir(nodeConfig); err != nil {
+		return err
+	}
+
+	if nodeConfig.FlannelDryRun {
+		logrus.WithFields(lf).Infof("Dry run: not starting flannel %s", config.ArgString(flanneldArgs(nodeConfig, flanneldIfaces(nodeConfig, candidates))))
+		return nil
+	}
+	logrus.WithFields(lf).Infof("Starting flannel with backend %s", nodeConfig.FlannelBackend)
+	registerMetrics()
+
+	podCIDRs, err := waitForPodCIDR(ctx, nodeConfig.AgentConfig.NodeName, nodes, netMode, nodeConfig.FlannelPodCIDRTimeout)
+	if err != nil {
+		return errors.Wrap(err, "flannel failed to wait for PodCIDR assignment")
+	}
+	lf["podCIDR"] = strings.Join(podCIDRs, ",")
+	if err := applyBackendLabel(ctx, lf, nodeConfig, nodes); err != nil {
+		return errors.Wrap(err, "failed to apply the flannel backend label")
+	}
+	flannelBackendInfo.WithLabelValues(nodeConfig.FlannelBackend).Set(1)
+	if err := annotateBackend(ctx, nodes, nodeConfig.AgentConfig.NodeName, nodeConfig.FlannelBackend); err != nil {
+		logrus.WithFields(lf).Warnf("Failed to set the flannel backend annotation: %v", err)
+	}
+	if err := annotateWireguardKey(ctx, nodes, nodeConfig); err != nil {
+		logrus.WithFields(lf).Warnf("Failed to set the wireguard public key annotation: %v", err)
+	}
+	if nodeConfig.FlannelNetworkFromNodes && !nodeConfig.FlannelConfOverride {
+		if err := reconcileNetworks(ctx, lf, nodeConfig, nodes); err != nil {
+			logrus.WithFields(lf).Warnf("Failed to derive the flannel network from node PodCIDRs; using the cluster CIDR: %v", err)
+		}
+	}
+	if err := validatePodCIDRs(podCIDRs, flannelNetworks(nodeConfig)); err != nil {
+		return errors.Wrap(err, "flannel cannot use the PodCIDR assigned to this node")
+	}
+
+	// Flannel reads the MTU from its config when the wireguard device is created, so the config is
+	// rewritten before flannel is started. An explicitly configured MTU is never changed.
+	if nodeConfig.FlannelMTUProbe && nodeConfig.FlannelBackend == config.FlannelBackendWireguardNative && nodeConfig.FlannelMTU == 0 && !nodeConfig.FlannelConfOverride {
+		probeWireguardMTU(ctx, nodeConfig, nodes, netMode)
+	}
+
+	if ipv4Masq, ipv6Masq := ipMasq(nodeConfig); nodeConfig.FlannelExternalProcess && netMode != ipv4 && ipv4Masq != ipv6Masq {
+		logrus.WithFields(lf).Warn("Flanneld cannot set up masquerading per address family; masquerading is enabled for both IPv4 and IPv6")
+	}
+
+	restart := make(chan struct{}, 1)
+	go watchReload(ctx, lf, nodeConfig, notifyReload(ctx), restart)
+
+	go func() {
+		err := superviseFlannel(ctx, lf, conditionRunner(lf, nodeConfig, nodes, flannelRunner(nodeConfig, candidates, publicIP, netMode, restart)))
+		if err != nil && !errors.Is(err, context.Canceled) {
+			logrus.WithFields(lf).Errorf("flannel exited: %v", err)
+			os.Exit(1)
+		}
+		if nodeConfig.FlannelCleanupOnStop {
+			teardownBackend(lf, nodeConfig, netMode)
+		}
+		os.Exit(0)
+	}()
+
+	if nodeConfig.FlannelConnectivityProbe {
+		go checkConnectivity(ctx, lf, nodeConfig, nodes, netMode)
+	}
+
+	return nil
+}
+
+// runFlannelSetup is Run. It is a variable so that tests can replace it.
+var runFlannelSetup = Run
+
+// RunWithRetry calls Run, and calls it again while it fails with ErrPodCIDRTimeout, waiting with jittered
+// exponential backoff before each retry. It gives up after flannelSetupRetryLimit retries, and returns
+// early once the context is done.
+func RunWithRetry(ctx context.Context, nodeConfig *config.Node, nodes typedcorev1.NodeInterface) error {
+	lf := logFields(nodeConfig)
+	for retries := 0; ; retries++ {
+		err := runFlannelSetup(ctx, nodeConfig, nodes)
+		if err == nil || !errors.Is(err, ErrPodCIDRTimeout) {
+			return err
+		}
+		if retries >= flannelSetupRetryLimit {
+			return errors.Wrapf(err, "flannel setup failed %d times", retries+1)
+		}
+		delay := flannelRestartDelay(retries + 1)
+		logrus.WithFields(lf).Warnf("Retrying flannel setup in %v: %v", delay, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// startFlannel runs the embedded flannel. It is a variable so that tests can replace it.
+var startFlannel = flannel
+
+// flannelRunner returns the function that runs flannel until it exits or the context is done: an external
+// flanneld process, which is restarted on reload, or the embedded flannel on the selected interface.
+func flannelRunner(nodeConfig *config.Node, candidates []net.Interface, publicIP net.IP, netMode int, restart <-chan struct{}) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		if nodeConfig.FlannelExternalProcess {
+			return restartOn(restart, func(ctx context.Context) error {
+				return flannelProcess(ctx, nodeConfig, candidates)
+			})(ctx)
+		}
+		iface := nodeConfig.FlannelIface
+		if len(candidates) > 0 {
+			selected, err := selectInterface(candidates, netMode)
+			if err != nil {
+				return err
+			}
+			iface = selected
+		}
+		ipv4Masq, ipv6Masq := ipMasq(nodeConfig)
+		return startFlannel(ctx, iface, nodeConfig.FlannelConfFile, flannelSubnetFile(nodeConfig), nodeConfig.FlannelKubeAPIURL, flannelKubeConfig(nodeConfig), AnnotationPrefix(nodeConfig), ipv4Masq, ipv6Masq, publicIP, netMode)
+	}
+}
+
+// ipMasq returns whether flannel masquerades traffic from pods to outside the cluster, for IPv4 and IPv6.
+// FlannelDisableMasq turns off masquerading for both, for networks that NAT pod traffic elsewhere.
+func ipMasq(nodeConfig *config.Node) (ipv4Masq, ipv6Masq bool) {
+	if nodeConfig.FlannelDisableMasq {
+		return false, false
+	}
+	return !nodeConfig.FlannelNoIPMasq, nodeConfig.FlannelIPv6Masq
+}
+
+// flannelSubnetFile returns where flannel writes its subnet file: FlannelSubnetFile if it is set, and
+// otherwise /run/flannel/subnet.env.
+func flannelSubnetFile(nodeConfig *config.Node) string {
+	if nodeConfig.FlannelSubnetFile != "" {
+		return nodeConfig.FlannelSubnetFile
+	}
+	return defaultSubnetFile
+}
+
+// ensureSubnetFileDir checks that a configured subnet file path is absolute, and creates its parent
+// directory, so that a bad path fails Run instead of only being logged once flannel has started.
+func ensureSubnetFileDir(nodeConfig *config.Node) error {
+	path := nodeConfig.FlannelSubnetFile
+	if path == "" {
+		return nil
+	}
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("flannel subnet file %s must be an absolute path", path)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.Wrapf(err, "failed to create the directory for flannel subnet file %s", path)
+	}
+	return nil
+}
+
+// flannelKubeConfig returns the kubeconfig that flannel uses to connect to the apiserver: the flannel
+// kubeconfig if one is configured, and otherwise the kubelet kubeconfig.
+func flannelKubeConfig(nodeConfig *config.Node) string {
+	if nodeConfig.FlannelKubeConfig != "" {
+		return nodeConfig.FlannelKubeConfig
+	}
+	return nodeConfig.AgentConfig.KubeConfigKubelet
+}
+
+// validateFlannelKubeConfig checks that a configured flannel kubeconfig exists, and that a configured
+// apiserver URL, which overrides the server in the kubeconfig, is an http or https URL.
+func validateFlannelKubeConfig(nodeConfig *config.Node) error {
+	if nodeConfig.FlannelKubeConfig != "" {
+		if _, err := os.Stat(nodeConfig.FlannelKubeConfig); err != nil {
+			return errors.Wrap(err, "invalid flannel kubeconfig")
+		}
+	}
+	if apiURL := nodeConfig.FlannelKubeAPIURL; apiURL != "" {
+		u, err := url.Parse(apiURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("invalid flannel apiserver URL %q: must be an http or https URL", apiURL)
+		}
+	}
+	return nil
+}
+
+// AnnotationPrefix returns the prefix of the annotations that the flannel kube subnet manager records
+// its lease in: FlannelAnnotationPrefix if it is set, and otherwise flannel's standard prefix. Flannel
+// networks that share nodes need different prefixes, so that they do not overwrite each other's leases.
+func AnnotationPrefix(nodeConfig *config.Node) string {
+	if nodeConfig.FlannelAnnotationPrefix != "" {
+		return nodeConfig.FlannelAnnotationPrefix
+	}
+	return FlannelBaseAnnotation
+}
+
+// ExternalIPAnnotations returns the annotations that override the public IPv4 and IPv6 addresses that
+// flannel advertises for the node.
+func ExternalIPAnnotations(nodeConfig *config.Node) (ipv4, ipv6 string) {
+	prefix := AnnotationPrefix(nodeConfig)
+	return prefix + "/public-ip-overwrite", prefix + "/public-ipv6-overwrite"
+}
+
+// validateAnnotationPrefix checks that a configured annotation prefix is a legal annotation key
+// prefix; that is, a DNS subdomain such as flannel.alpha.coreos.com.
+func validateAnnotationPrefix(nodeConfig *config.Node) error {
+	prefix := nodeConfig.FlannelAnnotationPrefix
+	if prefix == "" {
+		return nil
+	}
+	if errs := validation.IsDNS1123Subdomain(prefix); len(errs) != 0 {
+		return fmt.Errorf("invalid flannel annotation prefix %q: %s", prefix, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Ready polls until flannel is up on this node; that is, until flannel has written its subnet file,
+// and the interfaces created by the backend exist. An error is returned if the context is done first.
+func Ready(ctx context.Context, nodeConfig *config.Node) error {
+	netMode, err := findNetMode(nodeConfig.AgentConfig.ClusterCIDRs)
+	if err != nil {
+		return errors.Wrap(err, "failed to check netMode for flannel")
+	}
+	ifaces := backendInterfaces(nodeConfig, netMode)
+	return wait.PollUntilContextCancel(ctx, time.Second, true, func(ctx context.Context) (bool, error) {
+		if !subnetFileWritten(flannelSubnetFile(nodeConfig)) {
+			return false, nil
+		}
+		for _, name := range ifaces {
+			if !interfaceExists(name) {
+				logrus.Debugf("Waiting for flannel interface %s to be created", name)
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+}
+
+// teardownBackend removes what the flannel backend set up on this node, so that a later start
+// with a different backend begins from a clean slate. This is best-effort: errors are logged, and
+// do not stop the remaining teardown. Deleting an interface also deletes the routes through it.
+func teardownBackend(lf logrus.Fields, nodeConfig *config.Node, netMode int) {
+	if err := removeReadyFile(nodeConfig); err != nil {
+		logrus.WithFields(lf).Error(err)
+	}
+	if nodeConfig.FlannelBackend == config.FlannelBackendTailscale {
+		logrus.WithFields(lf).Infof("Running flannel backend shutdown command: %s", tailscaleShutdownCommand)
+		if err := runShutdownCommand(tailscaleShutdownCommand); err != nil {
+			logrus.WithFields(lf).Errorf("Flannel backend shutdown command failed: %v", err)
+		}
+	}
+	for _, name := range backendInterfaces(nodeConfig, netMode) {
+		logrus.WithFields(lf).Infof("Deleting flannel interface %s", name)
+		if err := deleteLink(name); err != nil {
+			logrus.WithFields(lf).Errorf("Failed to delete flannel interface %s: %v", name, err)
+		}
+	}
+}
+
+// runShutdownCommand runs a backend shutdown command. The agent's context is already cancelled
+// at shutdown, so the command gets its own timeout.
+// It is a variable so that tests can replace it.
+var runShutdownCommand = func(command string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	args := strings.Fields(command)
+	out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "%s: %s", command, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Cleanup removes what flannel setup leaves on the node, so that another CNI can be installed: the
+// generated CNI confs and flannel config, the generated wireguard private key, and the interfaces
+// created by any backend, including the CNI bridge. Each step is best-effort; errors are logged, and
+// the remaining steps are still attempted. Files that were provided by the user are not removed.
+func Cleanup(nodeConfig *config.Node) {
+	lf := logFields(nodeConfig)
+	var files []string
+	if dir := nodeConfig.AgentConfig.CNIConfDir; dir != "" && !nodeConfig.AgentConfig.DisableCNIConf {
+		names, err := staleCNIConfs(dir, "")
+		if err != nil {
+			logrus.WithFields(lf).Errorf("Failed to find flannel CNI confs: %v", err)
+		}
+		for _, name := range names {
+			files = append(files, filepath.Join(dir, name))
+		}
+	}
+	if nodeConfig.FlannelConfFile != "" && !nodeConfig.FlannelConfOverride {
+		files = append(files, nodeConfig.FlannelConfFile)
+	}
+	if nodeConfig.FlannelConfFile != "" || nodeConfig.FlannelRuntimeDir != "" {
+		files = append(files, filepath.Join(flannelRuntimeDir(nodeConfig), wireguardKeyFileName))
+	}
+	if nodeConfig.FlannelReadyFile != "" {
+		files = append(files, nodeConfig.FlannelReadyFile)
+	}
+	for _, file := range files {
+		if err := os.Remove(file); err == nil {
+			logrus.WithFields(lf).Infof("Removed %s", file)
+		} else if !os.IsNotExist(err) {
+			logrus.WithFields(lf).Errorf("Failed to remove %s: %v", file, err)
+		}
+	}
+
+	for _, name := range cleanupInterfaces(nodeConfig) {
+		if err := deleteLink(name); err != nil {
+			logrus.WithFields(lf).Errorf("Failed to delete flannel interface %s: %v", name, err)
+		}
+	}
+}
+
+// cleanupInterfaces returns the interfaces that any flannel backend may have created for either
+// address family, as the backend may have been changed since they were created.
+func cleanupInterfaces(nodeConfig *config.Node) []string {
+	var ifaces []string
+	for _, backend := range []string{config.FlannelBackendVXLAN, config.FlannelBackendIPIP, config.FlannelBackendWireguardNative} {
+		backendConfig := *nodeConfig
+		backendConfig.FlannelBackend = backend
+		ifaces = append(ifaces, backendInterfaces(&backendConfig, ipv4+ipv6)...)
+	}
+	if goruntime.GOOS != "windows" {
+		ifaces = append(ifaces, flannelBridgeName)
+	}
+	return ifaces
+}
+
+// backendInterfaces returns the names of the interfaces that the flannel backend creates on Linux.
+// The Windows backends do not create interfaces that can be found by name.
+func backendInterfaces(nodeConfig *config.Node, netMode int) []string {
+	if goruntime.GOOS == "windows" {
+		return nil
+	}
+	var ifaces []string
+	switch nodeConfig.FlannelBackend {
+	case config.FlannelBackendVXLAN, config.FlannelBackendHostGWVXLAN:
+		vni := nodeConfig.FlannelVNI
+		if vni == 0 {
+			vni = 1
+		}
+		if netMode == ipv4 || netMode == (ipv4+ipv6) {
+			ifaces = append(ifaces, fmt.Sprintf("flannel.%d", vni))
+		}
+		if netMode == ipv6 || netMode == (ipv4+ipv6) {
+			ifaces = append(ifaces, fmt.Sprintf("flannel-v6.%d", vni))
+		}
+	case config.FlannelBackendIPIP:
+		ifaces = append(ifaces, "flannel.ipip")
+	case config.FlannelBackendWireguardNative:
+		if netMode == ipv4 || netMode == (ipv4+ipv6) {
+			ifaces = append(ifaces, "flannel-wg")
+		}
+		if netMode == ipv6 || netMode == (ipv4+ipv6) {
+			ifaces = append(ifaces, "flannel-wg-v6")
+		}
+	}
+	return ifaces
+}
+
+// superviseFlannel calls run until it returns without error or the context is cancelled. Failed
+// runs are retried with jittered exponential backoff; an error is only returned once flannel has failed
+// flannelRestartLimit times within flannelRestartWindow.
+func superviseFlannel(ctx context.Context, lf logrus.Fields, run func(ctx context.Context) error) error {
+	var failures []time.Time
+	for {
+		// Cancel each run's context once it returns, so that anything a failed run left behind is stopped
+		runCtx, cancel := context.WithCancel(ctx)
+		err := run(runCtx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		now := time.Now()
+		failures = append(failures, now)
+		for len(failures) > 0 && now.Sub(failures[0]) > flannelRestartWindow {
+			failures = failures[1:]
+		}
+		if len(failures) >= flannelRestartLimit {
+			return errors.Wrapf(err, "flannel failed %d times within %v", len(failures), flannelRestartWindow)
+		}
+
+		delay := flannelRestartDelay(len(failures))
+		logrus.WithFields(lf).Errorf("flannel exited: %v; restarting in %v", err, delay)
+		flannelRestartsTotal.Inc()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// flannelRestartDelay returns how long to wait before restarting flannel after the given number of
+// recent failures: flannelRestartBackoff doubled for each failure after the first, capped at
+// flannelRestartMaxBackoff, then jittered by up to flannelRestartJitter of the delay.
+func flannelRestartDelay(failures int) time.Duration {
+	delay := flannelRestartBackoff << (failures - 1)
+	if delay > flannelRestartMaxBackoff || delay <= 0 {
+		delay = flannelRestartMaxBackoff
+	}
+	if flannelRestartJitter > 0 {
+		delay += time.Duration(flannelRestartRand() * flannelRestartJitter * float64(delay))
+	}
+	return delay
+}
+
+// waitForPodCIDR watches nodes with this node's name, and returns the node's PodCIDRs once a PodCIDR
+// has been set for each address family enabled by the netMode. If timeout is non-zero, an error is
+// returned if the PodCIDRs have not been assigned within that time.
+func waitForPodCIDR(ctx context.Context, nodeName string, nodes typedcorev1.NodeInterface, netMode int, timeout time.Duration) ([]string, error) {
+	start := time.Now()
+	parentCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// Skip the watch if the PodCIDRs have already been assigned, as happens when the agent restarts.
+	// UntilWithSync lists the node again, so there is no window in which an update can be missed.
+	if node, err := nodes.Get(ctx, nodeName, metav1.GetOptions{}); err == nil && podCIDRsAssigned(node, netMode) {
+		podCIDRs := nodePodCIDRs(node)
+		if err := checkPodCIDRFamilies(nodeName, podCIDRs, netMode); err != nil {
+			return nil, err
+		}
+		logrus.WithFields(logrus.Fields{"node": nodeName, "podCIDR": strings.Join(podCIDRs, ",")}).Info("Flannel found PodCIDR assigned for node " + nodeName)
+		flannelPodCIDRWaitSeconds.Observe(time.Since(start).Seconds())
+		return podCIDRs, nil
+	}
+
+	fieldSelector := fields.Set{metav1.ObjectNameField: nodeName}.String()
+	lw := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (object runtime.Object, e error) {
+			options.FieldSelector = fieldSelector
+			return nodes.List(ctx, options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (i watch.Interface, e error) {
+			options.FieldSelector = fieldSelector
+			return nodes.Watch(ctx, options)
+		},
+	}
+	// A PodCIDR of a family that is not enabled will not be replaced, so waiting for another would not end
+	var familyErr error
+	condition := func(ev watch.Event) (bool, error) {
+		if n, ok := ev.Object.(*v1.Node); ok {
+			if familyErr = checkPodCIDRFamilies(nodeName, nodePodCIDRs(n), netMode); familyErr != nil {
+				return false, familyErr
+			}
+			return podCIDRsAssigned(n, netMode), nil
+		}
+		return false, errors.New("event object not of type v1.Node")
+	}
+
+	ev, err := toolswatch.UntilWithSync(ctx, lw, &v1.Node{}, nil, condition)
+	if familyErr != nil {
+		return nil, familyErr
+	}
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			// The caller's deadline may be shorter than the timeout
+			if parentCtx.Err() != nil {
+				timeout = time.Since(start).Round(time.Millisecond)
+			}
+			return nil, &podCIDRTimeoutError{nodeName: nodeName, timeout: timeout}
+		}
+		return nil, errors.Wrap(err, "failed to wait for PodCIDR assignment")
+	}
+
+	podCIDRs := nodePodCIDRs(ev.Object.(*v1.Node))
+	logrus.WithFields(logrus.Fields{"node": nodeName, "podCIDR": strings.Join(podCIDRs, ",")}).Info("Flannel found PodCIDR assigned for node " + nodeName)
+	flannelPodCIDRWaitSeconds.Observe(time.Since(start).Seconds())
+	return podCIDRs, nil
+}
+
+// labelBackends are the backends that can be selected with the flannel backend label. The none and
+// tailscale backends need setup by the agent before flannel is run, so they can only be configured.
+var labelBackends = []string{
+	config.FlannelBackendVXLAN,
+	config.FlannelBackendHostGW,
+	config.FlannelBackendHostGWVXLAN,
+	config.FlannelBackendIPIP,
+	config.FlannelBackendWireguardNative,
+}
+
+// nodeBackend returns the backend selected by the node's flannel backend label, or the configured
+// backend if the node is not labelled.
+func nodeBackend(node *v1.Node, backend string) (string, error) {
+	label, ok := node.Labels[FlannelBackendLabel]
+	if !ok || label == backend {
+		return backend, nil
+	}
+	if !slices.Contains(labelBackends, label) {
+		return "", fmt.Errorf("invalid %s label %q: must be one of %s", FlannelBackendLabel, label, strings.Join(labelBackends, ", "))
+	}
+	return label, nil
+}
+
+// applyBackendLabel switches the node to the backend selected by its flannel backend label, if it
+// differs from the configured backend, and rewrites the flannel config for it. The backend is set in
+// the node config, so that the rest of the flannel setup and teardown uses it.
+func applyBackendLabel(ctx context.Context, lf logrus.Fields, nodeConfig *config.Node, nodes typedcorev1.NodeInterface) error {
+	node, err := nodes.Get(ctx, nodeConfig.AgentConfig.NodeName, metav1.GetOptions{})
+	if err != nil {
+		logrus.WithFields(lf).Warnf("Failed to get node for the %s label; using the configured backend: %v", FlannelBackendLabel, err)
+		return nil
+	}
+	backend, err := nodeBackend(node, nodeConfig.FlannelBackend)
+	if err != nil || backend == nodeConfig.FlannelBackend {
+		return err
+	}
+	if nodeConfig.FlannelConfOverride {
+		logrus.WithFields(lf).Warnf("Ignoring %s label: a custom flannel conf is in use", FlannelBackendLabel)
+		return nil
+	}
+
+	labelled := *nodeConfig
+	labelled.FlannelBackend = backend
+	if err := validateBackend(&labelled); err != nil {
+		return err
+	}
+	if err := createFlannelConf(&labelled); err != nil {
+		return err
+	}
+	if backend == config.FlannelBackendWireguardNative {
+		if err := setupWireguardKey(&labelled); err != nil {
+			return err
+		}
+	}
+	logrus.WithFields(lf).Infof("Using flannel backend %s from the %s label instead of %s", backend, FlannelBackendLabel, nodeConfig.FlannelBackend)
+	nodeConfig.FlannelBackend = backend
+	lf["backend"] = backend
+	return nil
+}
+
+// podCIDRTimeoutError is returned by waitForPodCIDR if the PodCIDR is not assigned before the timeout
+// or the caller's deadline.
+type podCIDRTimeoutError struct {
+	nodeName string
+	timeout  time.Duration
+}
+
+func (e *podCIDRTimeoutError) Error() string {
+	return fmt.Sprintf("timed out after %v waiting for PodCIDR on node %s; is the controller-manager allocating CIDRs?", e.timeout, e.nodeName)
+}
+
+func (e *podCIDRTimeoutError) Is(target error) bool {
+	return target == ErrPodCIDRTimeout
+}
+
+// annotateBackend sets the flannel backend annotation on the node.
+func annotateBackend(ctx context.Context, nodes typedcorev1.NodeInterface, nodeName, backend string) error {
+	return annotateNode(ctx, nodes, nodeName, FlannelBackendAnnotation, backend)
+}
+
+// annotateWireguardKey sets the wireguard public key annotation on the node, if the backend is
+// wireguard-native. The public key is derived from the private key that was set up by Prepare.
+func annotateWireguardKey(ctx context.Context, nodes typedcorev1.NodeInterface, nodeConfig *config.Node) error {
+	if nodeConfig.FlannelBackend != config.FlannelBackendWireguardNative {
+		return nil
+	}
+	keyFile := wireguardKeyFile(nodeConfig)
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to read wireguard private key")
+	}
+	key, err := wgtypes.ParseKey(string(data))
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse wireguard private key %s", keyFile)
+	}
+	return annotateNode(ctx, nodes, nodeConfig.AgentConfig.NodeName, FlannelWireguardKeyAnnotation, key.PublicKey().String())
+}
+
+// annotateNode sets an annotation on the node, retrying if the node is updated concurrently. The node
+// is not updated if the annotation already has the value.
+func annotateNode(ctx context.Context, nodes typedcorev1.NodeInterface, nodeName, key, value string) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		node, err := nodes.Get(ctx, nodeName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if v, ok := node.Annotations[key]; ok && v == value {
+			return nil
+		}
+		node = node.DeepCopy()
+		if node.Annotations == nil {
+			node.Annotations = map[string]string{}
+		}
+		node.Annotations[key] = value
+		_, err = nodes.Update(ctx, node, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// validatePodCIDRs checks that each PodCIDR is a subnet of the cluster CIDR of the same address family.
+func validatePodCIDRs(podCIDRs []string, clusterCIDRs []*net.IPNet) error {
+	for _, podCIDR := range podCIDRs {
+		_, podNet, err := net.ParseCIDR(podCIDR)
+		if err != nil {
+			return errors.Wrapf(err, "invalid PodCIDR %s", podCIDR)
+		}
+		family := "IPv4"
+		if utilsnet.IsIPv6CIDR(podNet) {
+			family = "IPv6"
+		}
+
+		var clusterNet *net.IPNet
+		for _, cidr := range clusterCIDRs {
+			if utilsnet.IsIPv6CIDR(cidr) == utilsnet.IsIPv6CIDR(podNet) {
+				clusterNet = cidr
+				break
+			}
+		}
+		if clusterNet == nil {
+			return fmt.Errorf("PodCIDR %s is %s, but no %s cluster CIDR is configured", podCIDR, family, family)
+		}
+		if !cidrContains(clusterNet, podNet) {
+			return fmt.Errorf("PodCIDR %s is not within the %s cluster CIDR %s; check the controller-manager cluster-cidr", podCIDR, family, clusterNet)
+		}
+	}
+	return nil
+}
+
+// flannelNetworks returns the networks that flannel is configured with: the networks derived from
+// node PodCIDRs if these have been set, or the cluster CIDRs otherwise.
+func flannelNetworks(nodeConfig *config.Node) []*net.IPNet {
+	if len(nodeConfig.FlannelNetworks) > 0 {
+		return nodeConfig.FlannelNetworks
+	}
+	return nodeConfig.AgentConfig.ClusterCIDRs
+}
+
+// reconcileNetworks derives the flannel networks from the PodCIDRs allocated to all nodes, and rewrites
+// the flannel config if they do not match the cluster CIDRs. The derived networks are kept in the node
+// config, so that the flannel config is rendered with them if it is rewritten later.
+func reconcileNetworks(ctx context.Context, lf logrus.Fields, nodeConfig *config.Node, nodes typedcorev1.NodeInterface) error {
+	nodeList, err := nodes.List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return errors.Wrap(err, "failed to list nodes")
+	}
+	var podCIDRs []string
+	for i := range nodeList.Items {
+		podCIDRs = append(podCIDRs, nodePodCIDRs(&nodeList.Items[i])...)
+	}
+	networks, err := nodeNetworks(podCIDRs, nodeConfig.AgentConfig.ClusterCIDRs)
+	if err != nil {
+		return err
+	}
+	if slices.Equal(networks, nodeConfig.AgentConfig.ClusterCIDRs) {
+		return nil
+	}
+	logrus.WithFields(lf).Warnf("Node PodCIDRs are not within the cluster CIDRs %v; using %v as the flannel network", nodeConfig.AgentConfig.ClusterCIDRs, networks)
+	nodeConfig.FlannelNetworks = networks
+	return createFlannelConf(nodeConfig)
+}
+
+// nodeNetworks returns a network for each of the cluster CIDRs: the cluster CIDR itself if it contains
+// all the PodCIDRs of its address family, or else the smallest network that contains them.
+func nodeNetworks(podCIDRs []string, clusterCIDRs []*net.IPNet) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(clusterCIDRs))
+	for _, clusterCIDR := range clusterCIDRs {
+		var network *net.IPNet
+		contained := true
+		for _, podCIDR := range podCIDRs {
+			_, podNet, err := net.ParseCIDR(podCIDR)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid PodCIDR %s", podCIDR)
+			}
+			if utilsnet.IsIPv6CIDR(podNet) != utilsnet.IsIPv6CIDR(clusterCIDR) {
+				continue
+			}
+			if !cidrContains(clusterCIDR, podNet) {
+				contained = false
+			}
+			if network == nil {
+				network = podNet
+			} else {
+				network = commonCIDR(network, podNet)
+			}
+		}
+		if contained || network == nil {
+			network = clusterCIDR
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// cidrContains returns true if the inner network is within the outer network.
+func cidrContains(outer, inner *net.IPNet) bool {
+	outerOnes, _ := outer.Mask.Size()
+	innerOnes, _ := inner.Mask.Size()
+	return outer.Contains(inner.IP) && innerOnes >= outerOnes
+}
+
+// commonCIDR returns the smallest network that contains both networks, which must be of the same
+// address family.
+func commonCIDR(a, b *net.IPNet) *net.IPNet {
+	ones, bits := a.Mask.Size()
+	if bOnes, _ := b.Mask.Size(); bOnes < ones {
+		ones = bOnes
+	}
+	for ones > 0 && !a.IP.Mask(net.CIDRMask(ones, bits)).Equal(b.IP.Mask(net.CIDRMask(ones, bits))) {
+		ones--
+	}
+	mask := net.CIDRMask(ones, bits)
+	return &net.IPNet{IP: a.IP.Mask(mask), Mask: mask}
+}
+
+// parsePublicIP parses the flannel public IP override, returning nil if none is set.
+func parsePublicIP(publicIP string) (net.IP, error) {
+	if publicIP == "" {
+		return nil, nil
+	}
+	ip := net.ParseIP(publicIP)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid flannel public IP %q", publicIP)
+	}
+	return ip, nil
+}
+
+// nodePodCIDRs returns the PodCIDRs assigned to the node, falling back to the single PodCIDR
+// field if the list is not set.
+func nodePodCIDRs(node *v1.Node) []string {
+	if node.Spec.PodCIDR == "" {
+		return nil
+	}
+	if len(node.Spec.PodCIDRs) == 0 {
+		return []string{node.Spec.PodCIDR}
+	}
+	return node.Spec.PodCIDRs
+}
+
+// logFields returns the node and backend context that is added to flannel log messages.
+func logFields(nodeConfig *config.Node) logrus.Fields {
+	iface := "auto"
+	if nodeConfig.FlannelIface != nil {
+		iface = nodeConfig.FlannelIface.Name
+	} else if len(nodeConfig.FlannelIfaces) > 0 {
+		iface = strings.Join(nodeConfig.FlannelIfaces, ",")
+	}
+	return logrus.Fields{
+		"node":    nodeConfig.AgentConfig.NodeName,
+		"backend": nodeConfig.FlannelBackend,
+		"iface":   iface,
+	}
+}
+
+// podCIDRsAssigned returns true if the node has a PodCIDR for each address family enabled by the netMode.
+func podCIDRsAssigned(node *v1.Node, netMode int) bool {
+	var hasIPv4, hasIPv6 bool
+	for _, podCIDR := range nodePodCIDRs(node) {
+		if utilsnet.IsIPv6CIDRString(podCIDR) {
+			hasIPv6 = true
+		} else {
+			hasIPv4 = true
+		}
+	}
+
+	switch netMode {
+	case ipv4:
+		return hasIPv4
+	case ipv6:
+		return hasIPv6
+	case (ipv4 + ipv6):
+		return hasIPv4 && hasIPv6
+	}
+	return false
+}
+
+// checkPodCIDRFamilies returns an error if a PodCIDR assigned to the node is of an address family that is
+// not enabled by the netMode, which is derived from the cluster CIDRs. A missing family is not an error,
+// as its PodCIDR may still be assigned.
+func checkPodCIDRFamilies(nodeName string, podCIDRs []string, netMode int) error {
+	for _, podCIDR := range podCIDRs {
+		isIPv6 := utilsnet.IsIPv6CIDRString(podCIDR)
+		if isIPv6 && netMode == ipv4 {
+			return fmt.Errorf("PodCIDR %s assigned to node %s is IPv6, but the cluster CIDRs are IPv4-only; check that the cluster CIDRs match the controller-manager cluster-cidr", podCIDR, nodeName)
+		}
+		if !isIPv6 && netMode == ipv6 {
+			return fmt.Errorf("PodCIDR %s assigned to node %s is IPv4, but the cluster CIDRs are IPv6-only; check that the cluster CIDRs match the controller-manager cluster-cidr", podCIDR, nodeName)
+		}
+	}
+	return nil
+}
+
+// checkCNIConfDirWritable creates the CNI conf dir if it is missing, and writes and removes a temp file
+// in it, so that a read-only mount or missing permissions are reported clearly before anything is written.
+func checkCNIConfDirWritable(nodeConfig *config.Node) error {
+	dir := nodeConfig.AgentConfig.CNIConfDir
+	if dir == "" || nodeConfig.AgentConfig.DisableCNIConf || nodeConfig.FlannelDryRun {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrapf(err, "CNI conf dir %q is not writable", dir)
+	}
+	f, err := os.CreateTemp(dir, ".flannel-write-check")
+	if err != nil {
+		return errors.Wrapf(err, "CNI conf dir %q is not writable", dir)
+	}
+	f.Close()
+	if err := os.Remove(f.Name()); err != nil {
+		return errors.Wrapf(err, "CNI conf dir %q is not writable", dir)
+	}
+	return nil
+}
+
+func createCNIConf(dir string, nodeConfig *config.Node) error {
+	// Another CNI manager may own the conf directory; any flannel conf already in it is left alone
+	if nodeConfig.AgentConfig.DisableCNIConf {
+		logrus.Infof("Flannel CNI conf is disabled; not creating it in %s", dir)
+		return nil
+	}
+	// Without a conf the kubelet only reports that no network plugin is configured, so say why here
+	if dir == "" {
+		if nodeConfig.AgentConfig.CNIConfDirRequired {
+			return errors.New("cannot create the flannel CNI conf: CNIConfDir is empty")
+		}
+		// With the none backend, no CNI conf dir means that another CNI is deliberately left to provide one
+		if nodeConfig.NoFlannel || nodeConfig.FlannelBackend == config.FlannelBackendNone {
+			logrus.Debug("Not creating a flannel CNI conf: CNIConfDir is empty and the flannel backend is none")
+			return nil
+		}
+		logrus.Warn("Flannel CNI conf generation is disabled because CNIConfDir is empty; pods will not have networking until a CNI conf is provided")
+		return nil
+	}
+	logrus.Debugf("Creating the CNI conf in directory %s", dir)
+	prefix := nodeConfig.AgentConfig.CNIConfPrefix
+	if prefix == "" {
+		prefix = defaultCNIConfPrefix
+	}
+	if !cniConfPrefixRegexp.MatchString(prefix) {
+		return fmt.Errorf("invalid CNI conf prefix %q: must be numeric", prefix)
+	}
+	if err := validateCNIConfSinglePlugin(nodeConfig); err != nil {
+		return err
+	}
+	suffix := cniConfSuffix
+	if nodeConfig.AgentConfig.CNIConfSinglePlugin {
+		suffix = cniSingleConfSuffix
+	}
+	p := filepath.Join(dir, prefix+suffix)
+
+	stale, err := staleCNIConfs(dir, filepath.Base(p))
+	if err != nil {
+		return errors.Wrap(err, "failed to check for stale flannel CNI confs")
+	}
+	for _, name := range stale {
+		if nodeConfig.FlannelDryRun {
+			logrus.Infof("Dry run: not removing stale flannel CNI conf %s", filepath.Join(dir, name))
+			continue
+		}
+		logrus.Infof("Removing stale flannel CNI conf %s", filepath.Join(dir, name))
+		if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "failed to remove stale flannel CNI conf")
+		}
+	}
+
+	shadowing, err := shadowingCNIConfs(dir, filepath.Base(p))
+	if err != nil {
+		return errors.Wrap(err, "failed to check for other CNI confs")
+	}
+	if len(shadowing) > 0 {
+		msg := fmt.Sprintf("flannel CNI conf %s will not be used, as the container runtime uses the first CNI conf in %s: found [%s]", p, dir, strings.Join(shadowing, ", "))
+		if nodeConfig.AgentConfig.CNIConfShadowFatal {
+			return errors.New(msg)
+		}
+		logrus.Warnf("*** %s ***", msg)
+	}
+
+	if nodeConfig.AgentConfig.FlannelCniConfFile != "" {
+		logrus.Debugf("Using %s as the flannel CNI conf", nodeConfig.AgentConfig.FlannelCniConfFile)
+		if !nodeConfig.FlannelDryRun {
+			return util.CopyFile(nodeConfig.AgentConfig.FlannelCniConfFile, p, false)
+		}
+	}
+
+	cniConfJSON, err := cniConfGenerator.Generate(nodeConfig)
+	if err != nil {
+		return err
+	}
+
+	if nodeConfig.FlannelDryRun {
+		logrus.Infof("Dry run: not writing flannel CNI conf %s:\n%s", p, cniConfJSON)
+		return nil
+	}
+
+	// Preserve an existing conf that was edited by hand since it was last written. A conf that still
+	// matches what was last written is replaced, so that a new version or changed CNI options take effect.
+	if existing, err := os.ReadFile(p); err == nil && string(existing) != cniConfJSON && !nodeConfig.AgentConfig.CNIConfForce && cniConfEdited(nodeConfig, p, existing) {
+		logrus.Warnf("Not overwriting flannel CNI conf %s as it was edited since it was generated; use --flannel-cni-conf-force to replace it", p)
+		return nil
+	}
+
+	if err := writeConf(p, cniConfJSON); err != nil {
+		return err
+	}
+	if record := cniConfRecord(nodeConfig); record != "" {
+		return writeConf(record, cniConfRecordLine(p, []byte(cniConfJSON)))
+	}
+	return nil
+}
+
+// cniConfRecord returns the file that records the hash of the CNI conf as it was last written, in the
+// sha256sum format. It is kept next to the flannel net-conf rather than in the CNI conf directory, which
+// other CNI managers and tools may read. Nothing is recorded if there is no flannel net-conf.
+func cniConfRecord(nodeConfig *config.Node) string {
+	if nodeConfig.FlannelConfFile == "" {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(nodeConfig.FlannelConfFile), "cni-conf.sha256")
+}
+
+func cniConfRecordLine(p string, content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:]) + "  " + p + "\n"
 }
 
-func Run(ctx context.Context, nodeConfig *config.Node, nodes typedcorev1.NodeInterface) error {
-	logrus.Infof("Starting flannel with backend %s", nodeConfig.FlannelBackend)
-	if err := waitForPodCIDR(ctx, nodeConfig.AgentConfig.NodeName, nodes); err != nil {
-		return errors.Wrap(err, "flannel failed to wait for PodCIDR assignment")
+// cniConfEdited reports whether the existing CNI conf at p differs from the conf that was last written
+// there. A conf without a record was written before confs were recorded, when the conf was always
+// replaced, so it is not treated as edited.
+func cniConfEdited(nodeConfig *config.Node, p string, existing []byte) bool {
+	record := cniConfRecord(nodeConfig)
+	if record == "" {
+		return false
 	}
-
-	netMode, err := findNetMode(nodeConfig.AgentConfig.ClusterCIDRs)
+	data, err := os.ReadFile(record)
 	if err != nil {
-		return errors.Wrap(err, "failed to check netMode for flannel")
+		return false
 	}
-	go func() {
-		err := flannel(ctx, nodeConfig.FlannelIface, nodeConfig.FlannelConfFile, nodeConfig.AgentConfig.KubeConfigKubelet, nodeConfig.FlannelIPv6Masq, netMode)
-		if err != nil && !errors.Is(err, context.Canceled) {
-			logrus.Errorf("flannel exited: %v", err)
-			os.Exit(1)
-		}
-		os.Exit(0)
-	}()
-
-	return nil
+	_, recordedPath, _ := strings.Cut(strings.TrimSpace(string(data)), "  ")
+	if recordedPath != p {
+		return false
+	}
+	return string(data) != cniConfRecordLine(p, existing)
 }
 
-// waitForPodCIDR watches nodes with this node's name, and returns when the PodCIDR has been set.
-func waitForPodCIDR(ctx context.Context, nodeName string, nodes typedcorev1.NodeInterface) error {
-	fieldSelector := fields.Set{metav1.ObjectNameField: nodeName}.String()
-	lw := &cache.ListWatch{
-		ListFunc: func(options metav1.ListOptions) (object runtime.Object, e error) {
-			options.FieldSelector = fieldSelector
-			return nodes.List(ctx, options)
-		},
-		WatchFunc: func(options metav1.ListOptions) (i watch.Interface, e error) {
-			options.FieldSelector = fieldSelector
-			return nodes.Watch(ctx, options)
-		},
-	}
-	condition := func(ev watch.Event) (bool, error) {
-		if n, ok := ev.Object.(*v1.Node); ok {
-			return n.Spec.PodCIDR != "", nil
-		}
-		return false, errors.New("event object not of type v1.Node")
-	}
+// CNIConfGenerator generates the CNI conf that Prepare writes for the node.
+type CNIConfGenerator interface {
+	Generate(nodeConfig *config.Node) (string, error)
+}
 
-	if _, err := toolswatch.UntilWithSync(ctx, lw, &v1.Node{}, nil, condition); err != nil {
-		return errors.Wrap(err, "failed to wait for PodCIDR assignment")
-	}
+// flannelCNIConfGenerator is the default CNIConfGenerator, which renders the flannel CNI conf.
+type flannelCNIConfGenerator struct{}
 
-	logrus.Info("Flannel found PodCIDR assigned for node " + nodeName)
-	return nil
+func (flannelCNIConfGenerator) Generate(nodeConfig *config.Node) (string, error) {
+	return RenderCNIConf(nodeConfig)
 }
 
-func createCNIConf(dir string, nodeConfig *config.Node) error {
-	logrus.Debugf("Creating the CNI conf in directory %s", dir)
-	if dir == "" {
-		return nil
+var cniConfGenerator CNIConfGenerator = flannelCNIConfGenerator{}
+
+// RegisterCNIConfGenerator replaces the generator of the CNI conf that Prepare writes, or restores the
+// default flannel generator if the generator is nil. It must be called before Prepare. A flannel CNI conf
+// file configured for the node is still copied as is, and the conf is written to the same path and with
+// the same checks as the default conf.
+func RegisterCNIConfGenerator(generator CNIConfGenerator) {
+	if generator == nil {
+		generator = flannelCNIConfGenerator{}
 	}
-	p := filepath.Join(dir, "10-flannel.conflist")
+	cniConfGenerator = generator
+}
 
+// RenderCNIConf returns the flannel CNI conf for the node, as it would be written by Prepare. The conf
+// file or template and plugins configured for the node are read, but nothing is written.
+func RenderCNIConf(nodeConfig *config.Node) (string, error) {
 	if nodeConfig.AgentConfig.FlannelCniConfFile != "" {
-		logrus.Debugf("Using %s as the flannel CNI conf", nodeConfig.AgentConfig.FlannelCniConfFile)
-		return util.CopyFile(nodeConfig.AgentConfig.FlannelCniConfFile, p, false)
+		b, err := os.ReadFile(nodeConfig.AgentConfig.FlannelCniConfFile)
+		if err != nil {
+			return "", errors.Wrap(err, "failed to read flannel CNI conf")
+		}
+		return string(b), nil
 	}
 
 	cniConfJSON := cniConf
+	if nodeConfig.AgentConfig.FlannelCniConfTemplate != "" {
+		logrus.Debugf("Using %s as the flannel CNI conf template", nodeConfig.AgentConfig.FlannelCniConfTemplate)
+		b, err := os.ReadFile(nodeConfig.AgentConfig.FlannelCniConfTemplate)
+		if err != nil {
+			return "", errors.Wrap(err, "failed to read flannel CNI conf template")
+		}
+		cniConfJSON = string(b)
+	}
+	cniVersion := nodeConfig.AgentConfig.CNIVersion
+	if cniVersion == "" {
+		cniVersion = defaultCNIVersion
+	}
+	if !slices.Contains(supportedCNIVersions, cniVersion) {
+		return "", fmt.Errorf("unsupported CNI version %q: must be one of %s", cniVersion, strings.Join(supportedCNIVersions, ", "))
+	}
+	cniConfJSON = strings.ReplaceAll(cniConfJSON, "%CNI_VERSION%", cniVersion)
+	cniName := nodeConfig.AgentConfig.CNINetworkName
+	if cniName == "" {
+		cniName = defaultCNINetworkName
+	}
+	if !cniNameRegexp.MatchString(cniName) {
+		return "", fmt.Errorf("invalid CNI network name %q", cniName)
+	}
+	cniConfJSON = strings.ReplaceAll(cniConfJSON, "%CNI_NAME%", cniName)
+	if ipv4Masq, _ := ipMasq(nodeConfig); nodeConfig.AgentConfig.CNINoIPMasq || !ipv4Masq {
+		// Without an explicit value, the flannel CNI plugin only masquerades if flannel itself does not
+		cniConfJSON = strings.ReplaceAll(cniConfJSON, "%IP_MASQ%", ",\n        \"ipMasq\":false")
+	} else {
+		cniConfJSON = strings.ReplaceAll(cniConfJSON, "%IP_MASQ%", "")
+	}
+	cniConfJSON = strings.ReplaceAll(cniConfJSON, "%CIDR%", nodeConfig.AgentConfig.ClusterCIDR.String())
+	if strings.Contains(cniConfJSON, "%MTU%") {
+		if nodeConfig.FlannelMTU == 0 {
+			return "", errors.New("flannel CNI conf template uses %MTU% but no flannel MTU is configured")
+		}
+		cniConfJSON = strings.ReplaceAll(cniConfJSON, "%MTU%", strconv.Itoa(nodeConfig.FlannelMTU))
+	}
+	cniConfJSON = strings.ReplaceAll(cniConfJSON, "%HAIRPIN_MODE%", strconv.FormatBool(!nodeConfig.AgentConfig.CNINoHairpinMode))
+	cniConfJSON = strings.ReplaceAll(cniConfJSON, "%FORCE_ADDRESS%", strconv.FormatBool(!nodeConfig.AgentConfig.CNINoForceAddress))
+	cniConfJSON = strings.ReplaceAll(cniConfJSON, "%IS_DEFAULT_GATEWAY%", strconv.FormatBool(!nodeConfig.AgentConfig.CNINoDefaultGateway))
+	if nodeConfig.AgentConfig.CNINoPortmap {
+		cniConfJSON = strings.ReplaceAll(cniConfJSON, "%PORTMAP%", "")
+	} else {
+		portmap, err := portmapPlugin(nodeConfig)
+		if err != nil {
+			return "", err
+		}
+		cniConfJSON = strings.ReplaceAll(cniConfJSON, "%PORTMAP%", portmap)
+	}
 	if goruntime.GOOS == "windows" {
 		extIface, err := LookupExtInterface(nodeConfig.FlannelIface, ipv4)
 		if err != nil {
-			return err
+			return "", err
 		}
 
 		cniConfJSON = strings.ReplaceAll(cniConfJSON, "%IPV4_ADDRESS%", extIface.IfaceAddr.String())
@@ -138,73 +1535,383 @@ func createCNIConf(dir string, nodeConfig *config.Node) error {
 		cniConfJSON = strings.ReplaceAll(cniConfJSON, "%SERVICE_CIDR%", nodeConfig.AgentConfig.ServiceCIDR.String())
 	}
 
-	return util.WriteFile(p, cniConfJSON)
+	if nodeConfig.AgentConfig.FlannelCniConfPlugins != "" {
+		logrus.Debugf("Appending plugins from %s to the flannel CNI conf", nodeConfig.AgentConfig.FlannelCniConfPlugins)
+		b, err := os.ReadFile(nodeConfig.AgentConfig.FlannelCniConfPlugins)
+		if err != nil {
+			return "", errors.Wrap(err, "failed to read flannel CNI conf plugins")
+		}
+		if cniConfJSON, err = appendCNIPlugins(cniConfJSON, b); err != nil {
+			return "", errors.Wrapf(err, "failed to append plugins from %s to the flannel CNI conf", nodeConfig.AgentConfig.FlannelCniConfPlugins)
+		}
+	}
+	if nodeConfig.AgentConfig.CNIConfSinglePlugin {
+		return singlePluginCNIConf(cniConfJSON)
+	}
+	return cniConfJSON, nil
+}
+
+// validateCNIConfSinglePlugin checks that no conflist options are set with a single plugin CNI conf, as
+// these would be silently lost.
+func validateCNIConfSinglePlugin(nodeConfig *config.Node) error {
+	if !nodeConfig.AgentConfig.CNIConfSinglePlugin {
+		return nil
+	}
+	for _, option := range []struct {
+		name string
+		set  bool
+	}{
+		{"a flannel CNI conf file", nodeConfig.AgentConfig.FlannelCniConfFile != ""},
+		{"a flannel CNI conf template", nodeConfig.AgentConfig.FlannelCniConfTemplate != ""},
+		{"flannel CNI conf plugins", nodeConfig.AgentConfig.FlannelCniConfPlugins != ""},
+		{"a CNI host port range", nodeConfig.AgentConfig.CNIHostPortRange != ""},
+	} {
+		if option.set {
+			return fmt.Errorf("a single plugin CNI conf cannot be used with %s, which requires a CNI conflist", option.name)
+		}
+	}
+	return nil
+}
+
+// singlePluginCNIConf converts the flannel CNI conflist into a single plugin CNI conf with only the
+// flannel plugin, which takes the name and version of the conflist. The portmap and bandwidth plugins
+// are dropped, so host ports and traffic shaping are not available to pods.
+func singlePluginCNIConf(cniConfJSON string) (string, error) {
+	var conflist struct {
+		Name       json.RawMessage              `json:"name"`
+		CNIVersion json.RawMessage              `json:"cniVersion"`
+		Plugins    []map[string]json.RawMessage `json:"plugins"`
+	}
+	if err := json.Unmarshal([]byte(cniConfJSON), &conflist); err != nil {
+		return "", errors.Wrap(err, "failed to parse flannel CNI conflist")
+	}
+	if len(conflist.Plugins) == 0 {
+		return "", errors.New("flannel CNI conflist has no plugins")
+	}
+	plugin := conflist.Plugins[0]
+	plugin["name"] = conflist.Name
+	plugin["cniVersion"] = conflist.CNIVersion
+	b, err := json.MarshalIndent(plugin, "", "  ")
+	if err != nil {
+		return "", errors.Wrap(err, "failed to marshal single plugin CNI conf")
+	}
+	return string(b) + "\n", nil
+}
+
+// portmapPlugin returns the portmap plugin conf for the CNI conf. With a host port range, the portmap
+// rules only match host ports in the range, so that pods cannot be reached on host ports outside it.
+func portmapPlugin(nodeConfig *config.Node) (string, error) {
+	hostPortRange := nodeConfig.AgentConfig.CNIHostPortRange
+	if hostPortRange == "" {
+		if nodeConfig.FlannelNFTables {
+			return cniPortmapNFTablesPlugin, nil
+		}
+		return cniPortmapPlugin, nil
+	}
+	if nodeConfig.FlannelNFTables {
+		return "", errors.New("a CNI host port range cannot be used with flannel nftables mode, as the portmap nftables backend does not support conditions")
+	}
+	pr, err := utilnet.ParsePortRange(hostPortRange)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid CNI host port range %q", hostPortRange)
+	}
+	if pr.Base < 1 {
+		return "", fmt.Errorf("invalid CNI host port range %q: ports must be between 1 and 65535", hostPortRange)
+	}
+	return fmt.Sprintf(cniPortmapRangePlugin, fmt.Sprintf("%d:%d", pr.Base, pr.Base+pr.Size-1)), nil
+}
+
+// shadowingCNIConfs returns the names of the CNI confs in dir that sort before the named conf, and
+// would therefore be loaded by the container runtime instead of it. The extensions are those that
+// libcni loads.
+func shadowingCNIConfs(dir, name string) ([]string, error) {
+	// A missing directory is created when the conf is written, and anything else in the way is reported then
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() || entry.Name() >= name {
+			continue
+		}
+		switch filepath.Ext(entry.Name()) {
+		case ".conf", ".conflist", ".json":
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// staleCNIConfs returns the flannel CNI confs in dir, other than name, that were written with a different
+// ordering prefix or in the other format. Leaving them in place would have the container runtime pick up
+// whichever sorts first.
+func staleCNIConfs(dir, name string) ([]string, error) {
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() || entry.Name() == name {
+			continue
+		}
+		for _, suffix := range []string{cniConfSuffix, cniSingleConfSuffix} {
+			if strings.HasSuffix(entry.Name(), suffix) && cniConfPrefixRegexp.MatchString(strings.TrimSuffix(entry.Name(), suffix)) {
+				names = append(names, entry.Name())
+			}
+		}
+	}
+	return names, nil
+}
+
+// appendCNIPlugins appends a JSON array of plugin objects to the plugins list of a CNI conflist.
+// Each plugin must be an object with a type.
+func appendCNIPlugins(cniConfJSON string, pluginsJSON []byte) (string, error) {
+	var extra []map[string]json.RawMessage
+	if err := json.Unmarshal(pluginsJSON, &extra); err != nil {
+		return "", errors.Wrap(err, "plugins must be a JSON array of objects")
+	}
+	for i, plugin := range extra {
+		var pluginType string
+		if err := json.Unmarshal(plugin["type"], &pluginType); err != nil || pluginType == "" {
+			return "", fmt.Errorf("plugin %d does not have a type", i)
+		}
+	}
+
+	var conf map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(cniConfJSON), &conf); err != nil {
+		return "", errors.Wrap(err, "failed to parse CNI conf")
+	}
+	var plugins []json.RawMessage
+	if err := json.Unmarshal(conf["plugins"], &plugins); err != nil {
+		return "", errors.Wrap(err, "failed to parse CNI conf plugins")
+	}
+	for _, plugin := range extra {
+		b, err := json.Marshal(plugin)
+		if err != nil {
+			return "", err
+		}
+		plugins = append(plugins, b)
+	}
+	b, err := json.Marshal(plugins)
+	if err != nil {
+		return "", err
+	}
+	conf["plugins"] = b
+	b, err = json.MarshalIndent(conf, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
 }
 
 func createFlannelConf(nodeConfig *config.Node) error {
-	var ipv4Enabled string
-	logrus.Debugf("Creating the flannel configuration for backend %s in file %s", nodeConfig.FlannelBackend, nodeConfig.FlannelConfFile)
+	lf := logFields(nodeConfig)
+	logrus.WithFields(lf).Debugf("Creating the flannel configuration for backend %s in file %s", nodeConfig.FlannelBackend, nodeConfig.FlannelConfFile)
 	if nodeConfig.FlannelConfFile == "" {
 		return errors.New("Flannel configuration not defined")
 	}
 	if nodeConfig.FlannelConfOverride {
-		logrus.Infof("Using custom flannel conf defined at %s", nodeConfig.FlannelConfFile)
+		logrus.WithFields(lf).Infof("Using custom flannel conf defined at %s", nodeConfig.FlannelConfFile)
+		return checkFlannelConfOverride(nodeConfig.FlannelConfFile)
+	}
+	mtu, err := flannelConfMTU(nodeConfig)
+	if err != nil {
+		return err
+	}
+	confJSON, err := renderFlannelConf(nodeConfig, mtu)
+	if err != nil {
+		return err
+	}
+
+	if nodeConfig.FlannelDryRun {
+		logrus.WithFields(lf).Infof("Dry run: not writing flannel configuration %s:\n%s", nodeConfig.FlannelConfFile, confJSON)
 		return nil
 	}
+	logrus.WithFields(lf).Debugf("The flannel configuration is %s", confJSON)
+	return writeConf(nodeConfig.FlannelConfFile, confJSON)
+}
+
+// checkFlannelConfOverride checks that the custom flannel conf can be read and is a JSON object, as
+// flannel only reports a bad conf once it is running.
+func checkFlannelConfOverride(name string) error {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return errors.Wrap(err, "failed to read custom flannel conf")
+	}
+	var conf map[string]interface{}
+	if err := json.Unmarshal(b, &conf); err != nil {
+		return errors.Wrapf(err, "custom flannel conf %s is not a valid JSON object", name)
+	}
+	return nil
+}
+
+// writeConf writes a conf file, retrying with backoff if the write fails with an error that may be
+// transient. Errors that will not go away on their own, such as permission denied, are returned at once.
+func writeConf(name, content string) error {
+	return retry.OnError(writeConfBackoff, func(err error) bool {
+		if !isTransientWriteError(err) {
+			return false
+		}
+		logrus.Warnf("Retrying write of %s: %v", name, err)
+		return true
+	}, func() error {
+		return writeConfFile(name, content)
+	})
+}
+
+// isTransientWriteError returns false for write errors that are caused by the permissions or layout of the
+// filesystem, and true for all others.
+func isTransientWriteError(err error) bool {
+	for _, permanent := range []error{os.ErrPermission, syscall.EROFS, syscall.ENOSPC, syscall.ENOTDIR, syscall.EISDIR} {
+		if errors.Is(err, permanent) {
+			return false
+		}
+	}
+	return true
+}
+
+// flannelConfMTU returns the MTU that Prepare writes to the flannel net-conf: the configured MTU, which
+// is checked against the MTU of the underlay interface, or otherwise the MTU detected from the underlay
+// interface. Zero leaves flannel to pick the MTU itself.
+func flannelConfMTU(nodeConfig *config.Node) (int, error) {
+	if goruntime.GOOS == "windows" {
+		return nodeConfig.FlannelMTU, nil
+	}
 	netMode, err := findNetMode(nodeConfig.AgentConfig.ClusterCIDRs)
 	if err != nil {
-		logrus.Fatalf("Flannel error checking netMode: %v", err)
-		return err
+		return 0, errors.Wrap(err, "failed to check netMode for flannel")
 	}
-	if netMode == ipv4 || netMode == (ipv4+ipv6) {
-		ipv4Enabled = "true"
-	} else {
-		ipv4Enabled = "false"
+	if nodeConfig.FlannelMTU == 0 {
+		return detectFlannelMTU(nodeConfig, netMode), nil
 	}
-	confJSON := strings.ReplaceAll(flannelConf, "%IPV4_ENABLED%", ipv4Enabled)
-	if netMode == ipv4 {
-		confJSON = strings.ReplaceAll(confJSON, "%CIDR%", nodeConfig.AgentConfig.ClusterCIDR.String())
-		confJSON = strings.ReplaceAll(confJSON, "%IPV6_ENABLED%", "false")
-		confJSON = strings.ReplaceAll(confJSON, "%CIDR_IPV6%", emptyIPv6Network)
-	} else if netMode == (ipv4 + ipv6) {
-		confJSON = strings.ReplaceAll(confJSON, "%IPV6_ENABLED%", "true")
-		for _, cidr := range nodeConfig.AgentConfig.ClusterCIDRs {
-			if utilsnet.IsIPv6(cidr.IP) {
-				// Only one ipv6 range available. This might change in future: https://github.com/kubernetes/enhancements/issues/2593
-				confJSON = strings.ReplaceAll(confJSON, "%CIDR_IPV6%", cidr.String())
-			} else {
-				confJSON = strings.ReplaceAll(confJSON, "%CIDR%", cidr.String())
-			}
+	if err := validateFlannelMTU(nodeConfig); err != nil {
+		return 0, err
+	}
+	checkFlannelMTU(nodeConfig, netMode)
+	return nodeConfig.FlannelMTU, nil
+}
+
+// validateFlannelMTU checks that a configured flannel MTU is in range, and is supported by the backend.
+func validateFlannelMTU(nodeConfig *config.Node) error {
+	if nodeConfig.FlannelMTU < minFlannelMTU || nodeConfig.FlannelMTU > maxFlannelMTU {
+		return fmt.Errorf("invalid flannel MTU %d: must be between %d and %d", nodeConfig.FlannelMTU, minFlannelMTU, maxFlannelMTU)
+	}
+	switch nodeConfig.FlannelBackend {
+	case config.FlannelBackendVXLAN, config.FlannelBackendHostGWVXLAN, config.FlannelBackendWireguardNative:
+	default:
+		return fmt.Errorf("flannel MTU cannot be set for backend '%s'", nodeConfig.FlannelBackend)
+	}
+	if goruntime.GOOS == "windows" {
+		return errors.New("flannel MTU cannot be set on Windows")
+	}
+	return nil
+}
+
+// RenderFlannelConf returns the flannel net-conf for the node. If the node uses a custom flannel conf,
+// its content is returned. Nothing is written, and the conf only depends on the node config: the host
+// is not checked for the backend's prerequisites, and the MTU is not detected from the underlay
+// interface, so the configured MTU, if any, is used.
+func RenderFlannelConf(nodeConfig *config.Node) (string, error) {
+	return renderFlannelConf(nodeConfig, nodeConfig.FlannelMTU)
+}
+
+// renderFlannelConf returns the flannel net-conf for the node, with the given backend MTU.
+func renderFlannelConf(nodeConfig *config.Node, mtu int) (string, error) {
+	if nodeConfig.FlannelConfOverride {
+		b, err := os.ReadFile(nodeConfig.FlannelConfFile)
+		if err != nil {
+			return "", errors.Wrap(err, "failed to read custom flannel conf")
 		}
+		return string(b), nil
+	}
+	netMode, err := findNetMode(nodeConfig.AgentConfig.ClusterCIDRs)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to check netMode for flannel")
+	}
+	conf := netConf{
+		EnableIPv4:     netMode == ipv4 || netMode == (ipv4+ipv6),
+		EnableIPv6:     netMode == ipv6 || netMode == (ipv4+ipv6),
+		EnableNFTables: nodeConfig.FlannelNFTables,
+	}
+	if err := setSubnetLease(&conf, nodeConfig, netMode); err != nil {
+		return "", err
+	}
+	networks := flannelNetworks(nodeConfig)
+	if netMode == ipv4 {
+		conf.Network = networks[0].String()
+		conf.IPv6Network = emptyIPv6Network
 	} else {
-		confJSON = strings.ReplaceAll(confJSON, "%CIDR%", "0.0.0.0/0")
-		confJSON = strings.ReplaceAll(confJSON, "%IPV6_ENABLED%", "true")
-		for _, cidr := range nodeConfig.AgentConfig.ClusterCIDRs {
+		for _, cidr := range networks {
 			if utilsnet.IsIPv6(cidr.IP) {
 				// Only one ipv6 range available. This might change in future: https://github.com/kubernetes/enhancements/issues/2593
-				confJSON = strings.ReplaceAll(confJSON, "%CIDR_IPV6%", cidr.String())
+				conf.IPv6Network = cidr.String()
+			} else if netMode == (ipv4 + ipv6) {
+				// IPv6-only clusters must not set an IPv4 Network
+				conf.Network = cidr.String()
 			}
 		}
 	}
 
-	var backendConf string
 	backendOptions := make(map[string]string)
 
+	if nodeConfig.FlannelMTU != 0 {
+		if err := validateFlannelMTU(nodeConfig); err != nil {
+			return "", err
+		}
+	}
+
 	// precheck and error out unsupported flannel backends.
 	switch nodeConfig.FlannelBackend {
 	case config.FlannelBackendHostGW:
 	case config.FlannelBackendTailscale:
 	case config.FlannelBackendWireguardNative:
-		if goruntime.GOOS == "windows" {
-			return fmt.Errorf("unsupported flannel backend '%s' for Windows", nodeConfig.FlannelBackend)
+		if err := checkBackendSupported(nodeConfig.FlannelBackend); err != nil {
+			return "", err
+		}
+		if nodeConfig.FlannelWireguardPort < 0 || nodeConfig.FlannelWireguardPort > 65535 {
+			return "", fmt.Errorf("invalid flannel wireguard listen port %d: must be between 1 and 65535", nodeConfig.FlannelWireguardPort)
+		}
+		if nodeConfig.FlannelWireguardPort == 65535 && netMode == (ipv4+ipv6) {
+			return "", errors.New("invalid flannel wireguard listen port 65535: dual-stack also listens on the next port")
+		}
+		if nodeConfig.FlannelWireguardKeepalive < 0 {
+			return "", fmt.Errorf("invalid flannel wireguard keepalive interval %d: must be a positive number of seconds", nodeConfig.FlannelWireguardKeepalive)
+		}
+	case config.FlannelBackendIPIP:
+		if err := checkBackendSupported(nodeConfig.FlannelBackend); err != nil {
+			return "", err
 		}
 	}
 
 	switch nodeConfig.FlannelBackend {
 	case config.FlannelBackendVXLAN:
-		backendConf = vxlanBackend
+		conf.Backend, err = vxlanBackendConf(nodeConfig, mtu)
+		if err != nil {
+			return "", err
+		}
+	case config.FlannelBackendHostGWVXLAN:
+		// Flannel's vxlan backend with DirectRouting installs host-gw style routes to nodes on the
+		// same subnet, and only encapsulates traffic to nodes on other subnets.
+		backend, err := vxlanBackendConf(nodeConfig, mtu)
+		if err != nil {
+			return "", err
+		}
+		backend.DirectRouting = true
+		conf.Backend = backend
 	case config.FlannelBackendHostGW:
-		backendConf = hostGWBackend
+		conf.Backend = hostGWBackend{Type: "host-gw"}
+	case config.FlannelBackendAlloc:
+		conf.Backend = allocBackend{Type: "alloc"}
+	case config.FlannelBackendIPIP:
+		conf.Backend = ipipBackend{Type: "ipip", DirectRouting: nodeConfig.FlannelDirectRouting}
 	case config.FlannelBackendTailscale:
 		var routes string
 		switch netMode {
@@ -215,27 +1922,243 @@ func createFlannelConf(nodeConfig *config.Node) error {
 		case ipv6:
 			routes = "$IPV6SUBNET"
 		default:
-			return fmt.Errorf("incorrect netMode for flannel tailscale backend")
+			return "", fmt.Errorf("incorrect netMode for flannel tailscale backend")
+		}
+		conf.Backend = extensionBackend{
+			Type:               "extension",
+			PostStartupCommand: "tailscale set --accept-routes --advertise-routes=" + routes,
+			ShutdownCommand:    tailscaleShutdownCommand,
 		}
-		backendConf = strings.ReplaceAll(tailscaledBackend, "%Routes%", routes)
 	case config.FlannelBackendWireguardNative:
 		mode, ok := backendOptions["Mode"]
 		if !ok {
 			mode = "separate"
 		}
-		keepalive, ok := backendOptions["PersistentKeepaliveInterval"]
-		if !ok {
-			keepalive = "25"
+		keepalive := nodeConfig.FlannelWireguardKeepalive
+		if keepalive == 0 {
+			keepalive = defaultWireguardKeepalive
+		}
+		backend := wireguardBackend{
+			Type:                        "wireguard",
+			MTU:                         mtu,
+			ListenPort:                  nodeConfig.FlannelWireguardPort,
+			PersistentKeepaliveInterval: keepalive,
+			Mode:                        mode,
+		}
+		// Flannel listens on ListenPortV6 for IPv6, 51821 by default. In dual-stack the IPv6 interface
+		// takes the port after ListenPort, so that a ListenPort of 51821 does not collide with it.
+		if backend.ListenPort != 0 {
+			switch netMode {
+			case ipv6:
+				backend.ListenPortV6 = backend.ListenPort
+			case ipv4 + ipv6:
+				backend.ListenPortV6 = backend.ListenPort + 1
+			}
+		}
+		conf.Backend = backend
+	default:
+		if nodeConfig.FlannelBackendConfig == "" {
+			return "", fmt.Errorf("Cannot configure unknown flannel backend '%s'", nodeConfig.FlannelBackend)
+		}
+		backend, err := customBackendConf(nodeConfig.FlannelBackendConfig)
+		if err != nil {
+			return "", errors.Wrapf(err, "invalid config for flannel backend '%s'", nodeConfig.FlannelBackend)
+		}
+		conf.Backend = backend
+	}
+	b, err := json.MarshalIndent(conf, "", "\t")
+	if err != nil {
+		return "", errors.Wrap(err, "failed to marshal flannel configuration")
+	}
+	if len(nodeConfig.FlannelNetConfExtra) > 0 {
+		if b, err = mergeNetConfExtra(b, nodeConfig.FlannelNetConfExtra); err != nil {
+			return "", err
+		}
+	}
+	return string(b) + "\n", nil
+}
+
+// mergeNetConfExtra adds extra top-level keys to the generated flannel net-conf. Generated keys
+// take precedence; as flannel matches keys case-insensitively, so does the check for a conflict.
+func mergeNetConfExtra(confJSON []byte, extra map[string]interface{}) ([]byte, error) {
+	merged := map[string]json.RawMessage{}
+	if err := json.Unmarshal(confJSON, &merged); err != nil {
+		return nil, errors.Wrap(err, "failed to parse flannel configuration")
+	}
+	computed := map[string]bool{}
+	for key := range merged {
+		computed[strings.ToLower(key)] = true
+	}
+	for key, value := range extra {
+		if computed[strings.ToLower(key)] {
+			logrus.Warnf("Ignoring extra flannel net-conf key %s, as it is already set in the generated config", key)
+			continue
+		}
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid value for extra flannel net-conf key %s", key)
+		}
+		merged[key] = raw
+	}
+	b, err := json.MarshalIndent(merged, "", "\t")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal flannel configuration")
+	}
+	return b, nil
+}
+
+// customBackendConf checks that the raw backend config for a backend that k3s does not know is a JSON
+// object with a Type, as flannel requires, and returns it to be used verbatim as the net-conf backend.
+func customBackendConf(raw string) (json.RawMessage, error) {
+	var backend map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(raw), &backend); err != nil || backend == nil {
+		return nil, errors.New("must be a JSON object")
+	}
+	var backendType string
+	if err := json.Unmarshal(backend["Type"], &backendType); err != nil || backendType == "" {
+		return nil, errors.New("must set Type to the name of a flannel backend")
+	}
+	return json.RawMessage(raw), nil
+}
+
+// checkBackendSupported returns an error if the flannel backend cannot be used on this OS. The
+// wireguard-native and ipip backends rely on Linux kernel interfaces that do not exist on Windows.
+func checkBackendSupported(backend string) error {
+	switch backend {
+	case config.FlannelBackendWireguardNative, config.FlannelBackendIPIP, config.FlannelBackendHostGWVXLAN:
+		if goruntime.GOOS == "windows" {
+			logrus.Errorf("Flannel backend %s is not supported on Windows; use vxlan or host-gw instead", backend)
+			return fmt.Errorf("unsupported flannel backend '%s' for Windows", backend)
+		}
+	}
+	return nil
+}
+
+// flannelRuntimeDir returns the directory for the files that flannel keeps across restarts: the
+// configured runtime dir, or the directory of the flannel config.
+func flannelRuntimeDir(nodeConfig *config.Node) string {
+	if nodeConfig.FlannelRuntimeDir != "" {
+		return nodeConfig.FlannelRuntimeDir
+	}
+	return filepath.Dir(nodeConfig.FlannelConfFile)
+}
+
+// wireguardKeyFile returns the path of the wireguard private key: the file named by the environment
+// variable that flannel reads, if it is set, and otherwise the key file in the flannel runtime dir.
+func wireguardKeyFile(nodeConfig *config.Node) string {
+	if keyFile := os.Getenv(wireguardKeyFileEnv); keyFile != "" {
+		return keyFile
+	}
+	return filepath.Join(flannelRuntimeDir(nodeConfig), wireguardKeyFileName)
+}
+
+// setupWireguardKey ensures that the wireguard private key is kept in the flannel runtime dir,
+// so that the node's public key does not change when the agent restarts. An existing key is
+// reused, and a new one is only generated if the file is missing.
+func setupWireguardKey(nodeConfig *config.Node) error {
+	keyFile := wireguardKeyFile(nodeConfig)
+
+	data, err := os.ReadFile(keyFile)
+	switch {
+	case err == nil:
+		if _, err := wgtypes.ParseKey(string(data)); err != nil {
+			return errors.Wrapf(err, "failed to parse wireguard private key %s", keyFile)
+		}
+		if err := os.Chmod(keyFile, 0600); err != nil {
+			return errors.Wrapf(err, "failed to set permissions on wireguard private key %s", keyFile)
+		}
+		logrus.Debugf("Using existing wireguard private key %s", keyFile)
+	case os.IsNotExist(err):
+		key, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			return errors.Wrap(err, "failed to generate wireguard private key")
+		}
+		if err := util.WriteFileMode(keyFile, key.String(), 0600); err != nil {
+			return errors.Wrap(err, "failed to write wireguard private key")
 		}
-		backendConf = strings.ReplaceAll(wireguardNativeBackend, "%Mode%", mode)
-		backendConf = strings.ReplaceAll(backendConf, "%PersistentKeepaliveInterval%", keepalive)
+		logrus.Infof("Generated wireguard private key %s", keyFile)
 	default:
-		return fmt.Errorf("Cannot configure unknown flannel backend '%s'", nodeConfig.FlannelBackend)
+		return errors.Wrapf(err, "failed to read wireguard private key %s", keyFile)
+	}
+
+	// flannel's wireguard backend reads the key from the file named by this environment variable
+	return os.Setenv(wireguardKeyFileEnv, keyFile)
+}
+
+// vxlanBackendConf returns the vxlan backend configuration. VNI and Port are only
+// included when overridden, or when the platform requires them to be set.
+func vxlanBackendConf(nodeConfig *config.Node, mtu int) (vxlanBackend, error) {
+	vni := nodeConfig.FlannelVNI
+	if vni == 0 {
+		vni = vxlanDefaultVNI
+	}
+	if vni < 0 || vni > maxVXLANVNI {
+		return vxlanBackend{}, fmt.Errorf("invalid flannel vxlan VNI %d: must be between 1 and %d", vni, maxVXLANVNI)
+	}
+	port := nodeConfig.FlannelPort
+	if port == 0 {
+		port = vxlanDefaultPort
+	}
+	if port < 0 || port > 65535 {
+		return vxlanBackend{}, fmt.Errorf("invalid flannel vxlan port %d: must be between 1 and 65535", port)
+	}
+
+	return vxlanBackend{
+		Type:          "vxlan",
+		VNI:           vni,
+		Port:          port,
+		MTU:           mtu,
+		GBP:           nodeConfig.FlannelVXLANGBP,
+		DirectRouting: nodeConfig.FlannelDirectRouting,
+	}, nil
+}
+
+// setSubnetLease sets the SubnetLen, SubnetMin and SubnetMax keys of the flannel config, leaving
+// those that are unset empty. These only apply to the IPv4 cluster CIDR, and are
+// validated the same way flannel validates them, so that a bad value is reported before flannel starts.
+func setSubnetLease(conf *netConf, nodeConfig *config.Node, netMode int) error {
+	if nodeConfig.FlannelSubnetLen == 0 && nodeConfig.FlannelSubnetMin == "" && nodeConfig.FlannelSubnetMax == "" {
+		return nil
+	}
+	var clusterCIDR *net.IPNet
+	for _, cidr := range flannelNetworks(nodeConfig) {
+		if utilsnet.IsIPv4CIDR(cidr) {
+			clusterCIDR = cidr
+			break
+		}
+	}
+	if netMode == ipv6 || clusterCIDR == nil {
+		return errors.New("flannel subnet lease parameters can only be set with an IPv4 cluster CIDR")
 	}
-	confJSON = strings.ReplaceAll(confJSON, "%backend%", backendConf)
+	prefixLen, _ := clusterCIDR.Mask.Size()
 
-	logrus.Debugf("The flannel configuration is %s", confJSON)
-	return util.WriteFile(nodeConfig.FlannelConfFile, confJSON)
+	subnetLen := nodeConfig.FlannelSubnetLen
+	if subnetLen != 0 {
+		if subnetLen < prefixLen+2 || subnetLen > 30 {
+			return fmt.Errorf("invalid flannel SubnetLen %d: must be between %d and 30 for cluster CIDR %s", subnetLen, prefixLen+2, clusterCIDR)
+		}
+		conf.SubnetLen = subnetLen
+	}
+	for _, key := range []struct {
+		name, value string
+		key         *string
+	}{{"SubnetMin", nodeConfig.FlannelSubnetMin, &conf.SubnetMin}, {"SubnetMax", nodeConfig.FlannelSubnetMax, &conf.SubnetMax}} {
+		if key.value == "" {
+			continue
+		}
+		ip := net.ParseIP(key.value).To4()
+		if ip == nil {
+			return fmt.Errorf("invalid flannel %s %q: must be an IPv4 address", key.name, key.value)
+		}
+		if !clusterCIDR.Contains(ip) {
+			return fmt.Errorf("invalid flannel %s %s: not within cluster CIDR %s", key.name, ip, clusterCIDR)
+		}
+		if subnetLen != 0 && !ip.Equal(ip.Mask(net.CIDRMask(subnetLen, 32))) {
+			return fmt.Errorf("invalid flannel %s %s: not on a /%d boundary", key.name, ip, subnetLen)
+		}
+		*key.key = ip.String()
+	}
+	return nil
 }
 
 // fundNetMode returns the mode (ipv4, ipv6 or dual-stack) in which flannel is operating
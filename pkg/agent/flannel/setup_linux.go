@@ -3,25 +3,27 @@
 
 package flannel
 
+import "github.com/docker/docker/pkg/parsers/kernel"
+
+// vxlanGBPSupported returns true if the kernel supports the vxlan group based policy extension, which
+// was added in Linux 4.0. It is a variable so that tests can replace it.
+var vxlanGBPSupported = func() bool {
+	return kernel.CheckKernelVersion(4, 0, 0)
+}
+
 const (
 	cniConf = `{
-  "name":"cbr0",
-  "cniVersion":"1.0.0",
+  "name":"%CNI_NAME%",
+  "cniVersion":"%CNI_VERSION%",
   "plugins":[
     {
       "type":"flannel",
       "delegate":{
-        "hairpinMode":true,
-        "forceAddress":true,
-        "isDefaultGateway":true
-      }
-    },
-    {
-      "type":"portmap",
-      "capabilities":{
-        "portMappings":true
+        "hairpinMode":%HAIRPIN_MODE%,
+        "forceAddress":%FORCE_ADDRESS%,
+        "isDefaultGateway":%IS_DEFAULT_GATEWAY%%IP_MASQ%
       }
-    },
+    },%PORTMAP%
     {
       "type":"bandwidth",
       "capabilities":{
@@ -32,7 +34,7 @@ const (
 }
 `
 
-	vxlanBackend = `{
-	"Type": "vxlan"
-}`
+	// Leave VNI and Port unset so that flannel uses its own defaults
+	vxlanDefaultVNI  = 0
+	vxlanDefaultPort = 0
 )
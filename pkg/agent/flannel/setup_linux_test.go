@@ -0,0 +1,1715 @@
+//go:build linux
+// +build linux
+
+package flannel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/k3s/pkg/daemons/config"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_createCNIConfDelegate(t *testing.T) {
+	tests := []struct {
+		name             string
+		noHairpinMode    bool
+		noDefaultGateway bool
+		noForceAddress   bool
+		wantConfig       []string
+	}{
+		{"defaults", false, false, false, []string{"\"hairpinMode\":true", "\"forceAddress\":true", "\"isDefaultGateway\":true"}},
+		{"no hairpin mode", true, false, false, []string{"\"hairpinMode\":false", "\"forceAddress\":true", "\"isDefaultGateway\":true"}},
+		{"no default gateway", false, true, false, []string{"\"hairpinMode\":true", "\"forceAddress\":true", "\"isDefaultGateway\":false"}},
+		{"all disabled", true, true, true, []string{"\"hairpinMode\":false", "\"forceAddress\":false", "\"isDefaultGateway\":false"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN)
+			nodeConfig.AgentConfig.CNINoHairpinMode = tt.noHairpinMode
+			nodeConfig.AgentConfig.CNINoDefaultGateway = tt.noDefaultGateway
+			nodeConfig.AgentConfig.CNINoForceAddress = tt.noForceAddress
+			if err := createCNIConf(dir, nodeConfig); err != nil {
+				t.Fatalf("createCNIConf() error = %v", err)
+			}
+			p := filepath.Join(dir, "10-flannel.conflist")
+			assertFileContains(t, p, tt.wantConfig)
+			assertValidJSON(t, p)
+		})
+	}
+}
+
+func Test_createCNIConfPortmap(t *testing.T) {
+	tests := []struct {
+		name       string
+		noPortmap  bool
+		nftables   bool
+		wantConfig []string
+		denyConfig []string
+	}{
+		{"enabled", false, false, []string{"\"type\":\"flannel\"", "\"type\":\"portmap\"", "\"portMappings\":true"}, []string{"\"backend\""}},
+		{"disabled", true, false, []string{"\"type\":\"flannel\""}, []string{"\"type\":\"portmap\"", "portMappings"}},
+		{"nftables", false, true, []string{"\"type\":\"portmap\"", "\"backend\":\"nftables\"", "\"portMappings\":true"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN)
+			nodeConfig.AgentConfig.CNINoPortmap = tt.noPortmap
+			nodeConfig.FlannelNFTables = tt.nftables
+			if err := createCNIConf(dir, nodeConfig); err != nil {
+				t.Fatalf("createCNIConf() error = %v", err)
+			}
+			p := filepath.Join(dir, "10-flannel.conflist")
+			assertFileContains(t, p, tt.wantConfig)
+			assertFileNotContains(t, p, tt.denyConfig)
+			assertValidJSON(t, p)
+		})
+	}
+}
+
+func Test_createCNIConfBandwidth(t *testing.T) {
+	dir := t.TempDir()
+	nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN)
+	if err := createCNIConf(dir, nodeConfig); err != nil {
+		t.Fatalf("createCNIConf() error = %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "10-flannel.conflist"))
+	if err != nil {
+		t.Fatalf("Failed to read CNI conf: %v", err)
+	}
+	var conf struct {
+		Plugins []struct {
+			Type         string          `json:"type"`
+			Capabilities map[string]bool `json:"capabilities"`
+		} `json:"plugins"`
+	}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		t.Fatalf("Failed to parse CNI conf: %v", err)
+	}
+
+	var types []string
+	for _, plugin := range conf.Plugins {
+		types = append(types, plugin.Type)
+	}
+	if want := []string{"flannel", "portmap", "bandwidth"}; !reflect.DeepEqual(types, want) {
+		t.Fatalf("CNI conf plugins = %v, want %v", types, want)
+	}
+	if !conf.Plugins[2].Capabilities["bandwidth"] {
+		t.Errorf("bandwidth plugin capabilities = %v, want bandwidth enabled", conf.Plugins[2].Capabilities)
+	}
+}
+
+func Test_createCNIConfTemplate(t *testing.T) {
+	tests := []struct {
+		name       string
+		template   string
+		mtu        int
+		wantConfig []string
+		wantErr    bool
+	}{
+		{
+			name:       "placeholders",
+			template:   `{"name":"custom","cniVersion":"1.0.0","plugins":[{"type":"flannel","delegate":{"hairpinMode":%HAIRPIN_MODE%,"mtu":%MTU%}},{"type":"firewall","cidr":"%CIDR%"}]}`,
+			mtu:        1400,
+			wantConfig: []string{"\"name\":\"custom\"", "\"hairpinMode\":true", "\"mtu\":1400", "\"type\":\"firewall\"", "\"cidr\":\"10.42.0.0/16\""},
+		},
+		{
+			name:     "mtu placeholder without mtu",
+			template: `{"name":"custom","plugins":[{"type":"flannel","delegate":{"mtu":%MTU%}}]}`,
+			wantErr:  true,
+		},
+		{
+			name:    "missing file",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN)
+			nodeConfig.FlannelMTU = tt.mtu
+			nodeConfig.AgentConfig.FlannelCniConfTemplate = filepath.Join(t.TempDir(), "template.conflist")
+			if tt.template != "" {
+				if err := os.WriteFile(nodeConfig.AgentConfig.FlannelCniConfTemplate, []byte(tt.template), 0644); err != nil {
+					t.Fatalf("Failed to write template: %v", err)
+				}
+			}
+			if err := createCNIConf(dir, nodeConfig); (err != nil) != tt.wantErr {
+				t.Fatalf("createCNIConf() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			p := filepath.Join(dir, "10-flannel.conflist")
+			assertFileContains(t, p, tt.wantConfig)
+			assertValidJSON(t, p)
+		})
+	}
+}
+
+func Test_createCNIConfVersion(t *testing.T) {
+	tests := []struct {
+		name       string
+		version    string
+		wantConfig []string
+		wantErr    bool
+	}{
+		{"default", "", []string{"\"cniVersion\":\"1.0.0\""}, false},
+		{"1.0.0", "1.0.0", []string{"\"cniVersion\":\"1.0.0\""}, false},
+		{"0.3.1", "0.3.1", []string{"\"cniVersion\":\"0.3.1\""}, false},
+		{"unknown", "0.2.0", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN)
+			nodeConfig.AgentConfig.CNIVersion = tt.version
+			if err := createCNIConf(dir, nodeConfig); (err != nil) != tt.wantErr {
+				t.Fatalf("createCNIConf() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			assertFileContains(t, filepath.Join(dir, "10-flannel.conflist"), tt.wantConfig)
+		})
+	}
+}
+
+func Test_createCNIConfExisting(t *testing.T) {
+	const edited = `{"name":"edited"}`
+	tests := []struct {
+		name       string
+		existing   string
+		recorded   bool
+		force      bool
+		wantConfig []string
+		wantEdited bool
+	}{
+		{"write on missing", "", false, false, []string{"\"type\":\"flannel\""}, false},
+		{"skip on existing", edited, true, false, nil, true},
+		{"overwrite unrecorded", edited, false, false, []string{"\"type\":\"flannel\""}, false},
+		{"force overwrite", edited, true, true, []string{"\"type\":\"flannel\""}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			p := filepath.Join(dir, "10-flannel.conflist")
+			if tt.existing != "" {
+				if err := os.WriteFile(p, []byte(tt.existing), 0644); err != nil {
+					t.Fatalf("Failed to write existing CNI conf: %v", err)
+				}
+			}
+			nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN)
+			if tt.recorded {
+				// The conf was generated, then edited
+				if err := os.WriteFile(cniConfRecord(nodeConfig), []byte(cniConfRecordLine(p, []byte(`{"name":"generated"}`))), 0644); err != nil {
+					t.Fatalf("Failed to write CNI conf record: %v", err)
+				}
+			}
+			nodeConfig.AgentConfig.CNIConfForce = tt.force
+			if err := createCNIConf(dir, nodeConfig); err != nil {
+				t.Fatalf("createCNIConf() error = %v", err)
+			}
+			data, err := os.ReadFile(p)
+			if err != nil {
+				t.Fatalf("Failed to read CNI conf: %v", err)
+			}
+			if got := string(data) == edited; got != tt.wantEdited {
+				t.Errorf("CNI conf preserved = %v, want %v", got, tt.wantEdited)
+			}
+			assertFileContains(t, p, tt.wantConfig)
+		})
+	}
+}
+
+func Test_createCNIConfChanged(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "10-flannel.conflist")
+	nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN)
+	if err := createCNIConf(dir, nodeConfig); err != nil {
+		t.Fatalf("createCNIConf() error = %v", err)
+	}
+	assertFileNotContains(t, p, []string{"ipMasq"})
+
+	// A conf that was not edited since it was written is replaced when the config changes
+	nodeConfig.FlannelDisableMasq = true
+	if err := createCNIConf(dir, nodeConfig); err != nil {
+		t.Fatalf("createCNIConf() error = %v", err)
+	}
+	assertFileContains(t, p, []string{"\"ipMasq\":false"})
+
+	// Once it is edited, it is preserved across config changes
+	const edited = `{"name":"edited"}`
+	if err := os.WriteFile(p, []byte(edited), 0644); err != nil {
+		t.Fatal(err)
+	}
+	nodeConfig.FlannelDisableMasq = false
+	if err := createCNIConf(dir, nodeConfig); err != nil {
+		t.Fatalf("createCNIConf() error = %v", err)
+	}
+	if data, err := os.ReadFile(p); err != nil || string(data) != edited {
+		t.Errorf("createCNIConf() replaced the edited CNI conf with %s", data)
+	}
+}
+
+func Test_createCNIConfNameAndIPMasq(t *testing.T) {
+	tests := []struct {
+		name            string
+		networkName     string
+		noIPMasq        bool
+		noFlannelIPMasq bool
+		disableMasq     bool
+		wantConfig      []string
+		denyConfig      []string
+		wantErr         bool
+	}{
+		{"defaults", "", false, false, false, []string{"\"name\":\"cbr0\""}, []string{"ipMasq"}, false},
+		{"custom name", "k3s-pods", false, false, false, []string{"\"name\":\"k3s-pods\""}, nil, false},
+		{"no ip masq", "", true, false, false, []string{"\"name\":\"cbr0\"", "\"ipMasq\":false"}, nil, false},
+		{"no flannel ip masq", "", false, true, false, []string{"\"ipMasq\":false"}, nil, false},
+		{"flannel masq disabled", "", false, false, true, []string{"\"ipMasq\":false"}, nil, false},
+		{"invalid name", "bad name", false, false, false, nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN)
+			nodeConfig.AgentConfig.CNINetworkName = tt.networkName
+			nodeConfig.AgentConfig.CNINoIPMasq = tt.noIPMasq
+			nodeConfig.FlannelNoIPMasq = tt.noFlannelIPMasq
+			nodeConfig.FlannelDisableMasq = tt.disableMasq
+			// FlannelDisableMasq also overrides the cluster-wide IPv6 masquerading setting
+			nodeConfig.FlannelIPv6Masq = tt.disableMasq
+			if err := createCNIConf(dir, nodeConfig); (err != nil) != tt.wantErr {
+				t.Fatalf("createCNIConf() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			p := filepath.Join(dir, "10-flannel.conflist")
+			assertFileContains(t, p, tt.wantConfig)
+			assertFileNotContains(t, p, tt.denyConfig)
+			assertValidJSON(t, p)
+		})
+	}
+}
+
+func Test_createCNIConfPlugins(t *testing.T) {
+	tests := []struct {
+		name      string
+		plugins   string
+		wantTypes []string
+		wantErr   bool
+	}{
+		{"one plugin", `[{"type":"firewall"}]`, []string{"flannel", "portmap", "bandwidth", "firewall"}, false},
+		{"two plugins", `[{"type":"firewall","backend":"iptables"},{"type":"tuning","sysctl":{"net.core.somaxconn":"500"}}]`, []string{"flannel", "portmap", "bandwidth", "firewall", "tuning"}, false},
+		{"not an array", `{"type":"firewall"}`, nil, true},
+		{"not an object", `["firewall"]`, nil, true},
+		{"missing type", `[{"backend":"iptables"}]`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			pluginsFile := filepath.Join(t.TempDir(), "plugins.json")
+			if err := os.WriteFile(pluginsFile, []byte(tt.plugins), 0644); err != nil {
+				t.Fatalf("Failed to write plugins: %v", err)
+			}
+			nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN)
+			nodeConfig.AgentConfig.FlannelCniConfPlugins = pluginsFile
+			if err := createCNIConf(dir, nodeConfig); (err != nil) != tt.wantErr {
+				t.Fatalf("createCNIConf() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			p := filepath.Join(dir, "10-flannel.conflist")
+			if tt.wantErr {
+				if _, err := os.Stat(p); !os.IsNotExist(err) {
+					t.Errorf("Expected no CNI conf to be written, got %v", err)
+				}
+				return
+			}
+			assertValidJSON(t, p)
+			data, err := os.ReadFile(p)
+			if err != nil {
+				t.Fatalf("Failed to read CNI conf: %v", err)
+			}
+			var conf struct {
+				Name    string
+				Plugins []struct{ Type string }
+			}
+			if err := json.Unmarshal(data, &conf); err != nil {
+				t.Fatalf("Failed to parse CNI conf: %v", err)
+			}
+			var gotTypes []string
+			for _, plugin := range conf.Plugins {
+				gotTypes = append(gotTypes, plugin.Type)
+			}
+			if !reflect.DeepEqual(gotTypes, tt.wantTypes) {
+				t.Errorf("CNI conf plugins = %v, want %v", gotTypes, tt.wantTypes)
+			}
+			if conf.Name != "cbr0" {
+				t.Errorf("CNI conf name = %q, want %q", conf.Name, "cbr0")
+			}
+		})
+	}
+}
+
+func Test_createFlannelConfGolden(t *testing.T) {
+	oldUnderlayMTU := underlayMTU
+	oldKernelModuleLoaded := kernelModuleLoaded
+	t.Cleanup(func() {
+		underlayMTU = oldUnderlayMTU
+		kernelModuleLoaded = oldKernelModuleLoaded
+	})
+	underlayMTU = func(*net.Interface, int) (int, error) { return 0, nil }
+	kernelModuleLoaded = func(string) bool { return true }
+
+	tests := []struct {
+		name    string
+		cidrs   string
+		backend string
+		set     func(*config.Node)
+	}{
+		{"vxlan", "10.42.0.0/16", config.FlannelBackendVXLAN, nil},
+		{"vxlan-dual-stack", "10.42.0.0/16,2001:cafe:42::/56", config.FlannelBackendVXLAN, nil},
+		{"vxlan-ipv6", "2001:cafe:42::/56", config.FlannelBackendVXLAN, nil},
+		{"vxlan-all", "10.42.0.0/16", config.FlannelBackendVXLAN, func(nodeConfig *config.Node) {
+			nodeConfig.FlannelVNI = 42
+			nodeConfig.FlannelPort = 4790
+			nodeConfig.FlannelMTU = 1400
+			nodeConfig.FlannelDirectRouting = true
+			nodeConfig.FlannelSubnetLen = 25
+			nodeConfig.FlannelSubnetMin = "10.42.1.0"
+			nodeConfig.FlannelSubnetMax = "10.42.200.128"
+		}},
+		{"host-gw", "10.42.0.0/16", config.FlannelBackendHostGW, nil},
+		{"host-gw-vxlan", "10.42.0.0/16", config.FlannelBackendHostGWVXLAN, nil},
+		{"host-gw-vxlan-dual-stack", "10.42.0.0/16,2001:cafe:42::/56", config.FlannelBackendHostGWVXLAN, func(nodeConfig *config.Node) {
+			nodeConfig.FlannelVNI = 42
+			nodeConfig.FlannelMTU = 1400
+		}},
+		{"ipip", "10.42.0.0/16", config.FlannelBackendIPIP, nil},
+		{"tailscale", "10.42.0.0/16,2001:cafe:42::/56", config.FlannelBackendTailscale, nil},
+		{"wireguard-native", "10.42.0.0/16", config.FlannelBackendWireguardNative, nil},
+		{"wireguard-native-all", "10.42.0.0/16", config.FlannelBackendWireguardNative, func(nodeConfig *config.Node) {
+			nodeConfig.FlannelMTU = 1380
+			nodeConfig.FlannelWireguardPort = 51830
+			nodeConfig.FlannelWireguardKeepalive = 10
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodeConfig := newTestNodeConfig(t, tt.cidrs, tt.backend)
+			if tt.set != nil {
+				tt.set(nodeConfig)
+			}
+			if err := createFlannelConf(nodeConfig); err != nil {
+				t.Fatalf("createFlannelConf() error = %v", err)
+			}
+			got, err := os.ReadFile(nodeConfig.FlannelConfFile)
+			if err != nil {
+				t.Fatalf("Failed to read flannel conf: %v", err)
+			}
+			want, err := os.ReadFile(filepath.Join("testdata", "net-conf-"+tt.name+".json"))
+			if err != nil {
+				t.Fatalf("Failed to read golden file: %v", err)
+			}
+			if string(got) != string(want) {
+				t.Errorf("createFlannelConf() wrote\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+func Test_RenderFlannelConf(t *testing.T) {
+	oldUnderlayMTU := underlayMTU
+	oldKernelModuleLoaded := kernelModuleLoaded
+	t.Cleanup(func() {
+		underlayMTU = oldUnderlayMTU
+		kernelModuleLoaded = oldKernelModuleLoaded
+	})
+	// The conf only depends on the node config, so the host must not be probed
+	underlayMTU = func(*net.Interface, int) (int, error) {
+		t.Errorf("RenderFlannelConf() probed the underlay MTU")
+		return 0, fmt.Errorf("no underlay interface")
+	}
+	kernelModuleLoaded = func(name string) bool {
+		t.Errorf("RenderFlannelConf() checked for the %s kernel module", name)
+		return false
+	}
+
+	tests := []struct {
+		name    string
+		cidrs   string
+		backend string
+	}{
+		{"vxlan", "10.42.0.0/16", config.FlannelBackendVXLAN},
+		{"vxlan-dual-stack", "10.42.0.0/16,2001:cafe:42::/56", config.FlannelBackendVXLAN},
+		{"host-gw", "10.42.0.0/16", config.FlannelBackendHostGW},
+		{"host-gw-vxlan", "10.42.0.0/16", config.FlannelBackendHostGWVXLAN},
+		{"ipip", "10.42.0.0/16", config.FlannelBackendIPIP},
+		{"tailscale", "10.42.0.0/16,2001:cafe:42::/56", config.FlannelBackendTailscale},
+		{"wireguard-native", "10.42.0.0/16", config.FlannelBackendWireguardNative},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodeConfig := newTestNodeConfig(t, tt.cidrs, tt.backend)
+			got, err := RenderFlannelConf(nodeConfig)
+			if err != nil {
+				t.Fatalf("RenderFlannelConf() error = %v", err)
+			}
+			want, err := os.ReadFile(filepath.Join("testdata", "net-conf-"+tt.name+".json"))
+			if err != nil {
+				t.Fatalf("Failed to read golden file: %v", err)
+			}
+			if got != string(want) {
+				t.Errorf("RenderFlannelConf() = \n%s\nwant\n%s", got, want)
+			}
+			if _, err := os.Stat(nodeConfig.FlannelConfFile); !os.IsNotExist(err) {
+				t.Errorf("RenderFlannelConf() wrote %s", nodeConfig.FlannelConfFile)
+			}
+		})
+	}
+
+	t.Run("unknown backend", func(t *testing.T) {
+		if _, err := RenderFlannelConf(newTestNodeConfig(t, "10.42.0.0/16", "foo")); err == nil {
+			t.Errorf("RenderFlannelConf() with an unknown backend did not return an error")
+		}
+	})
+
+	t.Run("override", func(t *testing.T) {
+		nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN)
+		nodeConfig.FlannelConfOverride = true
+		if err := os.WriteFile(nodeConfig.FlannelConfFile, []byte(`{"Network":"10.244.0.0/16"}`), 0644); err != nil {
+			t.Fatalf("Failed to write flannel conf: %v", err)
+		}
+		got, err := RenderFlannelConf(nodeConfig)
+		if err != nil {
+			t.Fatalf("RenderFlannelConf() error = %v", err)
+		}
+		if got != `{"Network":"10.244.0.0/16"}` {
+			t.Errorf("RenderFlannelConf() = %s, want the custom flannel conf", got)
+		}
+	})
+}
+
+func Test_RenderCNIConf(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN)
+		got, err := RenderCNIConf(nodeConfig)
+		if err != nil {
+			t.Fatalf("RenderCNIConf() error = %v", err)
+		}
+		var conf struct {
+			CNIVersion string `json:"cniVersion"`
+			Name       string `json:"name"`
+			Plugins    []struct {
+				Type string `json:"type"`
+			} `json:"plugins"`
+		}
+		if err := json.Unmarshal([]byte(got), &conf); err != nil {
+			t.Fatalf("RenderCNIConf() returned invalid JSON: %v\n%s", err, got)
+		}
+		if conf.CNIVersion != defaultCNIVersion || conf.Name != defaultCNINetworkName {
+			t.Errorf("RenderCNIConf() cniVersion = %q, name = %q, want %q, %q", conf.CNIVersion, conf.Name, defaultCNIVersion, defaultCNINetworkName)
+		}
+		if len(conf.Plugins) != 3 || conf.Plugins[0].Type != "flannel" {
+			t.Errorf("RenderCNIConf() plugins = %+v, want flannel, portmap and bandwidth", conf.Plugins)
+		}
+	})
+
+	t.Run("conf file", func(t *testing.T) {
+		nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN)
+		nodeConfig.AgentConfig.FlannelCniConfFile = filepath.Join(t.TempDir(), "custom.conflist")
+		if err := os.WriteFile(nodeConfig.AgentConfig.FlannelCniConfFile, []byte(`{"name":"custom"}`), 0644); err != nil {
+			t.Fatalf("Failed to write CNI conf: %v", err)
+		}
+		got, err := RenderCNIConf(nodeConfig)
+		if err != nil {
+			t.Fatalf("RenderCNIConf() error = %v", err)
+		}
+		if got != `{"name":"custom"}` {
+			t.Errorf("RenderCNIConf() = %s, want the custom CNI conf", got)
+		}
+	})
+
+	t.Run("invalid version", func(t *testing.T) {
+		nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN)
+		nodeConfig.AgentConfig.CNIVersion = "0.1.0"
+		if _, err := RenderCNIConf(nodeConfig); err == nil {
+			t.Errorf("RenderCNIConf() with an unsupported CNI version did not return an error")
+		}
+	})
+}
+
+func Test_createFlannelConfAtomic(t *testing.T) {
+	nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN)
+	backends := []string{config.FlannelBackendVXLAN, config.FlannelBackendHostGW}
+	contents := map[string]bool{}
+	for _, backend := range backends {
+		nodeConfig.FlannelBackend = backend
+		if err := createFlannelConf(nodeConfig); err != nil {
+			t.Fatalf("createFlannelConf() error = %v", err)
+		}
+		data, err := os.ReadFile(nodeConfig.FlannelConfFile)
+		if err != nil {
+			t.Fatalf("Failed to read flannel conf: %v", err)
+		}
+		contents[string(data)] = true
+	}
+
+	// Rewrite the conf repeatedly while reading it; every read must see one of the complete confs
+	done := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			data, err := os.ReadFile(nodeConfig.FlannelConfFile)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if !contents[string(data)] {
+				errs <- fmt.Errorf("read partial flannel conf %q", data)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 500; i++ {
+		nodeConfig.FlannelBackend = backends[i%len(backends)]
+		if err := createFlannelConf(nodeConfig); err != nil {
+			t.Fatalf("createFlannelConf() error = %v", err)
+		}
+	}
+	close(done)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(nodeConfig.FlannelConfFile))
+	if err != nil {
+		t.Fatalf("Failed to read flannel conf dir: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("flannel conf dir has %d entries, want only the conf file", len(entries))
+	}
+}
+
+func Test_createCNIConfDir(t *testing.T) {
+	t.Run("create missing parents", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "etc", "cni", "net.d")
+		nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN)
+		nodeConfig.FlannelConfFile = filepath.Join(t.TempDir(), "flannel", "net-conf.json")
+		if err := createCNIConf(dir, nodeConfig); err != nil {
+			t.Fatalf("createCNIConf() error = %v", err)
+		}
+		if err := createFlannelConf(nodeConfig); err != nil {
+			t.Fatalf("createFlannelConf() error = %v", err)
+		}
+		assertValidJSON(t, filepath.Join(dir, "10-flannel.conflist"))
+		assertValidJSON(t, nodeConfig.FlannelConfFile)
+	})
+
+	t.Run("file in the way", func(t *testing.T) {
+		dir := filepath.Join(t.TempDir(), "net.d")
+		if err := os.WriteFile(dir, nil, 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+		nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN)
+		err := createCNIConf(dir, nodeConfig)
+		if err == nil || !strings.Contains(err.Error(), "is not a directory") {
+			t.Fatalf("createCNIConf() error = %v, want not a directory error", err)
+		}
+	})
+}
+
+func Test_backendInterfaces(t *testing.T) {
+	tests := []struct {
+		name    string
+		cidrs   string
+		backend string
+		vni     int
+		want    []string
+	}{
+		{"vxlan", "10.42.0.0/16", config.FlannelBackendVXLAN, 0, []string{"flannel.1"}},
+		{"vxlan vni", "10.42.0.0/16", config.FlannelBackendVXLAN, 42, []string{"flannel.42"}},
+		{"vxlan dual-stack", "10.42.0.0/16,2001:cafe:22::/56", config.FlannelBackendVXLAN, 0, []string{"flannel.1", "flannel-v6.1"}},
+		{"host-gw", "10.42.0.0/16", config.FlannelBackendHostGW, 0, nil},
+		{"wireguard-native", "10.42.0.0/16", config.FlannelBackendWireguardNative, 0, []string{"flannel-wg"}},
+		{"wireguard-native ipv6", "2001:cafe:22::/56", config.FlannelBackendWireguardNative, 0, []string{"flannel-wg-v6"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodeConfig := newTestNodeConfig(t, tt.cidrs, tt.backend)
+			nodeConfig.FlannelVNI = tt.vni
+			netMode, err := findNetMode(nodeConfig.AgentConfig.ClusterCIDRs)
+			if err != nil {
+				t.Fatalf("findNetMode() error = %v", err)
+			}
+			if got := backendInterfaces(nodeConfig, netMode); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("backendInterfaces() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_Ready(t *testing.T) {
+	tests := []struct {
+		name       string
+		backend    string
+		subnetFile bool
+		ifaces     []string
+		wantErr    bool
+	}{
+		{"vxlan ready", config.FlannelBackendVXLAN, true, []string{"flannel.1"}, false},
+		{"vxlan no interface", config.FlannelBackendVXLAN, true, nil, true},
+		{"vxlan no subnet file", config.FlannelBackendVXLAN, false, []string{"flannel.1"}, true},
+		{"host-gw ready", config.FlannelBackendHostGW, true, nil, false},
+		{"wireguard-native ready", config.FlannelBackendWireguardNative, true, []string{"flannel-wg"}, false},
+		{"wireguard-native wrong interface", config.FlannelBackendWireguardNative, true, []string{"flannel.1"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldInterfaceExists, oldSubnetFileWritten := interfaceExists, subnetFileWritten
+			t.Cleanup(func() { interfaceExists, subnetFileWritten = oldInterfaceExists, oldSubnetFileWritten })
+			interfaceExists = func(name string) bool { return slices.Contains(tt.ifaces, name) }
+			subnetFileWritten = func(string) bool { return tt.subnetFile }
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			if err := Ready(ctx, newTestNodeConfig(t, "10.42.0.0/16", tt.backend)); (err != nil) != tt.wantErr {
+				t.Errorf("Ready() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_PrepareDisableCNIConf(t *testing.T) {
+	oldUnderlayMTU := underlayMTU
+	oldKernelModuleAvailable := kernelModuleAvailable
+	t.Cleanup(func() {
+		underlayMTU = oldUnderlayMTU
+		kernelModuleAvailable = oldKernelModuleAvailable
+	})
+	underlayMTU = func(*net.Interface, int) (int, error) { return 0, nil }
+	kernelModuleAvailable = func(string) bool { return true }
+	stubKernelModulesLoaded(t)
+
+	tests := []struct {
+		backend      string
+		wantNetConf  bool
+		existingConf bool
+	}{
+		{config.FlannelBackendNone, false, false},
+		{config.FlannelBackendNone, false, true},
+		{config.FlannelBackendVXLAN, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s existing=%v", tt.backend, tt.existingConf), func(t *testing.T) {
+			cniDir := t.TempDir()
+			existing := filepath.Join(cniDir, "10-flannel.conflist")
+			if tt.existingConf {
+				if err := os.WriteFile(existing, []byte("{}"), 0644); err != nil {
+					t.Fatalf("Failed to write %s: %v", existing, err)
+				}
+			}
+			nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", tt.backend)
+			nodeConfig.AgentConfig.CNIConfDir = cniDir
+			nodeConfig.AgentConfig.DisableCNIConf = true
+			if err := Prepare(context.Background(), nodeConfig); err != nil {
+				t.Fatalf("Prepare() error = %v", err)
+			}
+
+			entries, err := os.ReadDir(cniDir)
+			if err != nil {
+				t.Fatalf("Failed to read %s: %v", cniDir, err)
+			}
+			wantEntries := 0
+			if tt.existingConf {
+				wantEntries = 1
+			}
+			if len(entries) != wantEntries {
+				t.Errorf("Prepare() left %d files in %s, want %d", len(entries), cniDir, wantEntries)
+			}
+			if tt.existingConf {
+				assertFileContains(t, existing, []string{`^\{\}$`})
+			}
+			if _, err := os.Stat(nodeConfig.FlannelConfFile); (err == nil) != tt.wantNetConf {
+				t.Errorf("Prepare() flannel conf exists = %v, want %v", err == nil, tt.wantNetConf)
+			}
+		})
+	}
+}
+
+func Test_PrepareFileModes(t *testing.T) {
+	oldUnderlayMTU := underlayMTU
+	oldKernelModuleAvailable := kernelModuleAvailable
+	t.Cleanup(func() {
+		underlayMTU = oldUnderlayMTU
+		kernelModuleAvailable = oldKernelModuleAvailable
+	})
+	underlayMTU = func(*net.Interface, int) (int, error) { return 0, nil }
+	kernelModuleAvailable = func(string) bool { return true }
+	stubKernelModulesLoaded(t)
+
+	for _, existing := range []bool{false, true} {
+		t.Run(fmt.Sprintf("existing=%v", existing), func(t *testing.T) {
+			t.Setenv(wireguardKeyFileEnv, "")
+			cniDir := t.TempDir()
+			nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendWireguardNative)
+			nodeConfig.AgentConfig.CNIConfDir = cniDir
+			nodeConfig.FlannelReadyFile = filepath.Join(filepath.Dir(nodeConfig.FlannelConfFile), "ready")
+			keyFile := filepath.Join(filepath.Dir(nodeConfig.FlannelConfFile), wireguardKeyFileName)
+			wantModes := map[string]os.FileMode{
+				filepath.Join(cniDir, "10-flannel.conflist"): 0644,
+				nodeConfig.FlannelConfFile:                   0644,
+				nodeConfig.FlannelReadyFile:                  0644,
+				keyFile:                                      0600,
+			}
+
+			if existing {
+				// Write the files with the wrong modes first, so that Prepare has to correct them
+				if err := Prepare(context.Background(), nodeConfig); err != nil {
+					t.Fatalf("Prepare() error = %v", err)
+				}
+				for path, mode := range wantModes {
+					if err := os.Chmod(path, mode^0066); err != nil {
+						t.Fatalf("Failed to chmod %s: %v", path, err)
+					}
+				}
+			}
+			if err := Prepare(context.Background(), nodeConfig); err != nil {
+				t.Fatalf("Prepare() error = %v", err)
+			}
+
+			for path, mode := range wantModes {
+				info, err := os.Stat(path)
+				if err != nil {
+					t.Fatalf("Failed to stat %s: %v", path, err)
+				}
+				if info.Mode().Perm() != mode {
+					t.Errorf("%s has mode %v, want %v", path, info.Mode().Perm(), mode)
+				}
+			}
+		})
+	}
+}
+
+func Test_PrepareDryRun(t *testing.T) {
+	hook := logtest.NewGlobal()
+	t.Cleanup(func() { logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks)) })
+	oldUnderlayMTU := underlayMTU
+	oldKernelModuleAvailable := kernelModuleAvailable
+	t.Cleanup(func() {
+		underlayMTU = oldUnderlayMTU
+		kernelModuleAvailable = oldKernelModuleAvailable
+	})
+	underlayMTU = func(*net.Interface, int) (int, error) { return 0, nil }
+	kernelModuleAvailable = func(string) bool { return true }
+	stubKernelModulesLoaded(t)
+
+	for _, backend := range []string{config.FlannelBackendVXLAN, config.FlannelBackendWireguardNative} {
+		t.Run(backend, func(t *testing.T) {
+			hook.Reset()
+			cniDir := t.TempDir()
+			nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", backend)
+			nodeConfig.AgentConfig.CNIConfDir = cniDir
+			nodeConfig.FlannelExternalProcess = true
+			nodeConfig.FlannelDryRun = true
+			if err := Prepare(context.Background(), nodeConfig); err != nil {
+				t.Fatalf("Prepare() error = %v", err)
+			}
+
+			// Nothing may be written, including the wireguard key next to the net-conf
+			for _, dir := range []string{cniDir, filepath.Dir(nodeConfig.FlannelConfFile)} {
+				if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+					t.Errorf("Prepare() wrote %d files to %s in dry run", len(entries), dir)
+				}
+			}
+
+			client := fake.NewSimpleClientset()
+			if err := Run(context.Background(), nodeConfig, client.CoreV1().Nodes()); err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+			if actions := client.Actions(); len(actions) != 0 {
+				t.Errorf("Run() made %d API calls in dry run, want 0", len(actions))
+			}
+
+			var logged string
+			for _, entry := range hook.AllEntries() {
+				logged += entry.Message + "\n"
+			}
+			for _, want := range []string{
+				"not writing flannel CNI conf " + filepath.Join(cniDir, "10-flannel.conflist"),
+				`"type":"flannel"`,
+				"not writing flannel configuration " + nodeConfig.FlannelConfFile,
+				`"Network": "10.42.0.0/16"`,
+				"not starting flannel --kube-subnet-mgr",
+			} {
+				if !strings.Contains(logged, want) {
+					t.Errorf("Dry run did not log %q; logged:\n%s", want, logged)
+				}
+			}
+		})
+	}
+}
+
+func Test_createCNIConfShadowed(t *testing.T) {
+	hook := logtest.NewGlobal()
+	t.Cleanup(func() { logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks)) })
+
+	tests := []struct {
+		name     string
+		files    []string
+		fatal    bool
+		wantWarn string
+		wantErr  bool
+	}{
+		{"no other confs", nil, false, "", false},
+		{"sorts after", []string{"20-bar.conflist"}, false, "", false},
+		{"not a conf", []string{"05-foo.conflist.bak", "05-foo.txt"}, false, "", false},
+		{"shadowed", []string{"05-foo.conflist", "07-bar.conf", "20-baz.conflist"}, false, "found [05-foo.conflist, 07-bar.conf]", false},
+		{"shadowed fatal", []string{"05-foo.conflist"}, true, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook.Reset()
+			dir := t.TempDir()
+			for _, name := range tt.files {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte("{}"), 0644); err != nil {
+					t.Fatalf("Failed to write %s: %v", name, err)
+				}
+			}
+			nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN)
+			nodeConfig.AgentConfig.CNIConfShadowFatal = tt.fatal
+			err := createCNIConf(dir, nodeConfig)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("createCNIConf() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if !strings.Contains(err.Error(), "05-foo.conflist") {
+					t.Errorf("createCNIConf() error = %v, want the shadowing conf named", err)
+				}
+				return
+			}
+
+			var warnings []string
+			for _, entry := range hook.AllEntries() {
+				if entry.Level == logrus.WarnLevel {
+					warnings = append(warnings, entry.Message)
+				}
+			}
+			if tt.wantWarn == "" {
+				if len(warnings) != 0 {
+					t.Errorf("createCNIConf() warned %q, want no warnings", warnings)
+				}
+			} else if len(warnings) != 1 || !strings.Contains(warnings[0], tt.wantWarn) {
+				t.Errorf("createCNIConf() warned %q, want a warning containing %q", warnings, tt.wantWarn)
+			}
+		})
+	}
+}
+
+func Test_createCNIConfPrefix(t *testing.T) {
+	tests := []struct {
+		name      string
+		prefix    string
+		files     []string
+		wantFiles []string
+		wantErr   bool
+	}{
+		{"default", "", nil, []string{"10-flannel.conflist"}, false},
+		{"custom", "90", nil, []string{"90-flannel.conflist"}, false},
+		{"default removed", "90", []string{"10-flannel.conflist"}, []string{"90-flannel.conflist"}, false},
+		{"custom removed", "", []string{"90-flannel.conflist"}, []string{"10-flannel.conflist"}, false},
+		{"others kept", "90", []string{"10-flannel.conflist", "05-foo-flannel.conflist", "20-calico.conflist"}, []string{"05-foo-flannel.conflist", "20-calico.conflist", "90-flannel.conflist"}, false},
+		{"invalid", "9a", []string{"10-flannel.conflist"}, []string{"10-flannel.conflist"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, name := range tt.files {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte("{}"), 0644); err != nil {
+					t.Fatalf("Failed to write %s: %v", name, err)
+				}
+			}
+			nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN)
+			nodeConfig.AgentConfig.CNIConfPrefix = tt.prefix
+			if err := createCNIConf(dir, nodeConfig); (err != nil) != tt.wantErr {
+				t.Fatalf("createCNIConf() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatalf("Failed to read %s: %v", dir, err)
+			}
+			var names []string
+			for _, entry := range entries {
+				names = append(names, entry.Name())
+			}
+			if !reflect.DeepEqual(names, tt.wantFiles) {
+				t.Errorf("createCNIConf() left %q, want %q", names, tt.wantFiles)
+			}
+		})
+	}
+}
+
+func Test_checkClusterCIDROverlap(t *testing.T) {
+	hook := logtest.NewGlobal()
+	oldList, oldAddrs := listInterfaces, interfaceAddrs
+	t.Cleanup(func() {
+		listInterfaces, interfaceAddrs = oldList, oldAddrs
+		logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+	})
+	listInterfaces = func() ([]net.Interface, error) {
+		return []net.Interface{{Name: "lo", Flags: net.FlagLoopback}, {Name: "eth0"}, {Name: "cni0"}, {Name: "flannel.1"}}, nil
+	}
+
+	tests := []struct {
+		name     string
+		cidrs    string
+		addrs    map[string][]string
+		fatal    bool
+		wantWarn string
+		wantErr  bool
+	}{
+		{"no overlap", "10.42.0.0/16", map[string][]string{"eth0": {"192.168.1.10/24"}}, false, "", false},
+		{"node subnet in cluster CIDR", "10.42.0.0/16", map[string][]string{"eth0": {"10.42.5.10/24"}}, false, "eth0 10.42.5.0/24 overlaps 10.42.0.0/16", false},
+		{"cluster CIDR in node subnet", "10.42.0.0/16", map[string][]string{"eth0": {"10.1.2.3/8"}}, false, "eth0 10.0.0.0/8 overlaps 10.42.0.0/16", false},
+		{"overlap fatal", "10.42.0.0/16", map[string][]string{"eth0": {"10.42.5.10/24"}}, true, "", true},
+		{"flannel interfaces skipped", "10.42.0.0/16", map[string][]string{"lo": {"10.42.0.1/8"}, "cni0": {"10.42.0.1/24"}, "flannel.1": {"10.42.0.0/32"}}, true, "", false},
+		{"dual-stack no overlap", "10.42.0.0/16,2001:cafe:42::/56", map[string][]string{"eth0": {"192.168.1.10/24", "2001:db8::10/64", "fe80::1/64"}}, false, "", false},
+		{"dual-stack ipv6 overlap", "10.42.0.0/16,2001:cafe:42::/56", map[string][]string{"eth0": {"192.168.1.10/24", "2001:cafe:42:1::10/64"}}, false, "eth0 2001:cafe:42:1::/64 overlaps 2001:cafe:42::/56", false},
+		{"families compared separately", "2001:cafe:42::/56", map[string][]string{"eth0": {"10.42.5.10/24"}}, true, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook.Reset()
+			interfaceAddrs = func(iface net.Interface) ([]net.Addr, error) {
+				var addrs []net.Addr
+				for _, cidr := range tt.addrs[iface.Name] {
+					ip, ipNet, err := net.ParseCIDR(cidr)
+					if err != nil {
+						return nil, err
+					}
+					addrs = append(addrs, &net.IPNet{IP: ip, Mask: ipNet.Mask})
+				}
+				return addrs, nil
+			}
+			nodeConfig := newTestNodeConfig(t, tt.cidrs, config.FlannelBackendVXLAN)
+			nodeConfig.FlannelCIDROverlapFatal = tt.fatal
+			netMode, err := findNetMode(nodeConfig.AgentConfig.ClusterCIDRs)
+			if err != nil {
+				t.Fatalf("findNetMode() error = %v", err)
+			}
+			err = checkClusterCIDROverlap(nodeConfig, netMode)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkClusterCIDROverlap() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			var warnings []string
+			for _, entry := range hook.AllEntries() {
+				if entry.Level == logrus.WarnLevel {
+					warnings = append(warnings, entry.Message)
+				}
+			}
+			if tt.wantWarn == "" {
+				if len(warnings) != 0 {
+					t.Errorf("checkClusterCIDROverlap() warned %q, want no warnings", warnings)
+				}
+			} else if len(warnings) != 1 || !strings.Contains(warnings[0], tt.wantWarn) {
+				t.Errorf("checkClusterCIDROverlap() warned %q, want a warning containing %q", warnings, tt.wantWarn)
+			}
+		})
+	}
+}
+
+func Test_applyBackendLabel(t *testing.T) {
+	oldUnderlayMTU := underlayMTU
+	oldKernelModuleAvailable := kernelModuleAvailable
+	t.Cleanup(func() {
+		underlayMTU = oldUnderlayMTU
+		kernelModuleAvailable = oldKernelModuleAvailable
+	})
+	underlayMTU = func(*net.Interface, int) (int, error) { return 0, nil }
+	kernelModuleAvailable = func(string) bool { return true }
+	stubKernelModulesLoaded(t)
+
+	tests := []struct {
+		name        string
+		labels      map[string]string
+		wantBackend string
+		wantConfig  string
+		wantErr     bool
+	}{
+		{"fallback", nil, config.FlannelBackendVXLAN, `{"Backend": {"Type": "vxlan"}}`, false},
+		{"other labels", map[string]string{"foo": "bar"}, config.FlannelBackendVXLAN, `{"Backend": {"Type": "vxlan"}}`, false},
+		{"override", map[string]string{FlannelBackendLabel: config.FlannelBackendHostGW}, config.FlannelBackendHostGW, `{"Backend": {"Type": "host-gw"}}`, false},
+		{"invalid", map[string]string{FlannelBackendLabel: "foo"}, config.FlannelBackendVXLAN, `{"Backend": {"Type": "vxlan"}}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN)
+			nodeConfig.AgentConfig.NodeName = "test-node"
+			if err := createFlannelConf(nodeConfig); err != nil {
+				t.Fatalf("createFlannelConf() error = %v", err)
+			}
+			node := newTestNode([]string{"10.42.0.0/24"})
+			node.Labels = tt.labels
+			nodes := fake.NewSimpleClientset(node).CoreV1().Nodes()
+
+			err := applyBackendLabel(context.Background(), logFields(nodeConfig), nodeConfig, nodes)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("applyBackendLabel() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if nodeConfig.FlannelBackend != tt.wantBackend {
+				t.Errorf("applyBackendLabel() backend = %q, want %q", nodeConfig.FlannelBackend, tt.wantBackend)
+			}
+			assertNetConf(t, nodeConfig.FlannelConfFile, tt.wantConfig)
+		})
+	}
+}
+
+func Test_teardownBackend(t *testing.T) {
+	oldDeleteLink := deleteLink
+	oldRunShutdownCommand := runShutdownCommand
+	t.Cleanup(func() {
+		deleteLink = oldDeleteLink
+		runShutdownCommand = oldRunShutdownCommand
+	})
+
+	tests := []struct {
+		name         string
+		backend      string
+		cidrs        string
+		failDelete   string
+		wantDeleted  []string
+		wantCommands []string
+	}{
+		{"vxlan", config.FlannelBackendVXLAN, "10.42.0.0/16", "", []string{"flannel.1"}, nil},
+		{"vxlan dual-stack", config.FlannelBackendVXLAN, "10.42.0.0/16,2001:cafe:42::/56", "", []string{"flannel.1", "flannel-v6.1"}, nil},
+		{"host-gw-vxlan", config.FlannelBackendHostGWVXLAN, "10.42.0.0/16", "", []string{"flannel.1"}, nil},
+		{"vxlan delete failure", config.FlannelBackendVXLAN, "10.42.0.0/16,2001:cafe:42::/56", "flannel.1", []string{"flannel.1", "flannel-v6.1"}, nil},
+		{"wireguard-native", config.FlannelBackendWireguardNative, "10.42.0.0/16", "", []string{"flannel-wg"}, nil},
+		{"ipip", config.FlannelBackendIPIP, "10.42.0.0/16", "", []string{"flannel.ipip"}, nil},
+		{"host-gw", config.FlannelBackendHostGW, "10.42.0.0/16", "", nil, nil},
+		{"tailscale", config.FlannelBackendTailscale, "10.42.0.0/16", "", nil, []string{"tailscale down"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var deleted, commands []string
+			deleteLink = func(name string) error {
+				deleted = append(deleted, name)
+				if name == tt.failDelete {
+					return fmt.Errorf("failed to delete %s", name)
+				}
+				return nil
+			}
+			runShutdownCommand = func(command string) error {
+				commands = append(commands, command)
+				return nil
+			}
+			nodeConfig := newTestNodeConfig(t, tt.cidrs, tt.backend)
+			netMode, err := findNetMode(nodeConfig.AgentConfig.ClusterCIDRs)
+			if err != nil {
+				t.Fatalf("findNetMode() error = %v", err)
+			}
+			teardownBackend(logFields(nodeConfig), nodeConfig, netMode)
+			if !reflect.DeepEqual(deleted, tt.wantDeleted) {
+				t.Errorf("teardownBackend() deleted %v, want %v", deleted, tt.wantDeleted)
+			}
+			if !reflect.DeepEqual(commands, tt.wantCommands) {
+				t.Errorf("teardownBackend() ran %v, want %v", commands, tt.wantCommands)
+			}
+		})
+	}
+}
+
+func Test_validateBackend(t *testing.T) {
+	oldKernelModuleLoaded := kernelModuleLoaded
+	oldKernelModuleAvailable := kernelModuleAvailable
+	oldLookPath := lookPath
+	t.Cleanup(func() {
+		kernelModuleLoaded = oldKernelModuleLoaded
+		kernelModuleAvailable = oldKernelModuleAvailable
+		lookPath = oldLookPath
+	})
+
+	tests := []struct {
+		name      string
+		backend   string
+		available bool
+		wantErr   string
+	}{
+		{"vxlan", config.FlannelBackendVXLAN, true, ""},
+		{"vxlan missing module", config.FlannelBackendVXLAN, false, "the vxlan kernel module is not available"},
+		{"host-gw-vxlan missing module", config.FlannelBackendHostGWVXLAN, false, "the vxlan kernel module is not available"},
+		{"ipip", config.FlannelBackendIPIP, true, ""},
+		{"ipip missing module", config.FlannelBackendIPIP, false, "the ipip kernel module is not available"},
+		{"wireguard-native", config.FlannelBackendWireguardNative, true, ""},
+		{"wireguard-native missing module", config.FlannelBackendWireguardNative, false, "the wireguard kernel module is not available"},
+		{"tailscale", config.FlannelBackendTailscale, true, ""},
+		{"tailscale missing binary", config.FlannelBackendTailscale, false, "the tailscale binary was not found in PATH"},
+		{"host-gw", config.FlannelBackendHostGW, false, ""},
+		{"none", config.FlannelBackendNone, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kernelModuleLoaded = func(string) bool { return tt.available }
+			kernelModuleAvailable = func(string) bool { return tt.available }
+			lookPath = func(file string) (string, error) {
+				if tt.available {
+					return "/usr/bin/" + file, nil
+				}
+				return "", fmt.Errorf("%s: not found", file)
+			}
+			err := validateBackend(newTestNodeConfig(t, "10.42.0.0/16", tt.backend))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validateBackend() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) || !strings.Contains(err.Error(), "'"+tt.backend+"'") {
+				t.Errorf("validateBackend() error = %v, want an error for backend %s containing %q", err, tt.backend, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_validateBackendLoadsModules(t *testing.T) {
+	oldKernelModuleLoaded := kernelModuleLoaded
+	oldKernelModuleAvailable := kernelModuleAvailable
+	oldLoadKernelModule := loadKernelModule
+	t.Cleanup(func() {
+		kernelModuleLoaded = oldKernelModuleLoaded
+		kernelModuleAvailable = oldKernelModuleAvailable
+		loadKernelModule = oldLoadKernelModule
+	})
+	kernelModuleAvailable = func(string) bool { return true }
+
+	tests := []struct {
+		name     string
+		backend  string
+		module   string
+		loadErr  error
+		dryRun   bool
+		wantLoad bool
+		wantErr  string
+	}{
+		{"vxlan", config.FlannelBackendVXLAN, "vxlan", nil, false, true, ""},
+		{"host-gw-vxlan", config.FlannelBackendHostGWVXLAN, "vxlan", nil, false, true, ""},
+		{"ipip", config.FlannelBackendIPIP, "ipip", nil, false, true, ""},
+		{"wireguard-native", config.FlannelBackendWireguardNative, "wireguard", nil, false, true, ""},
+		{"ipip load fails", config.FlannelBackendIPIP, "ipip", fmt.Errorf("exit status 1: modprobe: FATAL: Module ipip not found"), false, true, "the ipip kernel module is not loaded, and loading it failed: exit status 1: modprobe: FATAL: Module ipip not found"},
+		{"wireguard-native load fails", config.FlannelBackendWireguardNative, "wireguard", fmt.Errorf("exit status 1"), false, true, "the wireguard kernel module is not loaded, and loading it failed"},
+		{"dry run", config.FlannelBackendVXLAN, "vxlan", nil, true, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loaded := map[string]bool{}
+			kernelModuleLoaded = func(name string) bool { return loaded[name] }
+			var loads []string
+			loadKernelModule = func(name string) error {
+				loads = append(loads, name)
+				if tt.loadErr != nil {
+					return tt.loadErr
+				}
+				loaded[name] = true
+				return nil
+			}
+			nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", tt.backend)
+			nodeConfig.FlannelDryRun = tt.dryRun
+			err := validateBackend(nodeConfig)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validateBackend() error = %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validateBackend() error = %v, want an error containing %q", err, tt.wantErr)
+			}
+			var wantLoads []string
+			if tt.wantLoad {
+				wantLoads = []string{tt.module}
+			}
+			if !reflect.DeepEqual(loads, wantLoads) {
+				t.Errorf("validateBackend() loaded modules %v, want %v", loads, wantLoads)
+			}
+		})
+	}
+}
+
+func Test_createFlannelConfIPIPDryRun(t *testing.T) {
+	oldKernelModuleLoaded := kernelModuleLoaded
+	oldKernelModuleAvailable := kernelModuleAvailable
+	oldLoadKernelModule := loadKernelModule
+	t.Cleanup(func() {
+		kernelModuleLoaded = oldKernelModuleLoaded
+		kernelModuleAvailable = oldKernelModuleAvailable
+		loadKernelModule = oldLoadKernelModule
+	})
+	kernelModuleLoaded = func(string) bool { return false }
+	kernelModuleAvailable = func(string) bool { return true }
+	loadKernelModule = func(name string) error {
+		t.Errorf("loadKernelModule(%q) called in a dry run", name)
+		return nil
+	}
+
+	nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendIPIP)
+	nodeConfig.FlannelDryRun = true
+	if err := validateBackend(nodeConfig); err != nil {
+		t.Fatalf("validateBackend() error = %v", err)
+	}
+	if err := createFlannelConf(nodeConfig); err != nil {
+		t.Fatalf("createFlannelConf() error = %v", err)
+	}
+	if _, err := os.Stat(nodeConfig.FlannelConfFile); !os.IsNotExist(err) {
+		t.Errorf("createFlannelConf() wrote %s in a dry run: %v", nodeConfig.FlannelConfFile, err)
+	}
+}
+
+func Test_kernelModuleLoaded(t *testing.T) {
+	oldSysModuleDir, oldProcModulesFile := sysModuleDir, procModulesFile
+	t.Cleanup(func() { sysModuleDir, procModulesFile = oldSysModuleDir, oldProcModulesFile })
+	sysModuleDir = t.TempDir()
+	procModulesFile = filepath.Join(t.TempDir(), "modules")
+	if err := os.Mkdir(filepath.Join(sysModuleDir, "vxlan"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	procModules := "ipip 16384 0 - Live 0x0000000000000000\nip_tunnel 32768 1 ipip, Live 0x0000000000000000\n"
+	if err := os.WriteFile(procModulesFile, []byte(procModules), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]bool{
+		"vxlan":     true,
+		"ipip":      true,
+		"ip-tunnel": true,
+		"ip_tunnel": true,
+		"ip":        false,
+		"wireguard": false,
+	} {
+		if got := kernelModuleLoaded(name); got != want {
+			t.Errorf("kernelModuleLoaded(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func Test_PrepareReadyFile(t *testing.T) {
+	oldUnderlayMTU := underlayMTU
+	oldKernelModuleAvailable := kernelModuleAvailable
+	oldDeleteLink := deleteLink
+	t.Cleanup(func() {
+		underlayMTU = oldUnderlayMTU
+		kernelModuleAvailable = oldKernelModuleAvailable
+		deleteLink = oldDeleteLink
+	})
+	underlayMTU = func(*net.Interface, int) (int, error) { return 0, nil }
+	kernelModuleAvailable = func(string) bool { return true }
+	stubKernelModulesLoaded(t)
+	deleteLink = func(string) error { return nil }
+
+	tests := []struct {
+		name    string
+		mtu     int
+		wantErr bool
+	}{
+		{"success", 0, false},
+		{"failure", 100, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN)
+			nodeConfig.AgentConfig.CNIConfDir = t.TempDir()
+			nodeConfig.FlannelMTU = tt.mtu
+			nodeConfig.FlannelReadyFile = filepath.Join(t.TempDir(), "ready")
+			// A ready file left by an earlier run must not survive a failed Prepare
+			if err := os.WriteFile(nodeConfig.FlannelReadyFile, []byte("backend=host-gw\n"), 0644); err != nil {
+				t.Fatalf("Failed to write ready file: %v", err)
+			}
+
+			before := time.Now().UTC().Truncate(time.Second)
+			if err := Prepare(context.Background(), nodeConfig); (err != nil) != tt.wantErr {
+				t.Fatalf("Prepare() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			data, err := os.ReadFile(nodeConfig.FlannelReadyFile)
+			if tt.wantErr {
+				if !os.IsNotExist(err) {
+					t.Errorf("Prepare() failed but left ready file %q", data)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Prepare() did not write the ready file: %v", err)
+			}
+			lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+			if len(lines) != 2 || lines[0] != "backend=vxlan" || !strings.HasPrefix(lines[1], "time=") {
+				t.Fatalf("Ready file = %q, want backend and time", data)
+			}
+			written, err := time.Parse(time.RFC3339, strings.TrimPrefix(lines[1], "time="))
+			if err != nil || written.Before(before) {
+				t.Errorf("Ready file time = %q, want a time no earlier than %v", lines[1], before)
+			}
+
+			teardownBackend(nil, nodeConfig, ipv4)
+			if _, err := os.Stat(nodeConfig.FlannelReadyFile); !os.IsNotExist(err) {
+				t.Errorf("teardownBackend() did not remove the ready file: %v", err)
+			}
+		})
+	}
+}
+
+func Test_Cleanup(t *testing.T) {
+	oldDeleteLink := deleteLink
+	t.Cleanup(func() { deleteLink = oldDeleteLink })
+
+	tests := []struct {
+		name        string
+		override    bool
+		disableCNI  bool
+		failDelete  string
+		wantRemoved []string
+		wantKept    []string
+	}{
+		{"generated", false, false, "", []string{"10-flannel.conflist", "05-flannel.conflist", "net-conf.json", "wgkey", "ready"}, []string{"20-other.conflist"}},
+		{"conf override", true, false, "", []string{"10-flannel.conflist", "wgkey"}, []string{"net-conf.json"}},
+		{"cni conf disabled", false, true, "", []string{"net-conf.json"}, []string{"10-flannel.conflist", "05-flannel.conflist"}},
+		{"delete failure", false, false, "flannel.1", []string{"10-flannel.conflist", "net-conf.json"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var deleted []string
+			deleteLink = func(name string) error {
+				deleted = append(deleted, name)
+				if name == tt.failDelete {
+					return fmt.Errorf("failed to delete %s", name)
+				}
+				return nil
+			}
+			nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN)
+			nodeConfig.FlannelConfOverride = tt.override
+			nodeConfig.AgentConfig.DisableCNIConf = tt.disableCNI
+			nodeConfig.AgentConfig.CNIConfDir = t.TempDir()
+			nodeConfig.FlannelReadyFile = filepath.Join(t.TempDir(), "ready")
+			path := func(name string) string {
+				switch {
+				case strings.HasSuffix(name, ".conflist"):
+					return filepath.Join(nodeConfig.AgentConfig.CNIConfDir, name)
+				case name == "ready":
+					return nodeConfig.FlannelReadyFile
+				default:
+					return filepath.Join(filepath.Dir(nodeConfig.FlannelConfFile), name)
+				}
+			}
+			for _, name := range []string{"10-flannel.conflist", "05-flannel.conflist", "20-other.conflist", "net-conf.json", "wgkey", "ready"} {
+				if err := os.WriteFile(path(name), []byte("{}"), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			Cleanup(nodeConfig)
+			for _, name := range tt.wantRemoved {
+				if _, err := os.Stat(path(name)); !os.IsNotExist(err) {
+					t.Errorf("Cleanup() did not remove %s", name)
+				}
+			}
+			for _, name := range tt.wantKept {
+				if _, err := os.Stat(path(name)); err != nil {
+					t.Errorf("Cleanup() removed %s", name)
+				}
+			}
+			wantDeleted := []string{"flannel.1", "flannel-v6.1", "flannel.ipip", "flannel-wg", "flannel-wg-v6", "cni0"}
+			if !reflect.DeepEqual(deleted, wantDeleted) {
+				t.Errorf("Cleanup() deleted %v, want %v", deleted, wantDeleted)
+			}
+		})
+	}
+}
+
+func Test_PrepareCNIConfDirWritable(t *testing.T) {
+	oldUnderlayMTU := underlayMTU
+	oldKernelModuleAvailable := kernelModuleAvailable
+	t.Cleanup(func() {
+		underlayMTU = oldUnderlayMTU
+		kernelModuleAvailable = oldKernelModuleAvailable
+	})
+	underlayMTU = func(*net.Interface, int) (int, error) { return 0, nil }
+	kernelModuleAvailable = func(string) bool { return true }
+	stubKernelModulesLoaded(t)
+
+	tests := []struct {
+		name     string
+		setup    func(t *testing.T) string
+		rootSkip bool
+		wantErr  bool
+	}{
+		{
+			name:  "writable",
+			setup: func(t *testing.T) string { return t.TempDir() },
+		},
+		{
+			name:  "missing",
+			setup: func(t *testing.T) string { return filepath.Join(t.TempDir(), "cni", "net.d") },
+		},
+		{
+			name: "read-only",
+			setup: func(t *testing.T) string {
+				dir := t.TempDir()
+				if err := os.Chmod(dir, 0555); err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { os.Chmod(dir, 0755) })
+				return dir
+			},
+			rootSkip: true,
+			wantErr:  true,
+		},
+		{
+			name: "file in the way",
+			setup: func(t *testing.T) string {
+				dir := filepath.Join(t.TempDir(), "net.d")
+				if err := os.WriteFile(dir, nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+				return dir
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.rootSkip && os.Geteuid() == 0 {
+				t.Skip("root can write to read-only directories")
+			}
+			nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN)
+			nodeConfig.AgentConfig.CNIConfDir = tt.setup(t)
+			err := Prepare(context.Background(), nodeConfig)
+			if tt.wantErr {
+				want := fmt.Sprintf("CNI conf dir %q is not writable", nodeConfig.AgentConfig.CNIConfDir)
+				if err == nil || !strings.HasPrefix(err.Error(), want) {
+					t.Fatalf("Prepare() error = %v, want %s", err, want)
+				}
+				if _, err := os.Stat(nodeConfig.FlannelConfFile); !os.IsNotExist(err) {
+					t.Errorf("Prepare() wrote %s", nodeConfig.FlannelConfFile)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Prepare() error = %v", err)
+			}
+			entries, err := os.ReadDir(nodeConfig.AgentConfig.CNIConfDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 || entries[0].Name() != "10-flannel.conflist" {
+				t.Errorf("CNI conf dir contains %v, want only 10-flannel.conflist", entries)
+			}
+		})
+	}
+}
+
+func Test_validateBackendNFTables(t *testing.T) {
+	oldKernelModuleAvailable := kernelModuleAvailable
+	oldLookPath := lookPath
+	t.Cleanup(func() {
+		kernelModuleAvailable = oldKernelModuleAvailable
+		lookPath = oldLookPath
+	})
+
+	tests := []struct {
+		name    string
+		module  bool
+		binary  bool
+		wantErr string
+	}{
+		{"supported", true, true, ""},
+		{"missing module", false, true, "nftables mode requires the nf_tables kernel module"},
+		{"missing binary", true, false, "nftables mode requires the nft binary"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kernelModuleAvailable = func(name string) bool { return name != "nf_tables" || tt.module }
+			lookPath = func(file string) (string, error) {
+				if tt.binary {
+					return "/usr/sbin/" + file, nil
+				}
+				return "", fmt.Errorf("%s: not found", file)
+			}
+			nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN)
+			nodeConfig.FlannelNFTables = true
+			err := validateBackend(nodeConfig)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("validateBackend() error = %v", err)
+				}
+				if err := createFlannelConf(nodeConfig); err != nil {
+					t.Fatalf("createFlannelConf() error = %v", err)
+				}
+				assertNetConf(t, nodeConfig.FlannelConfFile, `{"EnableNFTables": true}`)
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validateBackend() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_createCNIConfHostPortRange(t *testing.T) {
+	tests := []struct {
+		name       string
+		portRange  string
+		nftables   bool
+		wantConfig []string
+		wantErr    bool
+	}{
+		{"unrestricted", "", false, []string{"\"type\":\"portmap\""}, false},
+		{"range", "30000-32767", false, []string{"\"type\":\"portmap\"", `"conditionsV4":\["-m","multiport","--dports","30000:32767"\]`, `"conditionsV6":\["-m","multiport","--dports","30000:32767"\]`}, false},
+		{"single port", "8080", false, []string{`"conditionsV4":\["-m","multiport","--dports","8080:8080"\]`}, false},
+		{"reversed", "32767-30000", false, nil, true},
+		{"too large", "30000-70000", false, nil, true},
+		{"zero", "0-1024", false, nil, true},
+		{"not a range", "high", false, nil, true},
+		{"nftables", "30000-32767", true, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN)
+			nodeConfig.AgentConfig.CNIHostPortRange = tt.portRange
+			nodeConfig.FlannelNFTables = tt.nftables
+			if err := createCNIConf(dir, nodeConfig); (err != nil) != tt.wantErr {
+				t.Fatalf("createCNIConf() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			p := filepath.Join(dir, "10-flannel.conflist")
+			assertFileContains(t, p, tt.wantConfig)
+			assertValidJSON(t, p)
+			if tt.portRange == "" {
+				assertFileNotContains(t, p, []string{"conditionsV4"})
+			}
+		})
+	}
+}
+
+func Test_validateBackendVXLANGBP(t *testing.T) {
+	oldKernelModuleAvailable := kernelModuleAvailable
+	oldVXLANGBPSupported := vxlanGBPSupported
+	t.Cleanup(func() {
+		kernelModuleAvailable = oldKernelModuleAvailable
+		vxlanGBPSupported = oldVXLANGBPSupported
+	})
+	kernelModuleAvailable = func(string) bool { return true }
+	stubKernelModulesLoaded(t)
+
+	tests := []struct {
+		name      string
+		backend   string
+		supported bool
+		wantErr   string
+	}{
+		{"vxlan", config.FlannelBackendVXLAN, true, ""},
+		{"host-gw-vxlan", config.FlannelBackendHostGWVXLAN, true, ""},
+		{"old kernel", config.FlannelBackendVXLAN, false, "vxlan GBP requires Linux 4.0 or newer"},
+		{"host-gw", config.FlannelBackendHostGW, true, "can only be used with the vxlan or host-gw-vxlan backend, not 'host-gw'"},
+		{"wireguard-native", config.FlannelBackendWireguardNative, true, "not 'wireguard-native'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vxlanGBPSupported = func() bool { return tt.supported }
+			nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", tt.backend)
+			nodeConfig.FlannelVXLANGBP = true
+			err := validateBackend(nodeConfig)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("validateBackend() error = %v", err)
+				}
+				if err := createFlannelConf(nodeConfig); err != nil {
+					t.Fatalf("createFlannelConf() error = %v", err)
+				}
+				assertNetConf(t, nodeConfig.FlannelConfFile, `{"Backend": {"GBP": true}}`)
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validateBackend() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_createCNIConfSinglePlugin(t *testing.T) {
+	tests := []struct {
+		name         string
+		singlePlugin bool
+		portRange    string
+		wantFile     string
+		wantConfig   []string
+		denyConfig   []string
+		wantErr      bool
+	}{
+		{"conflist", false, "", "10-flannel.conflist", []string{`"plugins":\[`, `"type":"flannel"`, `"type":"portmap"`}, nil, false},
+		{"single plugin", true, "", "10-flannel.conf", []string{`"name": "cbr0"`, `"cniVersion": "1.0.0"`, `"type": "flannel"`, `"delegate": \{`}, []string{"plugins", "portmap", "bandwidth"}, false},
+		{"single plugin with host port range", true, "30000-32767", "", nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			// A conf in the other format is stale, and is removed
+			for _, name := range []string{"10-flannel.conflist", "10-flannel.conf"} {
+				if name != tt.wantFile {
+					if err := os.WriteFile(filepath.Join(dir, name), []byte("{}"), 0644); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN)
+			nodeConfig.AgentConfig.CNIConfSinglePlugin = tt.singlePlugin
+			nodeConfig.AgentConfig.CNIHostPortRange = tt.portRange
+			if err := createCNIConf(dir, nodeConfig); (err != nil) != tt.wantErr {
+				t.Fatalf("createCNIConf() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 || entries[0].Name() != tt.wantFile {
+				t.Fatalf("createCNIConf() left %v, want only %s", entries, tt.wantFile)
+			}
+			p := filepath.Join(dir, tt.wantFile)
+			assertFileContains(t, p, tt.wantConfig)
+			assertFileNotContains(t, p, tt.denyConfig)
+			assertValidJSON(t, p)
+		})
+	}
+}
+
+// stubKernelModulesLoaded reports every kernel module as loaded for the duration of the test, so that
+// no module is loaded on the host.
+func stubKernelModulesLoaded(t *testing.T) {
+	oldKernelModuleLoaded := kernelModuleLoaded
+	t.Cleanup(func() { kernelModuleLoaded = oldKernelModuleLoaded })
+	kernelModuleLoaded = func(string) bool { return true }
+}
@@ -1,13 +1,37 @@
 package flannel
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
 	"net"
 	"os"
+	"path/filepath"
+	"reflect"
 	"regexp"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/flannel-io/flannel/pkg/backend"
 	"github.com/k3s-io/k3s/pkg/daemons/config"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/utils/ptr"
 )
 
 func stringToCIDR(s string) []*net.IPNet {
@@ -47,6 +71,767 @@ func Test_findNetMode(t *testing.T) {
 	}
 }
 
+func Test_podCIDRsAssigned(t *testing.T) {
+	tests := []struct {
+		name     string
+		podCIDRs []string
+		netMode  int
+		want     bool
+	}{
+		{"ipv4 only assigned", []string{"10.42.0.0/24"}, ipv4, true},
+		{"ipv4 only unassigned", nil, ipv4, false},
+		{"ipv6 only assigned", []string{"2001:cafe:42::/64"}, ipv6, true},
+		{"ipv6 only with ipv4 cidr", []string{"10.42.0.0/24"}, ipv6, false},
+		{"dual-stack assigned", []string{"10.42.0.0/24", "2001:cafe:42::/64"}, ipv4 + ipv6, true},
+		{"dual-stack missing ipv6", []string{"10.42.0.0/24"}, ipv4 + ipv6, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := podCIDRsAssigned(newTestNode(tt.podCIDRs), tt.netMode); got != tt.want {
+				t.Errorf("podCIDRsAssigned() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_waitForPodCIDRDualStack(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	node := newTestNode([]string{"10.42.0.0/24"})
+	nodes := fake.NewSimpleClientset(node).CoreV1().Nodes()
+
+	errCh := make(chan error, 1)
+	var podCIDRs []string
+	name := node.Name
+	go func() {
+		var err error
+		podCIDRs, err = waitForPodCIDR(ctx, name, nodes, ipv4+ipv6, 0)
+		errCh <- err
+	}()
+
+	select {
+	case err := <-errCh:
+		t.Fatalf("waitForPodCIDR() returned before the IPv6 PodCIDR was assigned: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	updated := newTestNode([]string{"10.42.0.0/24", "2001:cafe:42::/64"})
+	if _, err := nodes.Update(ctx, updated, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Failed to update node: %v", err)
+	}
+	if err := <-errCh; err != nil {
+		t.Errorf("waitForPodCIDR() error = %v", err)
+	}
+	if want := []string{"10.42.0.0/24", "2001:cafe:42::/64"}; !reflect.DeepEqual(podCIDRs, want) {
+		t.Errorf("waitForPodCIDR() = %v, want %v", podCIDRs, want)
+	}
+}
+
+func Test_checkPodCIDRFamilies(t *testing.T) {
+	tests := []struct {
+		name     string
+		podCIDRs []string
+		netMode  int
+		wantErr  bool
+	}{
+		{"ipv4 cluster ipv4 PodCIDR", []string{"10.42.0.0/24"}, ipv4, false},
+		{"ipv6 cluster ipv6 PodCIDR", []string{"2001:cafe:42::/64"}, ipv6, false},
+		{"dual-stack cluster dual-stack PodCIDRs", []string{"10.42.0.0/24", "2001:cafe:42::/64"}, ipv4 + ipv6, false},
+		{"dual-stack cluster ipv4 PodCIDR", []string{"10.42.0.0/24"}, ipv4 + ipv6, false},
+		{"dual-stack cluster ipv6 PodCIDR", []string{"2001:cafe:42::/64"}, ipv4 + ipv6, false},
+		{"no PodCIDR", nil, ipv4, false},
+		{"ipv4 cluster ipv6 PodCIDR", []string{"2001:cafe:42::/64"}, ipv4, true},
+		{"ipv4 cluster dual-stack PodCIDRs", []string{"10.42.0.0/24", "2001:cafe:42::/64"}, ipv4, true},
+		{"ipv6 cluster ipv4 PodCIDR", []string{"10.42.0.0/24"}, ipv6, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkPodCIDRFamilies("test-node", tt.podCIDRs, tt.netMode); (err != nil) != tt.wantErr {
+				t.Errorf("checkPodCIDRFamilies() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_waitForPodCIDRFamilyMismatch(t *testing.T) {
+	t.Run("already assigned", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		node := newTestNode([]string{"10.42.0.0/24", "2001:cafe:42::/64"})
+		_, err := waitForPodCIDR(ctx, node.Name, fake.NewSimpleClientset(node).CoreV1().Nodes(), ipv4, 0)
+		if err == nil || !strings.Contains(err.Error(), "is IPv6, but the cluster CIDRs are IPv4-only") {
+			t.Errorf("waitForPodCIDR() error = %v, want PodCIDR family error", err)
+		}
+	})
+
+	t.Run("assigned while waiting", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		node := newTestNode(nil)
+		nodes := fake.NewSimpleClientset(node).CoreV1().Nodes()
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := waitForPodCIDR(ctx, node.Name, nodes, ipv4, 0)
+			errCh <- err
+		}()
+		time.Sleep(100 * time.Millisecond)
+		if _, err := nodes.Update(ctx, newTestNode([]string{"2001:cafe:42::/64"}), metav1.UpdateOptions{}); err != nil {
+			t.Fatalf("Failed to update node: %v", err)
+		}
+		if err := <-errCh; err == nil || !strings.Contains(err.Error(), "is IPv6, but the cluster CIDRs are IPv4-only") {
+			t.Errorf("waitForPodCIDR() error = %v, want PodCIDR family error", err)
+		}
+	})
+}
+
+func Test_waitForPodCIDRResult(t *testing.T) {
+	tests := []struct {
+		name    string
+		node    *v1.Node
+		netMode int
+		want    []string
+	}{
+		{"single-stack", newTestNode([]string{"10.42.0.0/24"}), ipv4, []string{"10.42.0.0/24"}},
+		{"dual-stack", newTestNode([]string{"10.42.0.0/24", "2001:cafe:42::/64"}), ipv4 + ipv6, []string{"10.42.0.0/24", "2001:cafe:42::/64"}},
+		{"legacy PodCIDR only", &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "test-node"}, Spec: v1.NodeSpec{PodCIDR: "10.42.1.0/24"}}, ipv4, []string{"10.42.1.0/24"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			got, err := waitForPodCIDR(ctx, tt.node.Name, fake.NewSimpleClientset(tt.node).CoreV1().Nodes(), tt.netMode, 0)
+			if err != nil {
+				t.Fatalf("waitForPodCIDR() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("waitForPodCIDR() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_validatePodCIDRs(t *testing.T) {
+	tests := []struct {
+		name         string
+		podCIDRs     []string
+		clusterCIDRs string
+		wantErr      string
+	}{
+		{"in range", []string{"10.42.1.0/24"}, "10.42.0.0/16", ""},
+		{"dual-stack in range", []string{"10.42.1.0/24", "2001:cafe:42:1::/64"}, "10.42.0.0/16,2001:cafe:42::/56", ""},
+		{"dual-stack reversed families", []string{"2001:cafe:42:1::/64", "10.42.1.0/24"}, "10.42.0.0/16,2001:cafe:42::/56", ""},
+		{"equal to cluster CIDR", []string{"10.42.0.0/16"}, "10.42.0.0/16", ""},
+		{"out of range", []string{"10.43.1.0/24"}, "10.42.0.0/16", "PodCIDR 10.43.1.0/24 is not within the IPv4 cluster CIDR 10.42.0.0/16"},
+		{"larger than cluster CIDR", []string{"10.42.0.0/15"}, "10.42.0.0/16", "PodCIDR 10.42.0.0/15 is not within the IPv4 cluster CIDR 10.42.0.0/16"},
+		{"ipv6 out of range", []string{"10.42.1.0/24", "2001:beef::/64"}, "10.42.0.0/16,2001:cafe:42::/56", "PodCIDR 2001:beef::/64 is not within the IPv6 cluster CIDR 2001:cafe:42::/56"},
+		{"family mismatch", []string{"2001:cafe:42:1::/64"}, "10.42.0.0/16", "PodCIDR 2001:cafe:42:1::/64 is IPv6, but no IPv6 cluster CIDR is configured"},
+		{"invalid", []string{"10.42.1.0"}, "10.42.0.0/16", "invalid PodCIDR 10.42.1.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validatePodCIDRs(tt.podCIDRs, stringToCIDR(tt.clusterCIDRs))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validatePodCIDRs() error = %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validatePodCIDRs() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_nodeNetworks(t *testing.T) {
+	tests := []struct {
+		name         string
+		podCIDRs     []string
+		clusterCIDRs string
+		want         string
+	}{
+		{"no PodCIDRs", nil, "10.42.0.0/16", "10.42.0.0/16"},
+		{"within cluster CIDR", []string{"10.42.0.0/24", "10.42.1.0/24"}, "10.42.0.0/16", "10.42.0.0/16"},
+		{"outside cluster CIDR", []string{"10.244.0.0/24", "10.244.1.0/24"}, "10.42.0.0/16", "10.244.0.0/23"},
+		{"single outside cluster CIDR", []string{"10.244.3.0/24"}, "10.42.0.0/16", "10.244.3.0/24"},
+		{"partly outside cluster CIDR", []string{"10.42.0.0/24", "10.43.0.0/24"}, "10.42.0.0/16", "10.42.0.0/15"},
+		{"dual-stack ipv6 outside", []string{"10.42.0.0/24", "2001:beef::/64", "10.42.1.0/24", "2001:beef:0:1::/64"}, "10.42.0.0/16,2001:cafe:42::/56", "10.42.0.0/16,2001:beef::/63"},
+		{"dual-stack ipv4 outside", []string{"10.244.0.0/24", "2001:cafe:42::/64"}, "10.42.0.0/16,2001:cafe:42::/56", "10.244.0.0/24,2001:cafe:42::/56"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := nodeNetworks(tt.podCIDRs, stringToCIDR(tt.clusterCIDRs))
+			if err != nil {
+				t.Fatalf("nodeNetworks() error = %v", err)
+			}
+			if want := stringToCIDR(tt.want); !reflect.DeepEqual(got, want) {
+				t.Errorf("nodeNetworks() = %v, want %v", got, want)
+			}
+		})
+	}
+	if _, err := nodeNetworks([]string{"10.42.1.0"}, stringToCIDR("10.42.0.0/16")); err == nil {
+		t.Errorf("nodeNetworks() with an invalid PodCIDR did not return an error")
+	}
+}
+
+func Test_reconcileNetworks(t *testing.T) {
+	tests := []struct {
+		name        string
+		podCIDRs    []string
+		wantNetwork string
+	}{
+		{"config derived", []string{"10.42.0.0/24", "10.42.1.0/24"}, "10.42.0.0/16"},
+		{"spec derived", []string{"10.244.0.0/24", "10.244.1.0/24"}, "10.244.0.0/23"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN)
+			nodeConfig.FlannelNetworkFromNodes = true
+			if err := createFlannelConf(nodeConfig); err != nil {
+				t.Fatalf("createFlannelConf() error = %v", err)
+			}
+			var objects []runtime.Object
+			for i, podCIDR := range tt.podCIDRs {
+				node := newTestNode([]string{podCIDR})
+				node.Name = fmt.Sprintf("node-%d", i)
+				objects = append(objects, node)
+			}
+			nodes := fake.NewSimpleClientset(objects...).CoreV1().Nodes()
+
+			if err := reconcileNetworks(context.Background(), logFields(nodeConfig), nodeConfig, nodes); err != nil {
+				t.Fatalf("reconcileNetworks() error = %v", err)
+			}
+			assertNetConf(t, nodeConfig.FlannelConfFile, `{"Network": "`+tt.wantNetwork+`"}`)
+			if err := validatePodCIDRs(tt.podCIDRs, flannelNetworks(nodeConfig)); err != nil {
+				t.Errorf("validatePodCIDRs() with the reconciled networks error = %v", err)
+			}
+		})
+	}
+}
+
+func Test_parsePublicIP(t *testing.T) {
+	tests := []struct {
+		name     string
+		publicIP string
+		want     net.IP
+		wantErr  bool
+	}{
+		{"unset", "", nil, false},
+		{"ipv4", "203.0.113.10", net.ParseIP("203.0.113.10"), false},
+		{"ipv6", "2001:db8::10", net.ParseIP("2001:db8::10"), false},
+		{"invalid", "203.0.113", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePublicIP(tt.publicIP)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePublicIP() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("parsePublicIP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_setPublicIP(t *testing.T) {
+	ifaceAddr, ifaceV6Addr := net.ParseIP("10.0.0.5").To4(), net.ParseIP("fd00::5")
+	tests := []struct {
+		name      string
+		publicIP  net.IP
+		wantExt   net.IP
+		wantExtV6 net.IP
+	}{
+		{"unset", nil, ifaceAddr, ifaceV6Addr},
+		{"ipv4", net.ParseIP("203.0.113.10"), net.ParseIP("203.0.113.10"), ifaceV6Addr},
+		{"ipv6", net.ParseIP("2001:db8::10"), ifaceAddr, net.ParseIP("2001:db8::10")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			extIface := &backend.ExternalInterface{ExtAddr: ifaceAddr, ExtV6Addr: ifaceV6Addr}
+			setPublicIP(extIface, tt.publicIP)
+			if !extIface.ExtAddr.Equal(tt.wantExt) || !extIface.ExtV6Addr.Equal(tt.wantExtV6) {
+				t.Errorf("setPublicIP() ExtAddr = %v, ExtV6Addr = %v, want %v, %v", extIface.ExtAddr, extIface.ExtV6Addr, tt.wantExt, tt.wantExtV6)
+			}
+		})
+	}
+}
+
+func Test_waitForPodCIDRTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	node := newTestNode(nil)
+	nodes := fake.NewSimpleClientset(node).CoreV1().Nodes()
+
+	_, err := waitForPodCIDR(ctx, node.Name, nodes, ipv4, 100*time.Millisecond)
+	if err == nil {
+		t.Fatal("waitForPodCIDR() expected timeout error, got nil")
+	}
+	if !strings.Contains(err.Error(), "timed out after 100ms waiting for PodCIDR on node test-node") {
+		t.Errorf("waitForPodCIDR() error = %v, want timeout error", err)
+	}
+	if !errors.Is(err, ErrPodCIDRTimeout) {
+		t.Errorf("waitForPodCIDR() error = %v, want ErrPodCIDRTimeout", err)
+	}
+}
+
+func Test_waitForPodCIDRDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	node := newTestNode(nil)
+	nodes := fake.NewSimpleClientset(node).CoreV1().Nodes()
+
+	start := time.Now()
+	_, err := waitForPodCIDR(ctx, node.Name, nodes, ipv4, time.Minute)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("waitForPodCIDR() returned after %v, want it to return at the caller's deadline", elapsed)
+	}
+	if !errors.Is(err, ErrPodCIDRTimeout) {
+		t.Errorf("waitForPodCIDR() error = %v, want ErrPodCIDRTimeout", err)
+	}
+}
+
+func Test_waitForPodCIDRCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	node := newTestNode(nil)
+	nodes := fake.NewSimpleClientset(node).CoreV1().Nodes()
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := waitForPodCIDR(ctx, node.Name, nodes, ipv4, time.Minute)
+		errCh <- err
+	}()
+	cancel()
+
+	select {
+	case err := <-errCh:
+		if err == nil || errors.Is(err, ErrPodCIDRTimeout) {
+			t.Errorf("waitForPodCIDR() error = %v, want a cancellation error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waitForPodCIDR() did not return after the context was cancelled")
+	}
+}
+
+func Test_waitForPodCIDRWatchClosed(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	node := newTestNode(nil)
+	client := fake.NewSimpleClientset(node)
+	watchers := []*watch.FakeWatcher{watch.NewFake(), watch.NewFake()}
+	var watchCalls atomic.Int32
+	client.PrependWatchReactor("nodes", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		if i := int(watchCalls.Add(1)) - 1; i < len(watchers) {
+			return true, watchers[i], nil
+		}
+		return false, nil, nil
+	})
+
+	errCh := make(chan error, 1)
+	var podCIDRs []string
+	go func() {
+		var err error
+		podCIDRs, err = waitForPodCIDR(ctx, node.Name, client.CoreV1().Nodes(), ipv4, 0)
+		errCh <- err
+	}()
+
+	// Close the first watch before any PodCIDR is assigned, and deliver the node on the second one.
+	waitForWatchCalls(t, &watchCalls, 1)
+	watchers[0].Stop()
+	waitForWatchCalls(t, &watchCalls, 2)
+	watchers[1].Modify(newTestNode([]string{"10.42.0.0/24"}))
+
+	if err := <-errCh; err != nil {
+		t.Errorf("waitForPodCIDR() error = %v", err)
+	}
+	if want := []string{"10.42.0.0/24"}; !reflect.DeepEqual(podCIDRs, want) {
+		t.Errorf("waitForPodCIDR() = %v, want %v", podCIDRs, want)
+	}
+}
+
+func Test_waitForPodCIDRAlreadyAssigned(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	node := newTestNode([]string{"10.42.0.0/24"})
+	client := fake.NewSimpleClientset(node)
+	var watchCalls atomic.Int32
+	client.PrependWatchReactor("nodes", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		watchCalls.Add(1)
+		return false, nil, nil
+	})
+
+	if _, err := waitForPodCIDR(ctx, node.Name, client.CoreV1().Nodes(), ipv4, 0); err != nil {
+		t.Fatalf("waitForPodCIDR() error = %v", err)
+	}
+	if n := watchCalls.Load(); n != 0 {
+		t.Errorf("waitForPodCIDR() started %d watches, want 0", n)
+	}
+}
+
+// waitForWatchCalls blocks until the watch reactor has been called at least n times.
+func waitForWatchCalls(t *testing.T, calls *atomic.Int32, n int32) {
+	t.Helper()
+	for i := 0; calls.Load() < n; i++ {
+		if i > 500 {
+			t.Fatalf("Timed out waiting for %d watch calls", n)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// newTestNode returns a node with the given PodCIDRs assigned.
+func newTestNode(podCIDRs []string) *v1.Node {
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "test-node"}}
+	if len(podCIDRs) > 0 {
+		node.Spec.PodCIDR = podCIDRs[0]
+		node.Spec.PodCIDRs = podCIDRs
+	}
+	return node
+}
+
+// setFlannelRestartPolicy shortens the flannel restart policy for the duration of the test.
+func setFlannelRestartPolicy(t *testing.T, limit int, window time.Duration) {
+	backoff, maxBackoff, oldWindow, oldLimit := flannelRestartBackoff, flannelRestartMaxBackoff, flannelRestartWindow, flannelRestartLimit
+	t.Cleanup(func() {
+		flannelRestartBackoff, flannelRestartMaxBackoff, flannelRestartWindow, flannelRestartLimit = backoff, maxBackoff, oldWindow, oldLimit
+	})
+	flannelRestartBackoff = time.Millisecond
+	flannelRestartMaxBackoff = 4 * time.Millisecond
+	flannelRestartWindow = window
+	flannelRestartLimit = limit
+}
+
+func Test_superviseFlannel(t *testing.T) {
+	tests := []struct {
+		name      string
+		failures  int
+		limit     int
+		wantCalls int32
+		wantErr   bool
+	}{
+		{"clean exit", 0, 3, 1, false},
+		{"recovers after failures", 2, 3, 3, false},
+		{"gives up after repeated failures", 10, 3, 3, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlannelRestartPolicy(t, tt.limit, time.Minute)
+			var calls int32
+			err := superviseFlannel(context.Background(), nil, func(ctx context.Context) error {
+				if atomic.AddInt32(&calls, 1) <= int32(tt.failures) {
+					return errors.New("transient failure")
+				}
+				return nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("superviseFlannel() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("superviseFlannel() ran flannel %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func Test_validateAnnotationPrefix(t *testing.T) {
+	tests := []struct {
+		prefix  string
+		wantErr bool
+	}{
+		{"", false},
+		{"flannel.alpha.coreos.com", false},
+		{"flannel-storage.example.com", false},
+		{"flannel.alpha.coreos.com/storage", true},
+		{"Flannel.example.com", true},
+		{"flannel_storage.example.com", true},
+		{"-flannel.example.com", true},
+		{strings.Repeat("a", 254), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			nodeConfig := &config.Node{FlannelAnnotationPrefix: tt.prefix}
+			if err := validateAnnotationPrefix(nodeConfig); (err != nil) != tt.wantErr {
+				t.Errorf("validateAnnotationPrefix() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_ExternalIPAnnotations(t *testing.T) {
+	ipv4, ipv6 := ExternalIPAnnotations(&config.Node{})
+	if ipv4 != FlannelExternalIPv4Annotation || ipv6 != FlannelExternalIPv6Annotation {
+		t.Errorf("ExternalIPAnnotations() = %s, %s, want %s, %s", ipv4, ipv6, FlannelExternalIPv4Annotation, FlannelExternalIPv6Annotation)
+	}
+	ipv4, ipv6 = ExternalIPAnnotations(&config.Node{FlannelAnnotationPrefix: "flannel.storage.example.com"})
+	if ipv4 != "flannel.storage.example.com/public-ip-overwrite" || ipv6 != "flannel.storage.example.com/public-ipv6-overwrite" {
+		t.Errorf("ExternalIPAnnotations() = %s, %s, want annotations with the configured prefix", ipv4, ipv6)
+	}
+}
+
+func Test_ensureSubnetFileDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		subnetFile string
+		wantDir    string
+		wantErr    bool
+	}{
+		{"default", "", "", false},
+		{"existing dir", filepath.Join(dir, "subnet.env"), dir, false},
+		{"missing dir", filepath.Join(dir, "run", "flannel", "subnet.env"), filepath.Join(dir, "run", "flannel"), false},
+		{"relative", filepath.Join("run", "subnet.env"), "", true},
+		{"file in the way", filepath.Join(dir, "file", "subnet.env"), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodeConfig := &config.Node{FlannelSubnetFile: tt.subnetFile}
+			if err := ensureSubnetFileDir(nodeConfig); (err != nil) != tt.wantErr {
+				t.Fatalf("ensureSubnetFileDir() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantDir != "" {
+				if info, err := os.Stat(tt.wantDir); err != nil || !info.IsDir() {
+					t.Errorf("ensureSubnetFileDir() did not create %s: %v", tt.wantDir, err)
+				}
+			}
+		})
+	}
+}
+
+func Test_flannelRestartDelay(t *testing.T) {
+	backoff, maxBackoff, jitter, rnd := flannelRestartBackoff, flannelRestartMaxBackoff, flannelRestartJitter, flannelRestartRand
+	t.Cleanup(func() {
+		flannelRestartBackoff, flannelRestartMaxBackoff, flannelRestartJitter, flannelRestartRand = backoff, maxBackoff, jitter, rnd
+	})
+	flannelRestartBackoff = time.Second
+	flannelRestartMaxBackoff = 30 * time.Second
+
+	tests := []struct {
+		name     string
+		jitter   float64
+		rand     float64
+		failures int
+		want     time.Duration
+	}{
+		{"no jitter", 0, 0.5, 1, time.Second},
+		{"no jitter backs off", 0, 0.5, 3, 4 * time.Second},
+		{"no jitter capped", 0, 0.5, 10, 30 * time.Second},
+		{"minimum jitter", 0.2, 0, 1, time.Second},
+		{"half jitter", 0.2, 0.5, 1, 1100 * time.Millisecond},
+		{"half jitter backs off", 0.2, 0.5, 3, 4400 * time.Millisecond},
+		{"jitter applied after cap", 0.2, 0.5, 10, 33 * time.Second},
+		{"shift overflow capped", 0, 0.5, 100, 30 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flannelRestartJitter = tt.jitter
+			flannelRestartRand = func() float64 { return tt.rand }
+			if got := flannelRestartDelay(tt.failures); got != tt.want {
+				t.Errorf("flannelRestartDelay(%d) = %v, want %v", tt.failures, got, tt.want)
+			}
+		})
+	}
+
+	t.Run("random jitter stays within bounds", func(t *testing.T) {
+		flannelRestartJitter = 0.2
+		flannelRestartRand = rnd
+		seen := map[time.Duration]bool{}
+		for i := 0; i < 100; i++ {
+			for failures := 1; failures <= 6; failures++ {
+				base := min(flannelRestartBackoff<<(failures-1), flannelRestartMaxBackoff)
+				got := flannelRestartDelay(failures)
+				if got < base || got >= base+base/5 {
+					t.Fatalf("flannelRestartDelay(%d) = %v, want within [%v, %v)", failures, got, base, base+base/5)
+				}
+				if failures == 1 {
+					seen[got] = true
+				}
+			}
+		}
+		if len(seen) < 2 {
+			t.Errorf("flannelRestartDelay(1) returned the same delay every time, want jittered delays")
+		}
+	})
+}
+
+func Test_superviseFlannelWindow(t *testing.T) {
+	// Failures spread out over more than the window should never exhaust the limit
+	setFlannelRestartPolicy(t, 2, time.Nanosecond)
+	var calls int32
+	err := superviseFlannel(context.Background(), nil, func(ctx context.Context) error {
+		if atomic.AddInt32(&calls, 1) <= 5 {
+			time.Sleep(time.Millisecond)
+			return errors.New("transient failure")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("superviseFlannel() error = %v", err)
+	}
+	if calls != 6 {
+		t.Errorf("superviseFlannel() ran flannel %d times, want 6", calls)
+	}
+}
+
+func Test_RunWithRetry(t *testing.T) {
+	tests := []struct {
+		name      string
+		timeouts  int
+		err       error
+		wantCalls int
+		wantErr   error
+	}{
+		{"success", 0, nil, 1, nil},
+		{"recovers after timeouts", 2, nil, 3, nil},
+		{"gives up after the retry limit", 10, nil, 4, ErrPodCIDRTimeout},
+		{"other error is not retried", 0, errors.New("invalid config"), 1, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlannelRestartPolicy(t, 100, time.Minute)
+			oldRunFlannelSetup, oldRetryLimit := runFlannelSetup, flannelSetupRetryLimit
+			t.Cleanup(func() { runFlannelSetup, flannelSetupRetryLimit = oldRunFlannelSetup, oldRetryLimit })
+			flannelSetupRetryLimit = 3
+
+			calls := 0
+			runFlannelSetup = func(context.Context, *config.Node, typedcorev1.NodeInterface) error {
+				calls++
+				if tt.err != nil {
+					return tt.err
+				}
+				if calls <= tt.timeouts {
+					return ErrPodCIDRTimeout
+				}
+				return nil
+			}
+			err := RunWithRetry(context.Background(), newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN), nil)
+			switch {
+			case tt.err != nil:
+				if !errors.Is(err, tt.err) {
+					t.Errorf("RunWithRetry() error = %v, want %v", err, tt.err)
+				}
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("RunWithRetry() error = %v, want %v", err, tt.wantErr)
+				}
+			case err != nil:
+				t.Errorf("RunWithRetry() error = %v", err)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("RunWithRetry() ran the flannel setup %d times, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func Test_RunWithRetryCancel(t *testing.T) {
+	setFlannelRestartPolicy(t, 100, time.Minute)
+	flannelRestartBackoff = time.Hour
+	flannelRestartMaxBackoff = time.Hour
+	oldRunFlannelSetup := runFlannelSetup
+	t.Cleanup(func() { runFlannelSetup = oldRunFlannelSetup })
+	started := make(chan struct{}, 1)
+	runFlannelSetup = func(context.Context, *config.Node, typedcorev1.NodeInterface) error {
+		started <- struct{}{}
+		return ErrPodCIDRTimeout
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- RunWithRetry(ctx, newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN), nil)
+	}()
+	<-started
+	cancel()
+	select {
+	case err := <-errs:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("RunWithRetry() error = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunWithRetry() did not return after the context was cancelled")
+	}
+}
+
+func Test_superviseFlannelCancel(t *testing.T) {
+	setFlannelRestartPolicy(t, 100, time.Minute)
+	flannelRestartBackoff = time.Hour
+	flannelRestartMaxBackoff = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- superviseFlannel(ctx, nil, func(ctx context.Context) error {
+			return errors.New("transient failure")
+		})
+	}()
+	cancel()
+	select {
+	case err := <-errs:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("superviseFlannel() error = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("superviseFlannel() did not return after the context was cancelled")
+	}
+}
+
+func Test_flannelRunnerKubeConfig(t *testing.T) {
+	oldStartFlannel := startFlannel
+	t.Cleanup(func() { startFlannel = oldStartFlannel })
+
+	kubeConfig := filepath.Join(t.TempDir(), "flannel.kubeconfig")
+	if err := os.WriteFile(kubeConfig, []byte("apiVersion: v1\nkind: Config\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name           string
+		kubeConfig     string
+		apiURL         string
+		wantKubeConfig string
+		wantAPIURL     string
+		wantErr        bool
+	}{
+		{"default", "", "", "/var/lib/rancher/k3s/agent/kubelet.kubeconfig", "", false},
+		{"kubeconfig", kubeConfig, "", kubeConfig, "", false},
+		{"kubeconfig and apiserver URL", kubeConfig, "https://10.0.0.1:6443", kubeConfig, "https://10.0.0.1:6443", false},
+		{"apiserver URL", "", "https://10.0.0.1:6443", "/var/lib/rancher/k3s/agent/kubelet.kubeconfig", "https://10.0.0.1:6443", false},
+		{"missing kubeconfig", filepath.Join(t.TempDir(), "missing"), "", "", "", true},
+		{"invalid apiserver URL", "", "10.0.0.1:6443", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN)
+			nodeConfig.AgentConfig.KubeConfigKubelet = "/var/lib/rancher/k3s/agent/kubelet.kubeconfig"
+			nodeConfig.FlannelKubeConfig = tt.kubeConfig
+			nodeConfig.FlannelKubeAPIURL = tt.apiURL
+			if err := validateFlannelKubeConfig(nodeConfig); (err != nil) != tt.wantErr {
+				t.Fatalf("validateFlannelKubeConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			var gotAPIURL, gotKubeConfig string
+			startFlannel = func(ctx context.Context, iface *net.Interface, flannelConf, subnetFile, kubeAPIURL, kubeConfigFile, annotationPrefix string, ipMasq, ipv6Masq bool, publicIP net.IP, netMode int) error {
+				gotAPIURL, gotKubeConfig = kubeAPIURL, kubeConfigFile
+				return nil
+			}
+			if err := flannelRunner(nodeConfig, nil, nil, ipv4, nil)(context.Background()); err != nil {
+				t.Fatalf("flannelRunner() error = %v", err)
+			}
+			if gotKubeConfig != tt.wantKubeConfig || gotAPIURL != tt.wantAPIURL {
+				t.Errorf("flannel started with kubeconfig %q and apiserver URL %q, want %q and %q", gotKubeConfig, gotAPIURL, tt.wantKubeConfig, tt.wantAPIURL)
+			}
+		})
+	}
+}
+
 func Test_createFlannelConf(t *testing.T) {
 	tests := []struct {
 		name       string
@@ -81,3 +866,857 @@ func Test_createFlannelConf(t *testing.T) {
 		})
 	}
 }
+
+func Test_createFlannelConfIPv6Only(t *testing.T) {
+	nodeConfig := newTestNodeConfig(t, "2001:cafe:42::/56", config.FlannelBackendVXLAN)
+	if err := createFlannelConf(nodeConfig); err != nil {
+		t.Fatalf("createFlannelConf() error = %v", err)
+	}
+	assertNetConf(t, nodeConfig.FlannelConfFile, `{"IPv6Network": "2001:cafe:42::/56", "EnableIPv6": true, "EnableIPv4": false, "Network": null}`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	node := newTestNode([]string{"2001:cafe:42::/64"})
+	nodes := fake.NewSimpleClientset(node).CoreV1().Nodes()
+	if _, err := waitForPodCIDR(ctx, node.Name, nodes, ipv6, 0); err != nil {
+		t.Errorf("waitForPodCIDR() error = %v", err)
+	}
+}
+
+func Test_createFlannelConfVXLANDirectRouting(t *testing.T) {
+	tests := []struct {
+		name          string
+		directRouting bool
+		wantConfig    string
+	}{
+		{"disabled", false, `{"Backend": {"Type": "vxlan", "DirectRouting": null}}`},
+		{"enabled", true, `{"Backend": {"Type": "vxlan", "DirectRouting": true}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN)
+			nodeConfig.FlannelDirectRouting = tt.directRouting
+			if err := createFlannelConf(nodeConfig); err != nil {
+				t.Fatalf("createFlannelConf() error = %v", err)
+			}
+			assertNetConf(t, nodeConfig.FlannelConfFile, tt.wantConfig)
+		})
+	}
+}
+
+func Test_createFlannelConfVXLANPorts(t *testing.T) {
+	tests := []struct {
+		name       string
+		vni        int
+		port       int
+		wantConfig []string
+		denyConfig []string
+		wantErr    bool
+	}{
+		{"defaults", 0, 0, nil, []string{"\"VNI\"", "\"Port\""}, false},
+		{"vni override", 42, 0, []string{"\"VNI\": 42,"}, []string{"\"Port\""}, false},
+		{"vni and port override", 42, 4789, []string{"\"VNI\": 42,", "\"Port\": 4789,"}, nil, false},
+		{"invalid vni", 1 << 24, 0, nil, nil, true},
+		{"invalid port", 0, 65536, nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN)
+			nodeConfig.FlannelVNI = tt.vni
+			nodeConfig.FlannelPort = tt.port
+			if err := createFlannelConf(nodeConfig); (err != nil) != tt.wantErr {
+				t.Fatalf("createFlannelConf() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			assertFileContains(t, nodeConfig.FlannelConfFile, tt.wantConfig)
+			assertFileNotContains(t, nodeConfig.FlannelConfFile, tt.denyConfig)
+			assertValidJSON(t, nodeConfig.FlannelConfFile)
+		})
+	}
+}
+
+func Test_createFlannelConfMTU(t *testing.T) {
+	tests := []struct {
+		name       string
+		cidrs      string
+		backend    string
+		mtu        int
+		underlay   int
+		wantConfig string
+		wantErr    bool
+	}{
+		{"vxlan undetected", "10.42.0.0/16", config.FlannelBackendVXLAN, 0, 0, `{"Backend": {"MTU": null}}`, false},
+		{"vxlan detected", "10.42.0.0/16", config.FlannelBackendVXLAN, 0, 9000, `{"Backend": {"MTU": 8950}}`, false},
+		{"vxlan detected ipv6", "2001:cafe:22::/56", config.FlannelBackendVXLAN, 0, 1500, `{"Backend": {"MTU": 1430}}`, false},
+		{"vxlan detected too small", "10.42.0.0/16", config.FlannelBackendVXLAN, 0, 576, `{"Backend": {"MTU": null}}`, false},
+		{"vxlan override", "10.42.0.0/16", config.FlannelBackendVXLAN, 1400, 9000, `{"Backend": {"MTU": 1400}}`, false},
+		{"wireguard-native detected", "10.42.0.0/16", config.FlannelBackendWireguardNative, 0, 1400, `{"Backend": {"MTU": 1340}}`, false},
+		{"wireguard-native detected dual-stack", "10.42.0.0/16,2001:cafe:22::/56", config.FlannelBackendWireguardNative, 0, 1500, `{"Backend": {"MTU": 1420}}`, false},
+		{"wireguard-native override", "10.42.0.0/16", config.FlannelBackendWireguardNative, 1380, 1500, `{"Backend": {"Type": "wireguard", "MTU": 1380}}`, false},
+		{"host-gw not detected", "10.42.0.0/16", config.FlannelBackendHostGW, 0, 1500, `{"Backend": {"MTU": null}}`, false},
+		{"too small", "10.42.0.0/16", config.FlannelBackendVXLAN, 100, 1500, "", true},
+		{"too large", "10.42.0.0/16", config.FlannelBackendVXLAN, 65000, 1500, "", true},
+		{"unsupported backend", "10.42.0.0/16", config.FlannelBackendHostGW, 1400, 1500, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldUnderlayMTU := underlayMTU
+			t.Cleanup(func() { underlayMTU = oldUnderlayMTU })
+			underlayMTU = func(*net.Interface, int) (int, error) {
+				if tt.underlay == 0 {
+					return 0, errors.New("no default gateway")
+				}
+				return tt.underlay, nil
+			}
+
+			nodeConfig := newTestNodeConfig(t, tt.cidrs, tt.backend)
+			nodeConfig.FlannelMTU = tt.mtu
+			if err := createFlannelConf(nodeConfig); (err != nil) != tt.wantErr {
+				t.Fatalf("createFlannelConf() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			assertNetConf(t, nodeConfig.FlannelConfFile, tt.wantConfig)
+		})
+	}
+}
+
+func Test_backendMTUOverhead(t *testing.T) {
+	tests := []struct {
+		name     string
+		backend  string
+		netMode  int
+		want     int
+		wantSets bool
+	}{
+		{"vxlan ipv4", config.FlannelBackendVXLAN, ipv4, 50, true},
+		{"vxlan ipv6", config.FlannelBackendVXLAN, ipv6, 70, true},
+		{"vxlan dual-stack", config.FlannelBackendVXLAN, ipv4 + ipv6, 70, true},
+		{"wireguard-native ipv4", config.FlannelBackendWireguardNative, ipv4, 60, true},
+		{"wireguard-native ipv6", config.FlannelBackendWireguardNative, ipv6, 80, true},
+		{"host-gw", config.FlannelBackendHostGW, ipv4, 0, false},
+		{"ipip", config.FlannelBackendIPIP, ipv4, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := backendMTUOverhead(tt.backend, tt.netMode)
+			if got != tt.want || ok != tt.wantSets {
+				t.Errorf("backendMTUOverhead() = %d, %v, want %d, %v", got, ok, tt.want, tt.wantSets)
+			}
+		})
+	}
+}
+
+func Test_createFlannelConfSubnetLease(t *testing.T) {
+	tests := []struct {
+		name       string
+		cidrs      string
+		subnetLen  int
+		subnetMin  string
+		subnetMax  string
+		wantConfig string
+		wantErr    bool
+	}{
+		{"unset", "10.42.0.0/16", 0, "", "", `{"SubnetLen": null, "SubnetMin": null, "SubnetMax": null}`, false},
+		{"subnet len", "10.42.0.0/16", 23, "", "", `{"SubnetLen": 23, "SubnetMin": null, "SubnetMax": null}`, false},
+		{"all set", "10.42.0.0/16", 25, "10.42.1.0", "10.42.200.128", `{"SubnetLen": 25, "SubnetMin": "10.42.1.0", "SubnetMax": "10.42.200.128"}`, false},
+		{"dual-stack", "10.42.0.0/16,2001:cafe:22::/56", 26, "", "", `{"SubnetLen": 26}`, false},
+		{"subnet len too small", "10.42.0.0/16", 16, "", "", "", true},
+		{"subnet len too large", "10.42.0.0/16", 31, "", "", "", true},
+		{"subnet min outside cluster CIDR", "10.42.0.0/16", 0, "10.43.0.0", "", "", true},
+		{"subnet max not an IPv4 address", "10.42.0.0/16", 0, "", "2001:cafe:22::", "", true},
+		{"subnet min not aligned", "10.42.0.0/16", 24, "10.42.1.128", "", "", true},
+		{"ipv6-only", "2001:cafe:22::/56", 64, "", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodeConfig := newTestNodeConfig(t, tt.cidrs, config.FlannelBackendVXLAN)
+			nodeConfig.FlannelSubnetLen = tt.subnetLen
+			nodeConfig.FlannelSubnetMin = tt.subnetMin
+			nodeConfig.FlannelSubnetMax = tt.subnetMax
+			if err := createFlannelConf(nodeConfig); (err != nil) != tt.wantErr {
+				t.Fatalf("createFlannelConf() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			assertNetConf(t, nodeConfig.FlannelConfFile, tt.wantConfig)
+		})
+	}
+}
+
+func Test_createFlannelConfWireguardNative(t *testing.T) {
+	tests := []struct {
+		name       string
+		cidrs      string
+		listenPort int
+		keepalive  int
+		wantConfig string
+		wantErr    bool
+	}{
+		{"defaults", "10.42.0.0/16", 0, 0, `{"Backend": {"Type": "wireguard", "PersistentKeepaliveInterval": 25, "Mode": "separate", "ListenPort": null, "ListenPortV6": null}}`, false},
+		{"listen port", "10.42.0.0/16", 51830, 0, `{"Backend": {"Type": "wireguard", "ListenPort": 51830, "ListenPortV6": null}}`, false},
+		{"keepalive", "10.42.0.0/16", 0, 10, `{"Backend": {"PersistentKeepaliveInterval": 10}}`, false},
+		{"listen port and keepalive", "10.42.0.0/16", 51830, 10, `{"Backend": {"ListenPort": 51830, "PersistentKeepaliveInterval": 10}}`, false},
+		{"dual-stack defaults", "10.42.0.0/16,2001:cafe:22::/56", 0, 0, `{"Backend": {"ListenPort": null, "ListenPortV6": null}}`, false},
+		{"dual-stack listen port", "10.42.0.0/16,2001:cafe:22::/56", 51821, 0, `{"Backend": {"ListenPort": 51821, "ListenPortV6": 51822}}`, false},
+		{"ipv6-only listen port", "2001:cafe:22::/56", 51830, 0, `{"Backend": {"ListenPortV6": 51830}}`, false},
+		{"invalid listen port", "10.42.0.0/16", 70000, 0, "", true},
+		{"dual-stack listen port without a next port", "10.42.0.0/16,2001:cafe:22::/56", 65535, 0, "", true},
+		{"invalid keepalive", "10.42.0.0/16", 0, -1, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodeConfig := newTestNodeConfig(t, tt.cidrs, config.FlannelBackendWireguardNative)
+			nodeConfig.FlannelWireguardPort = tt.listenPort
+			nodeConfig.FlannelWireguardKeepalive = tt.keepalive
+			if err := createFlannelConf(nodeConfig); (err != nil) != tt.wantErr {
+				t.Fatalf("createFlannelConf() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			assertNetConf(t, nodeConfig.FlannelConfFile, tt.wantConfig)
+		})
+	}
+}
+
+func Test_setupWireguardKey(t *testing.T) {
+	t.Setenv(wireguardKeyFileEnv, "")
+	nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendWireguardNative)
+	keyFile := filepath.Join(filepath.Dir(nodeConfig.FlannelConfFile), wireguardKeyFileName)
+
+	if err := setupWireguardKey(nodeConfig); err != nil {
+		t.Fatalf("setupWireguardKey() error = %v", err)
+	}
+	firstKey, err := os.ReadFile(keyFile)
+	if err != nil {
+		t.Fatalf("Failed to read wireguard private key: %v", err)
+	}
+	info, err := os.Stat(keyFile)
+	if err != nil {
+		t.Fatalf("Failed to stat wireguard private key: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Wireguard private key has mode %v, want 0600", info.Mode().Perm())
+	}
+	if got := os.Getenv(wireguardKeyFileEnv); got != keyFile {
+		t.Errorf("%s = %q, want %q", wireguardKeyFileEnv, got, keyFile)
+	}
+
+	if err := setupWireguardKey(nodeConfig); err != nil {
+		t.Fatalf("setupWireguardKey() second run error = %v", err)
+	}
+	secondKey, err := os.ReadFile(keyFile)
+	if err != nil {
+		t.Fatalf("Failed to read wireguard private key: %v", err)
+	}
+	if string(firstKey) != string(secondKey) {
+		t.Errorf("Wireguard private key was regenerated on second run")
+	}
+}
+
+func Test_setupWireguardKeyRuntimeDir(t *testing.T) {
+	t.Setenv(wireguardKeyFileEnv, "")
+	nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendWireguardNative)
+	nodeConfig.FlannelRuntimeDir = filepath.Join(t.TempDir(), "flannel")
+	keyFile := filepath.Join(nodeConfig.FlannelRuntimeDir, wireguardKeyFileName)
+
+	if err := setupWireguardKey(nodeConfig); err != nil {
+		t.Fatalf("setupWireguardKey() error = %v", err)
+	}
+	if _, err := os.Stat(keyFile); err != nil {
+		t.Errorf("Wireguard private key not written to the runtime dir: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(nodeConfig.FlannelConfFile), wireguardKeyFileName)); !os.IsNotExist(err) {
+		t.Errorf("Wireguard private key written next to the flannel config: %v", err)
+	}
+	if got := os.Getenv(wireguardKeyFileEnv); got != keyFile {
+		t.Errorf("%s = %q, want %q", wireguardKeyFileEnv, got, keyFile)
+	}
+}
+
+func Test_createFlannelConfIPIP(t *testing.T) {
+	tests := []struct {
+		name          string
+		directRouting bool
+		wantConfig    string
+	}{
+		{"default", false, `{"Backend": {"Type": "ipip", "DirectRouting": false}}`},
+		{"direct routing", true, `{"Backend": {"Type": "ipip", "DirectRouting": true}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendIPIP)
+			nodeConfig.FlannelDirectRouting = tt.directRouting
+			if err := createFlannelConf(nodeConfig); err != nil {
+				t.Fatalf("createFlannelConf() error = %v", err)
+			}
+			assertNetConf(t, nodeConfig.FlannelConfFile, tt.wantConfig)
+		})
+	}
+}
+
+func Test_createFlannelConfCustomBackend(t *testing.T) {
+	tests := []struct {
+		name          string
+		backendConfig string
+		wantConfig    string
+		wantErr       bool
+	}{
+		{"valid", `{"Type":"udp","Port":8285}`, `{"Network": "10.42.0.0/16", "Backend": {"Type": "udp", "Port": 8285}}`, false},
+		{"no config", "", "", true},
+		{"not json", `udp`, "", true},
+		{"not an object", `["udp"]`, "", true},
+		{"null", `null`, "", true},
+		{"no type", `{"Port":8285}`, "", true},
+		{"empty type", `{"Type":""}`, "", true},
+		{"type not a string", `{"Type":1}`, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", "udp")
+			nodeConfig.FlannelBackendConfig = tt.backendConfig
+			if err := createFlannelConf(nodeConfig); (err != nil) != tt.wantErr {
+				t.Fatalf("createFlannelConf() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			assertNetConf(t, nodeConfig.FlannelConfFile, tt.wantConfig)
+		})
+	}
+}
+
+func Test_createFlannelConfNetConfExtra(t *testing.T) {
+	nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN)
+	nodeConfig.FlannelNetConfExtra = map[string]interface{}{
+		"EnableNFTables": true,
+		"SubnetLen":      26,
+		"Network":        "10.0.0.0/8",
+		"backend":        map[string]interface{}{"Type": "host-gw"},
+	}
+	if err := createFlannelConf(nodeConfig); err != nil {
+		t.Fatalf("createFlannelConf() error = %v", err)
+	}
+	assertValidJSON(t, nodeConfig.FlannelConfFile)
+
+	data, err := os.ReadFile(nodeConfig.FlannelConfFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["EnableNFTables"] != true || got["SubnetLen"] != float64(26) {
+		t.Errorf("Extra keys were not merged into the flannel config: %s", data)
+	}
+	if got["Network"] != "10.42.0.0/16" {
+		t.Errorf("Network = %v, want the generated 10.42.0.0/16", got["Network"])
+	}
+	if backend, _ := got["Backend"].(map[string]interface{}); backend["Type"] != "vxlan" {
+		t.Errorf("Backend = %v, want the generated vxlan backend", got["Backend"])
+	}
+	if _, ok := got["backend"]; ok {
+		t.Errorf("Extra key backend was merged, but conflicts with the generated Backend")
+	}
+
+	nodeConfig.FlannelNetConfExtra = map[string]interface{}{"Invalid": math.Inf(1)}
+	if err := createFlannelConf(nodeConfig); err == nil {
+		t.Errorf("createFlannelConf() with an invalid extra value did not return an error")
+	}
+}
+
+// newTestNodeConfig returns a node config for the given cluster CIDRs and flannel backend,
+// with the flannel config file placed in a temporary directory.
+func newTestNodeConfig(t *testing.T, cidrs, backend string) *config.Node {
+	var agent = config.Agent{}
+	agent.ClusterCIDR = stringToCIDR(cidrs)[0]
+	agent.ClusterCIDRs = stringToCIDR(cidrs)
+	return &config.Node{
+		FlannelBackend:  backend,
+		FlannelConfFile: filepath.Join(t.TempDir(), "net-conf.json"),
+		AgentConfig:     agent,
+	}
+}
+
+// assertValidJSON checks that the file content parses as JSON.
+func assertValidJSON(t *testing.T, path string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Something went wrong when reading the config file %s: %v", path, err)
+	}
+	if !json.Valid(data) {
+		t.Errorf("Config file %s is not valid JSON: %s", path, data)
+	}
+}
+
+// assertNetConf checks the flannel conf against want, a JSON object of the expected fields: each key
+// of want must have the same value in the conf, objects are compared the same way key by key, and a
+// null value means that the key must not be present. Keys that are not in want are not checked.
+func assertNetConf(t *testing.T, path, want string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Something went wrong when reading the config file %s: %v", path, err)
+	}
+	var gotConf, wantConf map[string]interface{}
+	if err := json.Unmarshal(data, &gotConf); err != nil {
+		t.Fatalf("Config file %s is not a JSON object: %v", path, err)
+	}
+	if err := json.Unmarshal([]byte(want), &wantConf); err != nil {
+		t.Fatalf("Expected config %s is not a JSON object: %v", want, err)
+	}
+	compareNetConf(t, "", gotConf, wantConf)
+}
+
+func compareNetConf(t *testing.T, prefix string, got, want map[string]interface{}) {
+	t.Helper()
+	for key, wantValue := range want {
+		gotValue, ok := got[key]
+		switch wantObject, isObject := wantValue.(map[string]interface{}); {
+		case wantValue == nil:
+			if ok {
+				t.Errorf("Config is wrong, %s%s should not be present, got %v", prefix, key, gotValue)
+			}
+		case !ok:
+			t.Errorf("Config is wrong, %s%s is not present", prefix, key)
+		case isObject:
+			gotObject, ok := gotValue.(map[string]interface{})
+			if !ok {
+				t.Errorf("Config is wrong, %s%s = %v, want an object", prefix, key, gotValue)
+				continue
+			}
+			compareNetConf(t, prefix+key+".", gotObject, wantObject)
+		case !reflect.DeepEqual(gotValue, wantValue):
+			t.Errorf("Config is wrong, %s%s = %v, want %v", prefix, key, gotValue, wantValue)
+		}
+	}
+}
+
+// assertFileNotContains checks that none of the given regular expressions match the file content.
+func assertFileNotContains(t *testing.T, path string, denyConfig []string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Something went wrong when reading the config file %s: %v", path, err)
+	}
+	for _, config := range denyConfig {
+		if isExist, _ := regexp.Match(config, data); isExist {
+			t.Errorf("Config is wrong, %s should not be present", config)
+		}
+	}
+}
+
+// assertFileContains checks that each of the given regular expressions matches the file content.
+func assertFileContains(t *testing.T, path string, wantConfig []string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Something went wrong when reading the config file %s: %v", path, err)
+	}
+	for _, config := range wantConfig {
+		isExist, _ := regexp.Match(config, data)
+		if !isExist {
+			t.Errorf("Config is wrong, %s is not present", config)
+		}
+	}
+}
+
+func Test_logFields(t *testing.T) {
+	hook := logtest.NewGlobal()
+	t.Cleanup(func() { logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks)) })
+	level := logrus.GetLevel()
+	t.Cleanup(func() { logrus.SetLevel(level) })
+	logrus.SetLevel(logrus.DebugLevel)
+
+	// findEntry returns the first log entry with the given message prefix
+	findEntry := func(prefix string) *logrus.Entry {
+		for _, entry := range hook.AllEntries() {
+			if strings.HasPrefix(entry.Message, prefix) {
+				return entry
+			}
+		}
+		t.Fatalf("No log entry starting with %q", prefix)
+		return nil
+	}
+	assertFields := func(entry *logrus.Entry, want logrus.Fields) {
+		t.Helper()
+		for k, v := range want {
+			if entry.Data[k] != v {
+				t.Errorf("Log entry %q field %s = %v, want %v", entry.Message, k, entry.Data[k], v)
+			}
+		}
+	}
+
+	nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendHostGW)
+	nodeConfig.AgentConfig.NodeName = "test-node"
+	nodeConfig.FlannelIface = &net.Interface{Name: "eth1"}
+	if err := createFlannelConf(nodeConfig); err != nil {
+		t.Fatalf("createFlannelConf() error = %v", err)
+	}
+	wantFields := logrus.Fields{"node": "test-node", "backend": "host-gw", "iface": "eth1"}
+	assertFields(findEntry("Creating the flannel configuration for backend host-gw"), wantFields)
+
+	setFlannelRestartPolicy(t, 2, time.Minute)
+	superviseFlannel(context.Background(), logFields(nodeConfig), func(ctx context.Context) error {
+		return errors.New("transient failure")
+	})
+	assertFields(findEntry("flannel exited: transient failure; restarting in"), wantFields)
+
+	node := newTestNode([]string{"10.42.0.0/24", "2001:cafe:42::/64"})
+	if _, err := waitForPodCIDR(context.Background(), node.Name, fake.NewSimpleClientset(node).CoreV1().Nodes(), ipv4+ipv6, 0); err != nil {
+		t.Fatalf("waitForPodCIDR() error = %v", err)
+	}
+	assertFields(findEntry("Flannel found PodCIDR assigned for node test-node"), logrus.Fields{"node": "test-node", "podCIDR": "10.42.0.0/24,2001:cafe:42::/64"})
+}
+
+func Test_backendNone(t *testing.T) {
+	cniDir := t.TempDir()
+	nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendNone)
+	nodeConfig.AgentConfig.CNIConfDir = cniDir
+	nodeConfig.AgentConfig.FlannelCniConfFile = filepath.Join(t.TempDir(), "placeholder.conflist")
+	if err := os.WriteFile(nodeConfig.AgentConfig.FlannelCniConfFile, []byte(`{"name":"placeholder"}`), 0644); err != nil {
+		t.Fatalf("Failed to write CNI conf: %v", err)
+	}
+
+	if err := Prepare(context.Background(), nodeConfig); err != nil {
+		t.Fatalf("Prepare() error = %v", err)
+	}
+	if _, err := os.Stat(nodeConfig.FlannelConfFile); !os.IsNotExist(err) {
+		t.Errorf("Prepare() wrote a flannel net-conf for the none backend")
+	}
+	assertFileContains(t, filepath.Join(cniDir, "10-flannel.conflist"), []string{"\"name\":\"placeholder\""})
+
+	// Without a CNI conf dir, nothing is written
+	nodeConfig = newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendNone)
+	if err := Prepare(context.Background(), nodeConfig); err != nil {
+		t.Fatalf("Prepare() error = %v", err)
+	}
+	if _, err := os.Stat(nodeConfig.FlannelConfFile); !os.IsNotExist(err) {
+		t.Errorf("Prepare() wrote a flannel net-conf for the none backend")
+	}
+
+	// Run must return without waiting for a PodCIDR or starting flannel
+	client := fake.NewSimpleClientset()
+	if err := Run(context.Background(), nodeConfig, client.CoreV1().Nodes()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if actions := client.Actions(); len(actions) != 0 {
+		t.Errorf("Run() made %d API calls for the none backend, want 0", len(actions))
+	}
+}
+
+func Test_nodeBackend(t *testing.T) {
+	tests := []struct {
+		name    string
+		label   *string
+		want    string
+		wantErr bool
+	}{
+		{"no label", nil, config.FlannelBackendVXLAN, false},
+		{"same backend", ptr.To(config.FlannelBackendVXLAN), config.FlannelBackendVXLAN, false},
+		{"override", ptr.To(config.FlannelBackendHostGW), config.FlannelBackendHostGW, false},
+		{"wireguard override", ptr.To(config.FlannelBackendWireguardNative), config.FlannelBackendWireguardNative, false},
+		{"none", ptr.To(config.FlannelBackendNone), "", true},
+		{"tailscale", ptr.To(config.FlannelBackendTailscale), "", true},
+		{"unknown", ptr.To("wireguard"), "", true},
+		{"empty", ptr.To(""), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := newTestNode([]string{"10.42.0.0/24"})
+			if tt.label != nil {
+				node.Labels = map[string]string{FlannelBackendLabel: *tt.label}
+			}
+			got, err := nodeBackend(node, config.FlannelBackendVXLAN)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("nodeBackend() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("nodeBackend() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_annotateBackend(t *testing.T) {
+	node := newTestNode([]string{"10.42.0.0/24"})
+	node.Annotations = map[string]string{"other": "value"}
+	client := fake.NewSimpleClientset(node)
+
+	// Fail the first update with a conflict, as if the node had been updated concurrently
+	var updates int
+	client.PrependReactor("update", "nodes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		updates++
+		if updates == 1 {
+			return true, nil, apierrors.NewConflict(schema.GroupResource{Resource: "nodes"}, node.Name, errors.New("conflict"))
+		}
+		return false, nil, nil
+	})
+
+	if err := annotateBackend(context.Background(), client.CoreV1().Nodes(), node.Name, config.FlannelBackendWireguardNative); err != nil {
+		t.Fatalf("annotateBackend() error = %v", err)
+	}
+	if updates != 2 {
+		t.Errorf("annotateBackend() updated the node %d times, want 2", updates)
+	}
+	got, err := client.CoreV1().Nodes().Get(context.Background(), node.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get node: %v", err)
+	}
+	if got.Annotations[FlannelBackendAnnotation] != config.FlannelBackendWireguardNative || got.Annotations["other"] != "value" {
+		t.Errorf("Node annotations = %v, want %s=%s and the existing annotations", got.Annotations, FlannelBackendAnnotation, config.FlannelBackendWireguardNative)
+	}
+
+	// An annotation that is already set is left alone
+	if err := annotateBackend(context.Background(), client.CoreV1().Nodes(), node.Name, config.FlannelBackendWireguardNative); err != nil {
+		t.Fatalf("annotateBackend() error = %v", err)
+	}
+	if updates != 2 {
+		t.Errorf("annotateBackend() updated the node again with the annotation already set")
+	}
+}
+
+func Test_annotateWireguardKey(t *testing.T) {
+	for _, backend := range []string{config.FlannelBackendWireguardNative, config.FlannelBackendVXLAN, config.FlannelBackendHostGW} {
+		t.Run(backend, func(t *testing.T) {
+			t.Setenv(wireguardKeyFileEnv, "")
+			nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", backend)
+			nodeConfig.AgentConfig.NodeName = "test-node"
+			if err := setupWireguardKey(nodeConfig); err != nil {
+				t.Fatalf("setupWireguardKey() error = %v", err)
+			}
+			data, err := os.ReadFile(wireguardKeyFile(nodeConfig))
+			if err != nil {
+				t.Fatalf("Failed to read wireguard private key: %v", err)
+			}
+			key, err := wgtypes.ParseKey(string(data))
+			if err != nil {
+				t.Fatalf("Failed to parse wireguard private key: %v", err)
+			}
+
+			client := fake.NewSimpleClientset(newTestNode([]string{"10.42.0.0/24"}))
+			if err := annotateWireguardKey(context.Background(), client.CoreV1().Nodes(), nodeConfig); err != nil {
+				t.Fatalf("annotateWireguardKey() error = %v", err)
+			}
+			node, err := client.CoreV1().Nodes().Get(context.Background(), "test-node", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("Failed to get node: %v", err)
+			}
+			got, ok := node.Annotations[FlannelWireguardKeyAnnotation]
+			if backend != config.FlannelBackendWireguardNative {
+				if ok {
+					t.Errorf("annotateWireguardKey() set %s=%s for backend %s", FlannelWireguardKeyAnnotation, got, backend)
+				}
+				return
+			}
+			if want := key.PublicKey().String(); got != want {
+				t.Errorf("%s = %q, want %q", FlannelWireguardKeyAnnotation, got, want)
+			}
+		})
+	}
+}
+
+func Test_createCNIConfEmptyDir(t *testing.T) {
+	hook := logtest.NewGlobal()
+	t.Cleanup(func() { logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks)) })
+
+	tests := []struct {
+		name     string
+		disabled bool
+		required bool
+		backend  string
+		wantWarn bool
+		wantErr  bool
+	}{
+		{"empty dir", false, false, config.FlannelBackendVXLAN, true, false},
+		{"empty dir required", false, true, config.FlannelBackendVXLAN, false, true},
+		{"conf disabled", true, true, config.FlannelBackendVXLAN, false, false},
+		{"none backend", false, false, config.FlannelBackendNone, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook.Reset()
+			nodeConfig := &config.Node{FlannelBackend: tt.backend, NoFlannel: tt.backend == config.FlannelBackendNone}
+			nodeConfig.AgentConfig.DisableCNIConf = tt.disabled
+			nodeConfig.AgentConfig.CNIConfDirRequired = tt.required
+			if err := createCNIConf("", nodeConfig); (err != nil) != tt.wantErr {
+				t.Fatalf("createCNIConf() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var warned bool
+			for _, entry := range hook.AllEntries() {
+				if entry.Level == logrus.WarnLevel && strings.Contains(entry.Message, "CNIConfDir is empty") {
+					warned = true
+				}
+			}
+			if warned != tt.wantWarn {
+				t.Errorf("createCNIConf() warned = %v, want %v", warned, tt.wantWarn)
+			}
+		})
+	}
+}
+
+func Test_writeConf(t *testing.T) {
+	oldWriteConfFile, oldWriteConfBackoff := writeConfFile, writeConfBackoff
+	t.Cleanup(func() {
+		writeConfFile = oldWriteConfFile
+		writeConfBackoff = oldWriteConfBackoff
+	})
+	writeConfBackoff.Duration = time.Millisecond
+
+	tests := []struct {
+		name      string
+		err       error
+		failures  int
+		wantCalls int
+		wantErr   bool
+	}{
+		{"success", nil, 0, 1, false},
+		{"transient", syscall.EIO, 2, 3, false},
+		{"transient exhausted", syscall.EIO, 10, writeConfBackoff.Steps, true},
+		{"permission denied", &os.PathError{Op: "open", Path: "conf", Err: syscall.EACCES}, 10, 1, true},
+		{"read-only filesystem", &os.PathError{Op: "open", Path: "conf", Err: syscall.EROFS}, 10, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			var calls int
+			writeConfFile = func(name, content string) error {
+				calls++
+				if calls <= tt.failures {
+					return fmt.Errorf("writing %s: %w", name, tt.err)
+				}
+				return oldWriteConfFile(name, content)
+			}
+			p := filepath.Join(dir, "net-conf.json")
+			err := writeConf(p, "{}")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("writeConf() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("writeConf() made %d write attempts, want %d", calls, tt.wantCalls)
+			}
+			if !tt.wantErr {
+				assertFileContains(t, p, []string{`^\{\}$`})
+			}
+		})
+	}
+}
+
+type testCNIConfGenerator struct {
+	conf string
+	err  error
+}
+
+func (g testCNIConfGenerator) Generate(nodeConfig *config.Node) (string, error) {
+	return strings.ReplaceAll(g.conf, "%NODE%", nodeConfig.AgentConfig.NodeName), g.err
+}
+
+func Test_RegisterCNIConfGenerator(t *testing.T) {
+	t.Cleanup(func() { RegisterCNIConfGenerator(nil) })
+
+	tests := []struct {
+		name       string
+		generator  CNIConfGenerator
+		wantConfig []string
+		wantErr    bool
+	}{
+		{"default", nil, []string{`"type":\s*"flannel"`}, false},
+		{"custom", testCNIConfGenerator{conf: `{"name":"custom","node":"%NODE%"}`}, []string{`^\{"name":"custom","node":"test-node"\}$`}, false},
+		{"custom error", testCNIConfGenerator{err: errors.New("no CNI chain for this environment")}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			RegisterCNIConfGenerator(tt.generator)
+			dir := t.TempDir()
+			nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN)
+			nodeConfig.AgentConfig.NodeName = "test-node"
+			if err := createCNIConf(dir, nodeConfig); (err != nil) != tt.wantErr {
+				t.Fatalf("createCNIConf() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			p := filepath.Join(dir, "10-flannel.conflist")
+			assertFileContains(t, p, tt.wantConfig)
+			assertValidJSON(t, p)
+		})
+	}
+}
+
+func Test_createFlannelConfOverride(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		missing bool
+		wantErr string
+	}{
+		{"valid", `{"Network":"10.244.0.0/16","Backend":{"Type":"vxlan"}}`, false, ""},
+		{"missing", "", true, "failed to read custom flannel conf"},
+		{"malformed", `{"Network":"10.244.0.0/16",`, false, "is not a valid JSON object"},
+		{"not an object", `["10.244.0.0/16"]`, false, "is not a valid JSON object"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN)
+			nodeConfig.FlannelConfOverride = true
+			if !tt.missing {
+				if err := os.WriteFile(nodeConfig.FlannelConfFile, []byte(tt.content), 0644); err != nil {
+					t.Fatalf("Failed to write flannel conf: %v", err)
+				}
+			}
+			err := createFlannelConf(nodeConfig)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("createFlannelConf() error = %v", err)
+				}
+				assertNetConf(t, nodeConfig.FlannelConfFile, `{"Network": "10.244.0.0/16"}`)
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("createFlannelConf() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_backendAlloc(t *testing.T) {
+	nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendAlloc)
+	if err := createFlannelConf(nodeConfig); err != nil {
+		t.Fatalf("createFlannelConf() error = %v", err)
+	}
+	assertNetConf(t, nodeConfig.FlannelConfFile, `{"Backend": {"Type": "alloc"}}`)
+	if got := backendInterfaces(nodeConfig, ipv4); len(got) != 0 {
+		t.Errorf("backendInterfaces() = %v, want none for the alloc backend", got)
+	}
+
+	// Flannel is still started to lease the subnet, without choosing among the node's interfaces
+	oldListInterfaces := listInterfaces
+	t.Cleanup(func() { listInterfaces = oldListInterfaces })
+	listInterfaces = func() ([]net.Interface, error) { return nil, errors.New("interfaces listed") }
+	nodeConfig.FlannelIfaceExclude = []string{"docker*"}
+	nodeConfig.FlannelDryRun = true
+	hook := logtest.NewGlobal()
+	t.Cleanup(func() { logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks)) })
+	if err := Run(context.Background(), nodeConfig, fake.NewSimpleClientset().CoreV1().Nodes()); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	var started bool
+	for _, entry := range hook.AllEntries() {
+		if strings.HasPrefix(entry.Message, "Dry run: not starting flannel") {
+			started = true
+			if strings.Contains(entry.Message, "--iface") {
+				t.Errorf("Run() passed interfaces to flannel for the alloc backend: %s", entry.Message)
+			}
+		}
+	}
+	if !started {
+		t.Errorf("Run() did not start flannel for the alloc backend")
+	}
+}
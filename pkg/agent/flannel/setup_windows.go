@@ -3,10 +3,15 @@
 
 package flannel
 
+// vxlanGBPSupported returns false, as flannel does not support vxlan GBP on Windows.
+var vxlanGBPSupported = func() bool {
+	return false
+}
+
 const (
 	cniConf = `{
   "name":"flannel.4096",
-  "cniVersion":"1.0.0",
+  "cniVersion":"%CNI_VERSION%",
   "plugins":[
     {
       "type":"flannel",
@@ -51,9 +56,7 @@ const (
 }
 `
 
-	vxlanBackend = `{
-	"Type": "vxlan",
-	"VNI": 4096,
-	"Port": 4789
-}`
+	// The Windows overlay network requires the VNI and Port to be set explicitly
+	vxlanDefaultVNI  = 4096
+	vxlanDefaultPort = 4789
 )
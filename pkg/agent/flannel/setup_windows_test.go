@@ -0,0 +1,38 @@
+//go:build windows
+// +build windows
+
+package flannel
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/k3s-io/k3s/pkg/daemons/config"
+)
+
+func Test_PrepareUnsupportedBackend(t *testing.T) {
+	for _, backend := range []string{config.FlannelBackendWireguardNative, config.FlannelBackendIPIP, config.FlannelBackendHostGWVXLAN} {
+		t.Run(backend, func(t *testing.T) {
+			nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", backend)
+			nodeConfig.AgentConfig.CNIConfDir = t.TempDir()
+			if err := Prepare(context.Background(), nodeConfig); err == nil {
+				t.Fatalf("Prepare() expected unsupported backend error for %s, got nil", backend)
+			}
+			if _, err := os.Stat(filepath.Join(nodeConfig.AgentConfig.CNIConfDir, "10-flannel.conflist")); !os.IsNotExist(err) {
+				t.Errorf("Prepare() wrote a CNI conf for unsupported backend %s", backend)
+			}
+			if _, err := os.Stat(nodeConfig.FlannelConfFile); !os.IsNotExist(err) {
+				t.Errorf("Prepare() wrote a flannel conf for unsupported backend %s", backend)
+			}
+		})
+	}
+}
+
+func Test_backendInterfacesWindows(t *testing.T) {
+	nodeConfig := newTestNodeConfig(t, "10.42.0.0/16", config.FlannelBackendVXLAN)
+	if got := backendInterfaces(nodeConfig, ipv4); got != nil {
+		t.Errorf("backendInterfaces() = %v, want none on Windows", got)
+	}
+}
@@ -0,0 +1,38 @@
+package flannel
+
+import (
+	"net"
+
+	utilsnet "k8s.io/utils/net"
+)
+
+// NodeSubnet is the subnet that flannel uses for a node in one address family, and the gateway address
+// on the node's CNI bridge.
+type NodeSubnet struct {
+	Subnet  *net.IPNet
+	Gateway net.IP
+}
+
+// ExpectedSubnets returns the subnets that flannel will use for a node with the given PodCIDRs, in the
+// same order, so that they can be known before flannel has started on the node. The networks are the
+// flannel networks, normally the cluster CIDRs; an error is returned if a PodCIDR is not within the
+// network of its address family, as flannel then refuses to start.
+// With the kube subnet manager, flannel uses each PodCIDR as the node's subnet, so the subnet length
+// is the PodCIDR mask size set by the controller-manager, even if a flannel SubnetLen is configured.
+// Subnets leased by the etcd subnet manager are chosen by flannel and cannot be predicted.
+func ExpectedSubnets(podCIDRs []string, networks []*net.IPNet) ([]NodeSubnet, error) {
+	if err := validatePodCIDRs(podCIDRs, networks); err != nil {
+		return nil, err
+	}
+	subnets := make([]NodeSubnet, 0, len(podCIDRs))
+	for _, podCIDR := range podCIDRs {
+		_, podNet, _ := net.ParseCIDR(podCIDR)
+		subnets = append(subnets, NodeSubnet{Subnet: podNet, Gateway: subnetGateway(podNet)})
+	}
+	return subnets, nil
+}
+
+// subnetGateway returns the first address of the subnet, which the CNI plugin assigns to the bridge.
+func subnetGateway(subnet *net.IPNet) net.IP {
+	return utilsnet.AddIPOffset(utilsnet.BigForIP(subnet.IP), 1)
+}
@@ -0,0 +1,105 @@
+package flannel
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_ExpectedSubnets(t *testing.T) {
+	tests := []struct {
+		name         string
+		podCIDRs     []string
+		networks     string
+		wantSubnets  []string
+		wantGateways []string
+		wantErr      bool
+	}{
+		{
+			name:         "default /24",
+			podCIDRs:     []string{"10.42.3.0/24"},
+			networks:     "10.42.0.0/16",
+			wantSubnets:  []string{"10.42.3.0/24"},
+			wantGateways: []string{"10.42.3.1"},
+		},
+		{
+			name:         "/26 from a /20",
+			podCIDRs:     []string{"10.42.1.192/26"},
+			networks:     "10.42.0.0/20",
+			wantSubnets:  []string{"10.42.1.192/26"},
+			wantGateways: []string{"10.42.1.193"},
+		},
+		{
+			name:         "/22 from a /8",
+			podCIDRs:     []string{"10.8.4.0/22"},
+			networks:     "10.0.0.0/8",
+			wantSubnets:  []string{"10.8.4.0/22"},
+			wantGateways: []string{"10.8.4.1"},
+		},
+		{
+			name:         "ipv6 /64",
+			podCIDRs:     []string{"2001:cafe:42:5::/64"},
+			networks:     "2001:cafe:42::/56",
+			wantSubnets:  []string{"2001:cafe:42:5::/64"},
+			wantGateways: []string{"2001:cafe:42:5::1"},
+		},
+		{
+			name:         "dual-stack",
+			podCIDRs:     []string{"2001:cafe:42:1::/64", "10.42.1.0/24"},
+			networks:     "10.42.0.0/16,2001:cafe:42::/56",
+			wantSubnets:  []string{"2001:cafe:42:1::/64", "10.42.1.0/24"},
+			wantGateways: []string{"2001:cafe:42:1::1", "10.42.1.1"},
+		},
+		{
+			name:         "no PodCIDR",
+			networks:     "10.42.0.0/16",
+			wantSubnets:  []string{},
+			wantGateways: []string{},
+		},
+		{
+			name:     "outside the network",
+			podCIDRs: []string{"10.43.0.0/24"},
+			networks: "10.42.0.0/16",
+			wantErr:  true,
+		},
+		{
+			name:     "larger than the network",
+			podCIDRs: []string{"10.42.0.0/15"},
+			networks: "10.42.0.0/16",
+			wantErr:  true,
+		},
+		{
+			name:     "no network for the family",
+			podCIDRs: []string{"2001:cafe:42:1::/64"},
+			networks: "10.42.0.0/16",
+			wantErr:  true,
+		},
+		{
+			name:     "invalid",
+			podCIDRs: []string{"10.42.0.0"},
+			networks: "10.42.0.0/16",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ExpectedSubnets(tt.podCIDRs, stringToCIDR(tt.networks))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ExpectedSubnets() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			gotSubnets, gotGateways := []string{}, []string{}
+			for _, subnet := range got {
+				gotSubnets = append(gotSubnets, subnet.Subnet.String())
+				gotGateways = append(gotGateways, subnet.Gateway.String())
+			}
+			if !reflect.DeepEqual(gotSubnets, tt.wantSubnets) {
+				t.Errorf("ExpectedSubnets() subnets = %v, want %v", gotSubnets, tt.wantSubnets)
+			}
+			if !reflect.DeepEqual(gotGateways, tt.wantGateways) {
+				t.Errorf("ExpectedSubnets() gateways = %v, want %v", gotGateways, tt.wantGateways)
+			}
+		})
+	}
+}
@@ -141,9 +141,10 @@ func run(ctx context.Context, cfg cmds.Agent, proxy proxy.Proxy) error {
 		} else if (nodeConfig.FlannelExternalIP) && (nodeConfig.FlannelBackend != daemonconfig.FlannelBackendWireguardNative) {
 			logrus.Warnf("Flannel is using external addresses with an insecure backend: %v. Please consider using an encrypting flannel backend.", nodeConfig.FlannelBackend)
 		}
-		if err := flannel.Prepare(ctx, nodeConfig); err != nil {
-			return err
-		}
+	}
+	// Prepare is also called with the none backend, as a CNI conf may still be requested
+	if err := flannel.Prepare(ctx, nodeConfig); err != nil {
+		return err
 	}
 
 	if nodeConfig.Docker {
@@ -187,7 +188,7 @@ func run(ctx context.Context, cfg cmds.Agent, proxy proxy.Proxy) error {
 	}
 
 	if !nodeConfig.NoFlannel {
-		if err := flannel.Run(ctx, nodeConfig, coreClient.CoreV1().Nodes()); err != nil {
+		if err := flannel.RunWithRetry(ctx, nodeConfig, coreClient.CoreV1().Nodes()); err != nil {
 			return err
 		}
 	}
@@ -480,12 +481,13 @@ func updateAddressAnnotations(nodeConfig *daemonconfig.Node, nodeAnnotations map
 	if agentConfig.NodeExternalIP != "" {
 		result[cp.ExternalIPKey] = util.JoinIPs(agentConfig.NodeExternalIPs)
 		if nodeConfig.FlannelExternalIP {
+			ipv4Annotation, ipv6Annotation := flannel.ExternalIPAnnotations(nodeConfig)
 			for _, ipAddress := range agentConfig.NodeExternalIPs {
 				if utilsnet.IsIPv4(ipAddress) {
-					result[flannel.FlannelExternalIPv4Annotation] = ipAddress.String()
+					result[ipv4Annotation] = ipAddress.String()
 				}
 				if utilsnet.IsIPv6(ipAddress) {
-					result[flannel.FlannelExternalIPv6Annotation] = ipAddress.String()
+					result[ipv6Annotation] = ipAddress.String()
 				}
 			}
 		}
@@ -1,15 +1,25 @@
 package util
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"syscall"
 
 	"github.com/pkg/errors"
 )
 
 func WriteFile(name string, content string) error {
-	os.MkdirAll(filepath.Dir(name), 0755)
-	err := os.WriteFile(name, []byte(content), 0644)
+	return WriteFileMode(name, content, 0644)
+}
+
+// WriteFileMode writes the file with the given permissions. The permissions are also applied if the
+// file already exists, as it is replaced rather than written in place.
+func WriteFileMode(name string, content string, perm os.FileMode) error {
+	if err := ensureDir(filepath.Dir(name)); err != nil {
+		return errors.Wrapf(err, "writing %s", name)
+	}
+	err := atomicWrite(name, []byte(content), perm)
 	if err != nil {
 		return errors.Wrapf(err, "writing %s", name)
 	}
@@ -17,16 +27,55 @@ func WriteFile(name string, content string) error {
 }
 
 func CopyFile(sourceFile string, destinationFile string, ignoreNotExist bool) error {
-	os.MkdirAll(filepath.Dir(destinationFile), 0755)
+	if err := ensureDir(filepath.Dir(destinationFile)); err != nil {
+		return errors.Wrapf(err, "copying %s to %s", sourceFile, destinationFile)
+	}
 	input, err := os.ReadFile(sourceFile)
 	if errors.Is(err, os.ErrNotExist) && ignoreNotExist {
 		return nil
 	} else if err != nil {
 		return errors.Wrapf(err, "copying %s to %s", sourceFile, destinationFile)
 	}
-	err = os.WriteFile(destinationFile, input, 0644)
+	err = atomicWrite(destinationFile, input, 0644)
 	if err != nil {
 		return errors.Wrapf(err, "copying %s to %s", sourceFile, destinationFile)
 	}
 	return nil
 }
+
+// ensureDir creates the directory and any missing parents. A file in the way is reported
+// explicitly, as the error from MkdirAll does not say which path component is at fault; the
+// error wraps ENOTDIR, so that callers can still tell what went wrong.
+func ensureDir(dir string) error {
+	if info, err := os.Stat(dir); err == nil && !info.IsDir() {
+		return fmt.Errorf("%s exists but is %w", dir, syscall.ENOTDIR)
+	}
+	return os.MkdirAll(dir, 0755)
+}
+
+// atomicWrite writes data to a temp file in the same directory, then renames it over the destination
+// file, so that readers never observe a partially written file.
+func atomicWrite(name string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := f.Name()
+	defer os.Remove(tmpName)
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, name)
+}
@@ -32,8 +32,11 @@ type Agent struct {
 	DefaultRuntime           string
 	ImageServiceEndpoint     string
 	FlannelIface             string
+	FlannelIfaceExclude      cli.StringSlice
 	FlannelConf              string
 	FlannelCniConfFile       string
+	FlannelCniConfTemplate   string
+	FlannelCniConfForce      bool
 	VPNAuth                  string
 	VPNAuthFile              string
 	Debug                    bool
@@ -155,9 +158,14 @@ var (
 	}
 	FlannelIfaceFlag = &cli.StringFlag{
 		Name:        "flannel-iface",
-		Usage:       "(agent/networking) Override default flannel interface",
+		Usage:       "(agent/networking) Override default flannel interface; with a comma-separated list, flannel uses the first interface that is usable",
 		Destination: &AgentConfig.FlannelIface,
 	}
+	FlannelIfaceExcludeFlag = &cli.StringSliceFlag{
+		Name:  "flannel-iface-exclude",
+		Usage: "(agent/networking) Regular expression matching interface names that flannel should not use when auto-detecting its interface",
+		Value: &AgentConfig.FlannelIfaceExclude,
+	}
 	FlannelConfFlag = &cli.StringFlag{
 		Name:        "flannel-conf",
 		Usage:       "(agent/networking) Override default flannel config file",
@@ -168,6 +176,16 @@ var (
 		Usage:       "(agent/networking) Override default flannel cni config file",
 		Destination: &AgentConfig.FlannelCniConfFile,
 	}
+	FlannelCniConfTemplateFlag = &cli.StringFlag{
+		Name:        "flannel-cni-conf-template",
+		Usage:       "(agent/networking) Override default flannel cni config template; supports the same placeholders as the default config",
+		Destination: &AgentConfig.FlannelCniConfTemplate,
+	}
+	FlannelCniConfForceFlag = &cli.BoolFlag{
+		Name:        "flannel-cni-conf-force",
+		Usage:       "(agent/networking) Overwrite an existing flannel cni config file that was edited since it was generated",
+		Destination: &AgentConfig.FlannelCniConfForce,
+	}
 	VPNAuth = &cli.StringFlag{
 		Name:        "vpn-auth",
 		Usage:       "(agent/networking) (experimental) Credentials for the VPN provider. It must include the provider name and join key in the format name=<vpn-provider>,joinKey=<key>[,controlServerURL=<url>][,extraArgs=<args>]",
@@ -297,8 +315,11 @@ func NewAgentCommand(action func(ctx *cli.Context) error) cli.Command {
 			NodeExternalIPFlag,
 			ResolvConfFlag,
 			FlannelIfaceFlag,
+			FlannelIfaceExcludeFlag,
 			FlannelConfFlag,
 			FlannelCniConfFileFlag,
+			FlannelCniConfTemplateFlag,
+			FlannelCniConfForceFlag,
 			ExtraKubeletArgs,
 			ExtraKubeProxyArgs,
 			// Experimental flags
@@ -216,7 +216,7 @@ var ServerFlags = []cli.Flag{
 	ClusterDomain,
 	&cli.StringFlag{
 		Name:        "flannel-backend",
-		Usage:       "(networking) Backend (valid values: 'none', 'vxlan', 'host-gw', 'wireguard-native'",
+		Usage:       "(networking) Backend (valid values: 'none', 'vxlan', 'host-gw', 'host-gw-vxlan', 'wireguard-native', 'ipip', 'alloc'",
 		Destination: &ServerConfig.FlannelBackend,
 		Value:       "vxlan",
 	},
@@ -541,8 +541,11 @@ var ServerFlags = []cli.Flag{
 	NodeExternalIPFlag,
 	ResolvConfFlag,
 	FlannelIfaceFlag,
+	FlannelIfaceExcludeFlag,
 	FlannelConfFlag,
 	FlannelCniConfFileFlag,
+	FlannelCniConfTemplateFlag,
+	FlannelCniConfForceFlag,
 	VPNAuth,
 	VPNAuthFile,
 	ExtraKubeletArgs,
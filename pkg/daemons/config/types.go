@@ -8,6 +8,7 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/k3s-io/k3s/pkg/generated/controllers/k3s.cattle.io"
 	"github.com/k3s-io/kine/pkg/endpoint"
@@ -25,8 +26,11 @@ const (
 	FlannelBackendNone            = "none"
 	FlannelBackendVXLAN           = "vxlan"
 	FlannelBackendHostGW          = "host-gw"
+	FlannelBackendHostGWVXLAN     = "host-gw-vxlan"
 	FlannelBackendWireguardNative = "wireguard-native"
 	FlannelBackendTailscale       = "tailscale"
+	FlannelBackendIPIP            = "ipip"
+	FlannelBackendAlloc           = "alloc"
 	EgressSelectorModeAgent       = "agent"
 	EgressSelectorModeCluster     = "cluster"
 	EgressSelectorModeDisabled    = "disabled"
@@ -36,30 +40,74 @@ const (
 )
 
 type Node struct {
-	Docker                   bool
-	ContainerRuntimeEndpoint string
-	ImageServiceEndpoint     string
-	NoFlannel                bool
-	SELinux                  bool
-	EnablePProf              bool
-	SupervisorMetrics        bool
-	EmbeddedRegistry         bool
-	FlannelBackend           string
-	FlannelConfFile          string
-	FlannelConfOverride      bool
-	FlannelIface             *net.Interface
-	FlannelIPv6Masq          bool
-	FlannelExternalIP        bool
-	EgressSelectorMode       string
-	Containerd               Containerd
-	CRIDockerd               CRIDockerd
-	Images                   string
-	AgentConfig              Agent
-	Token                    string
-	Certificate              *tls.Certificate
-	ServerHTTPSPort          int
-	SupervisorPort           int
-	DefaultRuntime           string
+	Docker                    bool
+	ContainerRuntimeEndpoint  string
+	ImageServiceEndpoint      string
+	NoFlannel                 bool
+	SELinux                   bool
+	EnablePProf               bool
+	SupervisorMetrics         bool
+	EmbeddedRegistry          bool
+	FlannelBackend            string
+	FlannelConfFile           string
+	FlannelConfOverride       bool
+	FlannelRuntimeDir         string
+	FlannelReadyFile          string
+	FlannelIface              *net.Interface
+	FlannelIfaces             []string
+	FlannelIfaceExclude       []string
+	FlannelCIDROverlapFatal   bool
+	FlannelIPv6Masq           bool
+	FlannelNoIPMasq           bool
+	FlannelDisableMasq        bool
+	FlannelExternalIP         bool
+	FlannelPublicIP           string
+	FlannelDirectRouting      bool
+	FlannelVXLANGBP           bool
+	FlannelVNI                int
+	FlannelPort               int
+	FlannelMTU                int
+	FlannelMTUProbe           bool
+	FlannelConnectivityProbe  bool
+	FlannelBackendConfig      string
+	FlannelNetConfExtra       map[string]interface{}
+	FlannelWireguardPort      int
+	FlannelWireguardKeepalive int
+	FlannelPodCIDRTimeout     time.Duration
+	FlannelSubnetLen          int
+	FlannelSubnetMin          string
+	FlannelSubnetMax          string
+	FlannelNetworkFromNodes   bool
+	FlannelNetworks           []*net.IPNet
+	FlannelExternalProcess    bool
+	FlannelBinary             string
+	FlannelNetns              string
+	FlannelSubnetFile         string
+	FlannelHealthzIP          string
+	FlannelHealthzPort        int
+	FlannelKubeConfig         string
+	FlannelKubeAPIURL         string
+	FlannelAnnotationPrefix   string
+	FlannelEtcdEndpoints      []string
+	FlannelEtcdPrefix         string
+	FlannelEtcdCAFile         string
+	FlannelEtcdCertFile       string
+	FlannelEtcdKeyFile        string
+	FlannelExtraArgs          []string
+	FlannelLogLevel           *int
+	FlannelDryRun             bool
+	FlannelCleanupOnStop      bool
+	FlannelNFTables           bool
+	EgressSelectorMode        string
+	Containerd                Containerd
+	CRIDockerd                CRIDockerd
+	Images                    string
+	AgentConfig               Agent
+	Token                     string
+	Certificate               *tls.Certificate
+	ServerHTTPSPort           int
+	SupervisorPort            int
+	DefaultRuntime            string
 }
 
 type EtcdS3 struct {
@@ -129,6 +177,20 @@ type Agent struct {
 	ClientCA                string
 	CNIBinDir               string
 	CNIConfDir              string
+	CNINoHairpinMode        bool
+	CNINoDefaultGateway     bool
+	CNINoForceAddress       bool
+	CNINoPortmap            bool
+	CNIHostPortRange        string
+	CNIVersion              string
+	CNIConfForce            bool
+	CNINetworkName          string
+	CNINoIPMasq             bool
+	CNIConfShadowFatal      bool
+	CNIConfPrefix           string
+	CNIConfSinglePlugin     bool
+	DisableCNIConf          bool
+	CNIConfDirRequired      bool
 	ExtraKubeletArgs        []string
 	ExtraKubeProxyArgs      []string
 	PauseImage              string
@@ -141,6 +203,8 @@ type Agent struct {
 	ImageCredProvConfig     string
 	IPSECPSK                string
 	FlannelCniConfFile      string
+	FlannelCniConfTemplate  string
+	FlannelCniConfPlugins   string
 	Registry                *registries.Registry
 	SystemDefaultRegistry   string
 	AirgapExtraRegistry     []string